@@ -8,7 +8,10 @@ import (
 	"github.com/fatih/color"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 const banner = `       _     _                         _   
@@ -19,7 +22,7 @@ const banner = `       _     _                         _
      REST Server for MkDocs projects.
 ===========================================
 
-Listening at: %s:%d
+Listening at: %s://%s:%d
 Document path: %s
 
 `
@@ -30,29 +33,66 @@ var rootCmd = &cobra.Command{
 	Short: "REST Server for MkDocs projects.",
 	Long:  `mkdocsrest is the backend companion for the MkDocsEditor project.`,
 	// this is the default command to run when no subcommand is specified
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// errors past this point are caused by the configuration, not by the command line
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+
 		setupUi()
 		printStartupInfo()
 
 		treeManager := backend.NewTreeManager()
-
-		action := func(s string) { treeManager.CreateItemTree() }
+		auditLog := backend.NewAuditLog()
+		rateLimits := backend.NewRateLimits()
+
+		automergeStateStore, err := backend.NewAutomergeStateStore(configuration.CurrentConfig.Sync.StateDir)
+		if err != nil {
+			log.Fatalf("Unable to create state directory: %v", err)
+		}
+		presenceManager := backend.NewPresenceManager()
+		lockManager := backend.NewLockManager(treeManager)
+		commentManager := backend.NewCommentManager(configuration.CurrentConfig.Sync.StateDir)
+		suggestionManager := backend.NewSuggestionManager(configuration.CurrentConfig.Sync.StateDir)
+		actorRegistry := backend.NewActorRegistry(configuration.CurrentConfig.Sync.StateDir)
+		documentPersister := backend.NewDocumentPersister(treeManager, auditLog)
+		automergeSyncManager := backend.NewAutomergeSyncManager(treeManager, documentPersister, automergeStateStore, presenceManager, lockManager, commentManager, suggestionManager, actorRegistry)
+		// diff-sync clients edit the same documents as the automerge clients
+		diffSyncManager := backend.NewSyncManager(treeManager, automergeSyncManager, lockManager)
+		automergeSyncManager.SetOnContentChangedListener(diffSyncManager.HandleContentChanged)
+
+		action := func(s string) {
+			treeManager.CreateItemTree()
+			automergeSyncManager.MergeExternalChanges()
+		}
 		path := configuration.CurrentConfig.MkDocs.DocsPath
 		fileWatcher := backend.NewFileWatcher(path, action)
 		fileWatcher.WatchDirRecursive()
 
-		//syncManager := backend.NewSyncManager(treeManager)
-		automergeSyncManager := backend.NewAutomergeSyncManager(treeManager)
-
-		restService := backend.NewRestService(treeManager, automergeSyncManager)
-		//websocketConnectionManager := backend.NewWebsocketConnectionManager(treeManager)
-		automergeWebsocketConnectionManager := backend.NewWebsocketConnectionManager(treeManager)
-
-		restService.RegisterWebsocketHandler(automergeWebsocketConnectionManager)
-		//syncManager.SetWebsocketConnectionManager(websocketConnectionManager)
-		automergeSyncManager.SetWebsocketConnectionManager(automergeWebsocketConnectionManager)
+		sessionManager := backend.NewSessionManager()
+		oidcAuthenticator, err := backend.NewOIDCAuthenticator(sessionManager, auditLog)
+		if err != nil {
+			return err
+		}
+		authenticator := backend.NewAuthenticator(sessionManager, oidcAuthenticator, auditLog, rateLimits)
+
+		restService := backend.NewRestService(treeManager, automergeSyncManager, authenticator, oidcAuthenticator, auditLog, rateLimits, presenceManager, lockManager, commentManager, suggestionManager)
+		websocketConnectionManager := backend.NewWebsocketConnectionManager(treeManager, rateLimits)
+
+		restService.RegisterWebsocketHandler(websocketConnectionManager)
+		automergeSyncManager.SetWebsocketConnectionManager(websocketConnectionManager)
+		diffSyncManager.SetWebsocketConnectionManager(websocketConnectionManager)
+
+		// write pending changes before the process exits
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			documentPersister.FlushAll()
+			os.Exit(0)
+		}()
 
 		restService.Start()
+		return nil
 	},
 }
 
@@ -71,11 +111,16 @@ func printStartupInfo() {
 	green := color.New(color.FgGreen).PrintfFunc()
 	warning := color.New(color.FgYellow).PrintfFunc()
 
-	green(banner, configuration.CurrentConfig.Server.Host, configuration.CurrentConfig.Server.Port, configuration.CurrentConfig.MkDocs.DocsPath)
+	scheme := "http"
+	if configuration.CurrentConfig.Server.TLS.IsEnabled() {
+		scheme = "https"
+	}
+
+	green(banner, scheme, configuration.CurrentConfig.Server.Host, configuration.CurrentConfig.Server.Port, configuration.CurrentConfig.MkDocs.DocsPath)
 
 	var auth = configuration.CurrentConfig.Server.BasicAuth
-	if auth.User == "" && auth.Password == "" {
-		warning("WARNING: No basic auth values set in configuration, unauthorized access to all files in document path is possible!")
+	if auth.User == "" && auth.Password == "" && !configuration.CurrentConfig.Server.OIDC.IsEnabled() && !configuration.CurrentConfig.Server.TLS.IsMutualTLSEnabled() {
+		warning("WARNING: Neither basic auth, OpenID Connect nor mutual TLS is set up in configuration, unauthorized access to all files in document path is possible!")
 	}
 
 	fmt.Println("")
@@ -85,7 +130,10 @@ func printStartupInfo() {
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	cobra.OnInitialize(func() {
-		configuration.InitConfig(global.CfgFile)
+		if err := configuration.InitConfig(global.CfgFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	})
 
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	mutexSync "sync"
+	"time"
+)
+
+const actorsFileName = "actors.jsonl"
+
+type (
+	// Actor is an automerge actor, which makes the changes of a single client or of the server on behalf of a user
+	Actor struct {
+		User         string    `json:"user" xml:"user" form:"user" query:"user"`
+		RegisteredAt time.Time `json:"registeredAt" xml:"registeredAt" form:"registeredAt" query:"registeredAt"`
+	}
+
+	// registeredActor is a line of the actors file
+	registeredActor struct {
+		ActorId string `json:"actorId"`
+		Actor
+	}
+)
+
+// ActorRegistry remembers which user the automerge actors belong to, so changes in the history of a document
+// can be attributed to users, the actors are appended to a file in the state directory and survive restarts
+type ActorRegistry struct {
+	stateDir string
+
+	lock mutexSync.Mutex
+	// actors hex encoded actor id -> actor, loaded on first access
+	actors map[string]Actor
+}
+
+func NewActorRegistry(stateDir string) *ActorRegistry {
+	return &ActorRegistry{
+		stateDir: stateDir,
+	}
+}
+
+// Register assigns the given actor to the given user, an actor keeps the user it has been registered with first
+func (ar *ActorRegistry) Register(actorId string, user string) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	err := ar.loadLocked()
+	if err != nil {
+		log.Printf("Unable to read registered actors: %v", err)
+		return
+	}
+	if _, ok := ar.actors[actorId]; ok {
+		return
+	}
+
+	actor := Actor{
+		User:         user,
+		RegisteredAt: time.Now(),
+	}
+	ar.actors[actorId] = actor
+
+	line, err := json.Marshal(registeredActor{ActorId: actorId, Actor: actor})
+	if err != nil {
+		log.Printf("Unable to encode registered actor %s: %v", actorId, err)
+		return
+	}
+	// an actor that is lost on a crash only loses the attribution of its changes, so the file is not synced
+	f, err := os.OpenFile(ar.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Unable to open registered actors: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to store registered actor %s: %v", actorId, err)
+	}
+}
+
+// Remove forgets the given actors, e.g. after the only document they have changed has been deleted
+func (ar *ActorRegistry) Remove(actorIds []string) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	err := ar.loadLocked()
+	if err != nil {
+		log.Printf("Unable to read registered actors: %v", err)
+		return
+	}
+	removed := false
+	for _, actorId := range actorIds {
+		if _, ok := ar.actors[actorId]; ok {
+			delete(ar.actors, actorId)
+			removed = true
+		}
+	}
+	if !removed {
+		return
+	}
+
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for actorId, actor := range ar.actors {
+		err = encoder.Encode(registeredActor{ActorId: actorId, Actor: actor})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writeFileAtomic(ar.path(), data.Bytes(), 0600)
+	}
+	if err != nil {
+		log.Printf("Unable to store registered actors: %v", err)
+	}
+}
+
+// GetUser returns the user of the given actor, or an empty string if the actor is unknown
+func (ar *ActorRegistry) GetUser(actorId string) string {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	err := ar.loadLocked()
+	if err != nil {
+		log.Printf("Unable to read registered actors: %v", err)
+		return ""
+	}
+	return ar.actors[actorId].User
+}
+
+// returns the path of the actors file
+func (ar *ActorRegistry) path() string {
+	return filepath.Join(ar.stateDir, actorsFileName)
+}
+
+// reads the registered actors from disk if necessary, must be called with the lock held
+func (ar *ActorRegistry) loadLocked() error {
+	if ar.actors != nil {
+		return nil
+	}
+
+	actors := make(map[string]Actor)
+	f, err := os.Open(ar.path())
+	if errors.Is(err, os.ErrNotExist) {
+		ar.actors = actors
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		var actor registeredActor
+		err = decoder.Decode(&actor)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// the last line may be incomplete after a crash
+			log.Printf("Ignoring the rest of the registered actors: %v", err)
+			break
+		}
+		if _, ok := actors[actor.ActorId]; !ok {
+			actors[actor.ActorId] = actor.Actor
+		}
+	}
+
+	ar.actors = actors
+	return nil
+}
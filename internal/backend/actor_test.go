@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"errors"
+	automerge "github.com/automerge/automerge-go"
+	"strings"
+	"testing"
+)
+
+func TestChangesOfForeignActorsAreRejected(t *testing.T) {
+	otherUser := &User{Name: "john", Roles: []string{RoleEditor}}
+
+	tests := []struct {
+		name string
+		// returns the actor the client makes its change with
+		actor func(s *testSyncSetup, client *testClient) string
+		// sends the whole document state instead of a sync message
+		offline  bool
+		rejected bool
+	}{
+		{
+			name:  "own actor",
+			actor: func(s *testSyncSetup, client *testClient) string { return client.client.ActorId },
+		},
+		{
+			name: "earlier actor of the same user",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				actorId := automerge.NewActorID()
+				s.actorRegistry.Register(actorId, testEditor.Name)
+				return actorId
+			},
+			offline: true,
+		},
+		{
+			name: "actor of another user",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				actorId := automerge.NewActorID()
+				s.actorRegistry.Register(actorId, otherUser.Name)
+				return actorId
+			},
+			rejected: true,
+		},
+		{
+			name: "actor of another user in an offline document",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				actorId := automerge.NewActorID()
+				s.actorRegistry.Register(actorId, otherUser.Name)
+				return actorId
+			},
+			offline:  true,
+			rejected: true,
+		},
+		{
+			name: "unknown actor",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				return automerge.NewActorID()
+			},
+			rejected: true,
+		},
+		{
+			name: "server actor of another user",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				return serverActorId(client.client.DocumentId(), otherUser.Name)
+			},
+			rejected: true,
+		},
+		{
+			name: "server actor of the same user",
+			actor: func(s *testSyncSetup, client *testClient) string {
+				actorId := serverActorId(client.client.DocumentId(), testEditor.Name)
+				s.actorRegistry.Register(actorId, testEditor.Name)
+				return actorId
+			},
+			rejected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": "# A\n"})
+			documentId := s.documentId("a.md")
+			client := s.connect(t, documentId, testEditor, ModeEdit)
+
+			if err := client.doc.SetActorID(tt.actor(s, client)); err != nil {
+				t.Fatal(err)
+			}
+			client.append("forged\n")
+			var err error
+			if tt.offline {
+				err = client.sendState()
+			} else {
+				err = client.sync()
+			}
+
+			var messageErr *messageError
+			rejected := errors.As(err, &messageErr) && messageErr.code == ErrorCodeForeignActor
+			if rejected != tt.rejected {
+				t.Fatalf("expected rejected = %v, got error %v", tt.rejected, err)
+			}
+			if !rejected && err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := s.syncManager.GetContent(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(content, "forged") == tt.rejected {
+				t.Fatalf("unexpected content of the shared document: %q", content)
+			}
+		})
+	}
+}
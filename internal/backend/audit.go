@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/labstack/echo/v4"
+	"log"
+	"os"
+	"path/filepath"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	AuditActionLogin       = "login"
+	AuditActionLoginFailed = "login-failed"
+	AuditActionLogout      = "logout"
+	AuditActionCreate      = "create"
+	AuditActionRename      = "rename"
+	AuditActionDelete      = "delete"
+	AuditActionSave        = "save"
+	AuditActionLock        = "lock"
+	AuditActionUnlock      = "unlock"
+	AuditActionDisconnect  = "disconnect"
+)
+
+type (
+	// AuditEntry is a single record of the audit log
+	AuditEntry struct {
+		Time       time.Time `json:"time" xml:"time" form:"time" query:"time"`
+		Action     string    `json:"action" xml:"action" form:"action" query:"action"`
+		User       string    `json:"user" xml:"user" form:"user" query:"user"`
+		RemoteAddr string    `json:"remoteAddr" xml:"remoteAddr" form:"remoteAddr" query:"remoteAddr"`
+		ItemType   string    `json:"itemType,omitempty" xml:"itemType,omitempty" form:"itemType" query:"itemType"`
+		ItemId     string    `json:"itemId,omitempty" xml:"itemId,omitempty" form:"itemId" query:"itemId"`
+		Path       string    `json:"path,omitempty" xml:"path,omitempty" form:"path" query:"path"`
+		// previous path of a renamed item
+		OldPath string `json:"oldPath,omitempty" xml:"oldPath,omitempty" form:"oldPath" query:"oldPath"`
+		// change of the file size caused by a document save
+		ByteDelta int64 `json:"byteDelta,omitempty" xml:"byteDelta,omitempty" form:"byteDelta" query:"byteDelta"`
+	}
+
+	// AuditQuery filters the entries of the audit log, empty fields match everything
+	AuditQuery struct {
+		User   string
+		ItemId string
+		From   time.Time
+		To     time.Time
+		Limit  int
+	}
+)
+
+// AuditLog appends a record of every mutating operation to a JSONL file
+type AuditLog struct {
+	lock mutexSync.Mutex
+	path string
+}
+
+func NewAuditLog() *AuditLog {
+	path := configuration.CurrentConfig.Server.Audit.File
+	if path != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0750)
+		if err != nil {
+			log.Printf("Unable to create directory for audit log %s: %v", path, err)
+		}
+	}
+
+	return &AuditLog{
+		path: path,
+	}
+}
+
+// IsEnabled returns true if an audit log file has been configured
+func (al *AuditLog) IsEnabled() bool {
+	return al.path != ""
+}
+
+// Record appends the given entry to the audit log
+func (al *AuditLog) Record(entry AuditEntry) {
+	if !al.IsEnabled() {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Unable to encode audit log entry: %v", err)
+		return
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	f, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Unable to open audit log %s: %v", al.path, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to write audit log entry: %v", err)
+	}
+}
+
+// RecordRequest records an operation that was triggered by the given REST request
+func (al *AuditLog) RecordRequest(c echo.Context, entry AuditEntry) {
+	entry.User = getUser(c).Name
+	entry.RemoteAddr = c.RealIP()
+	al.Record(entry)
+}
+
+// creates an audit entry for a document save caused by the given websocket client
+func newDocumentSaveAuditEntry(client *WebsocketClient, documentId string, path string, byteDelta int64) AuditEntry {
+	entry := AuditEntry{
+		Action:    AuditActionSave,
+		ItemType:  TypeDocument,
+		ItemId:    documentId,
+		Path:      path,
+		ByteDelta: byteDelta,
+	}
+	if client != nil {
+		entry.User = client.User.Name
+		entry.RemoteAddr = client.RemoteAddr
+	}
+	return entry
+}
+
+// Query returns all entries of the audit log matching the given query, oldest first
+func (al *AuditLog) Query(query AuditQuery) (entries []AuditEntry, err error) {
+	entries = []AuditEntry{}
+	if !al.IsEnabled() {
+		return entries, nil
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	f, err := os.Open(al.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// skip partially written lines
+			continue
+		}
+		if !query.matches(entry) {
+			continue
+		}
+
+		entries = append(entries, entry)
+		if query.Limit > 0 && len(entries) > query.Limit {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	if q.User != "" && q.User != entry.User {
+		return false
+	}
+	if q.ItemId != "" && q.ItemId != entry.ItemId {
+		return false
+	}
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.Time.After(q.To) {
+		return false
+	}
+	return true
+}
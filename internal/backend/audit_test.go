@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuditLogQuery(t *testing.T) {
+	previous := configuration.CurrentConfig
+	t.Cleanup(func() {
+		configuration.CurrentConfig = previous
+	})
+	configuration.CurrentConfig.Server.Audit.File = filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	al := NewAuditLog()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	records := []AuditEntry{
+		{Time: at(0), Action: AuditActionLogin, User: "jane"},
+		{Time: at(1), Action: AuditActionSave, User: "jane", ItemId: "a"},
+		{Time: at(2), Action: AuditActionSave, User: "john", ItemId: "a"},
+		{Time: at(3), Action: AuditActionRename, User: "jane", ItemId: "b"},
+		{Time: at(4), Action: AuditActionDelete, User: "john", ItemId: "b"},
+	}
+	for i, entry := range records {
+		entry.Path = strconv.Itoa(i)
+		al.Record(entry)
+	}
+	// a line that has only been written partially, e.g. because the server crashed
+	f, err := os.OpenFile(configuration.CurrentConfig.Server.Audit.File, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"time":"2024-05-01T12:05:00Z","action":"sa` + "\n")
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		// paths of the expected entries, i.e. their index in the log
+		expected []string
+	}{
+		{name: "everything", query: AuditQuery{}, expected: []string{"0", "1", "2", "3", "4"}},
+		{name: "user", query: AuditQuery{User: "john"}, expected: []string{"2", "4"}},
+		{name: "item", query: AuditQuery{ItemId: "a"}, expected: []string{"1", "2"}},
+		{name: "user and item", query: AuditQuery{User: "jane", ItemId: "b"}, expected: []string{"3"}},
+		{name: "from", query: AuditQuery{From: at(3)}, expected: []string{"3", "4"}},
+		{name: "to", query: AuditQuery{To: at(1)}, expected: []string{"0", "1"}},
+		{name: "from and to", query: AuditQuery{From: at(1), To: at(3)}, expected: []string{"1", "2", "3"}},
+		{name: "limit keeps the newest entries", query: AuditQuery{Limit: 2}, expected: []string{"3", "4"}},
+		{name: "limit after filtering", query: AuditQuery{User: "jane", Limit: 2}, expected: []string{"1", "3"}},
+		{name: "limit larger than the result", query: AuditQuery{ItemId: "b", Limit: 5}, expected: []string{"3", "4"}},
+		{name: "no match", query: AuditQuery{User: "joe"}, expected: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := al.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := []string{}
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+			}
+			if !slices.Equal(paths, tt.expected) {
+				t.Fatalf("expected entries %v, got %v", tt.expected, paths)
+			}
+		})
+	}
+}
+
+func TestAuditLogQueryWithoutFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file func(t *testing.T) string
+	}{
+		{name: "disabled", file: func(t *testing.T) string { return "" }},
+		{name: "nothing recorded yet", file: func(t *testing.T) string { return filepath.Join(t.TempDir(), "audit.jsonl") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			al := &AuditLog{path: tt.file(t)}
+			entries, err := al.Query(AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries == nil || len(entries) != 0 {
+				t.Fatalf("expected an empty list, got %v", entries)
+			}
+		})
+	}
+}
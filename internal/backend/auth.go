@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	// RoleContributor users may only propose changes, their websocket connections are always in suggestion mode
+	RoleContributor = "contributor"
+	RoleViewer      = "viewer"
+
+	contextKeyUser = "user"
+
+	EndpointPathLogin    = "/auth/login/"
+	EndpointPathCallback = "/auth/callback/"
+	EndpointPathLogout   = "/auth/logout/"
+	EndpointPathUser     = "/auth/user/"
+)
+
+type (
+	// User is an authenticated user of the server
+	User struct {
+		Name  string   `json:"name" xml:"name" form:"name" query:"name"`
+		Roles []string `json:"roles" xml:"roles" form:"roles" query:"roles"`
+	}
+)
+
+// HasRole returns true if the user has been granted the given role (or a role that includes it)
+func (u *User) HasRole(role string) bool {
+	if slices.Contains(u.Roles, RoleAdmin) {
+		return true
+	}
+	if role == RoleViewer && (slices.Contains(u.Roles, RoleEditor) || slices.Contains(u.Roles, RoleContributor)) {
+		return true
+	}
+	return slices.Contains(u.Roles, role)
+}
+
+// the user used if no authentication is configured at all
+var anonymousUser = &User{
+	Name:  "anonymous",
+	Roles: []string{RoleAdmin},
+}
+
+// Authenticator authenticates incoming requests using a client certificate, a login session or basic auth credentials
+type Authenticator struct {
+	sessionManager *SessionManager
+	oidc           *OIDCAuthenticator
+	auditLog       *AuditLog
+	rateLimits     *RateLimits
+}
+
+func NewAuthenticator(
+	sessionManager *SessionManager,
+	oidc *OIDCAuthenticator,
+	auditLog *AuditLog,
+	rateLimits *RateLimits,
+) *Authenticator {
+	return &Authenticator{
+		sessionManager: sessionManager,
+		oidc:           oidc,
+		auditLog:       auditLog,
+		rateLimits:     rateLimits,
+	}
+}
+
+// returns true if any kind of authentication has been configured
+func (a *Authenticator) isEnabled() bool {
+	return a.isBasicAuthEnabled() || a.oidc != nil || configuration.CurrentConfig.Server.TLS.IsMutualTLSEnabled()
+}
+
+func (a *Authenticator) isBasicAuthEnabled() bool {
+	var authConf = configuration.CurrentConfig.Server.BasicAuth
+	return authConf.User != "" && authConf.Password != ""
+}
+
+// Middleware returns an echo middleware that resolves the user of a request and rejects unauthenticated requests
+func (a *Authenticator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Path() {
+			case EndpointPathAlive, EndpointPathLogin, EndpointPathCallback:
+				return next(c)
+			}
+
+			user, retryAfter := a.authenticate(c)
+			if retryAfter > 0 {
+				return tooManyRequests(c, retryAfter)
+			}
+			if user == nil {
+				return a.rejectUnauthenticated(c)
+			}
+			c.Set(contextKeyUser, user)
+
+			// only editors are allowed to change anything, except for taking part in the comment threads
+			// of a document, only the authors of comments and replies and admins may delete them
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if c.Path() == EndpointPathLogout {
+					break
+				}
+				requiredRole := RoleEditor
+				if strings.HasPrefix(c.Path(), pathDocumentComments) {
+					requiredRole = RoleViewer
+				}
+				if !user.HasRole(requiredRole) {
+					return echo.ErrForbidden
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// resolves the user of the given request, returns nil if the request is not authenticated
+// and the remaining lockout time if the client is currently not allowed to log in
+func (a *Authenticator) authenticate(c echo.Context) (*User, time.Duration) {
+	if !a.isEnabled() {
+		return anonymousUser, 0
+	}
+
+	if user := userFromClientCertificate(c.Request()); user != nil {
+		return user, 0
+	}
+
+	if session := a.sessionManager.GetSession(c); session != nil {
+		return session.User, 0
+	}
+
+	if a.isBasicAuthEnabled() {
+		username, password, ok := c.Request().BasicAuth()
+		if ok {
+			ipKey := "ip:" + c.RealIP()
+			userKey := "user:" + username
+			if lockedFor := max(a.rateLimits.AuthFailures.LockedFor(ipKey), a.rateLimits.AuthFailures.LockedFor(userKey)); lockedFor > 0 {
+				return nil, lockedFor
+			}
+
+			if a.validateBasicAuth(username, password) {
+				a.rateLimits.AuthFailures.Reset(ipKey)
+				a.rateLimits.AuthFailures.Reset(userKey)
+				return &User{Name: username, Roles: []string{RoleAdmin}}, 0
+			}
+
+			a.rateLimits.AuthFailures.RecordFailure(ipKey)
+			a.rateLimits.AuthFailures.RecordFailure(userKey)
+			a.auditLog.Record(AuditEntry{
+				Action:     AuditActionLoginFailed,
+				User:       username,
+				RemoteAddr: c.RealIP(),
+			})
+		}
+	}
+
+	return nil, 0
+}
+
+// checks the given credentials against the configured basic auth credentials
+func (a *Authenticator) validateBasicAuth(username string, password string) bool {
+	var authConf = configuration.CurrentConfig.Server.BasicAuth
+	userMatches := subtle.ConstantTimeCompare([]byte(username), []byte(authConf.User)) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(authConf.Password)) == 1
+	return userMatches && passwordMatches
+}
+
+// responds to an unauthenticated request, browsers are redirected to the OpenID Connect login if possible
+func (a *Authenticator) rejectUnauthenticated(c echo.Context) error {
+	request := c.Request()
+	if a.oidc != nil && request.Method == http.MethodGet && strings.Contains(request.Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+		return c.Redirect(http.StatusFound, EndpointPathLogin+"?redirect="+url.QueryEscape(request.URL.RequestURI()))
+	}
+
+	if a.isBasicAuthEnabled() {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Basic realm=\"Restricted\"")
+	}
+	return echo.ErrUnauthorized
+}
+
+// RequireRole returns an echo middleware that only allows users with the given role
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !getUser(c).HasRole(role) {
+				return echo.ErrForbidden
+			}
+			return next(c)
+		}
+	}
+}
+
+// returns the authenticated user of the given request
+func getUser(c echo.Context) *User {
+	user, ok := c.Get(contextKeyUser).(*User)
+	if !ok || user == nil {
+		return anonymousUser
+	}
+	return user
+}
+
+// returns the currently logged-in user
+func (a *Authenticator) getCurrentUser(c echo.Context) error {
+	return c.JSONPretty(http.StatusOK, getUser(c), indentationChar)
+}
+
+// ends the login session of the current user
+func (a *Authenticator) logout(c echo.Context) error {
+	session := a.sessionManager.DestroySession(c)
+	if session != nil {
+		a.auditLog.Record(AuditEntry{
+			Action:     AuditActionLogout,
+			User:       session.User.Name,
+			RemoteAddr: c.RealIP(),
+		})
+	}
+	return c.NoContent(http.StatusOK)
+}
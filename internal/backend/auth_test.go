@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareRequiresRoleForChanges(t *testing.T) {
+	issuer := newMockIssuer(t, "jane", nil)
+	_, authenticator, sessionManager := setupOIDC(t, issuer.server.URL)
+
+	e := echo.New()
+	e.Use(authenticator.Middleware())
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	e.GET("/document/:id/", ok)
+	e.PUT("/document/:id/", ok)
+	e.POST("/document/:id/suggestions/:suggestionId/accept/", ok)
+	e.POST("/document/:id/comments/", ok)
+	e.PUT("/document/:id/comments/:commentId/", ok)
+	e.DELETE("/document/:id/comments/:commentId/", ok)
+	e.POST("/document/:id/comments/:commentId/replies/", ok)
+	e.DELETE("/document/:id/comments/:commentId/replies/:replyId/", ok)
+
+	tests := []struct {
+		role   string
+		method string
+		target string
+		status int
+	}{
+		{role: RoleViewer, method: http.MethodGet, target: "/document/1/", status: http.StatusOK},
+		{role: RoleViewer, method: http.MethodPut, target: "/document/1/", status: http.StatusForbidden},
+		{role: RoleViewer, method: http.MethodPost, target: "/document/1/suggestions/2/accept/", status: http.StatusForbidden},
+		{role: RoleViewer, method: http.MethodPost, target: "/document/1/comments/", status: http.StatusOK},
+		{role: RoleViewer, method: http.MethodPut, target: "/document/1/comments/2/", status: http.StatusOK},
+		{role: RoleViewer, method: http.MethodDelete, target: "/document/1/comments/2/", status: http.StatusOK},
+		{role: RoleViewer, method: http.MethodPost, target: "/document/1/comments/2/replies/", status: http.StatusOK},
+		{role: RoleViewer, method: http.MethodDelete, target: "/document/1/comments/2/replies/3/", status: http.StatusOK},
+		{role: RoleContributor, method: http.MethodPut, target: "/document/1/", status: http.StatusForbidden},
+		{role: RoleContributor, method: http.MethodPost, target: "/document/1/comments/", status: http.StatusOK},
+		{role: RoleEditor, method: http.MethodPut, target: "/document/1/", status: http.StatusOK},
+		{role: RoleEditor, method: http.MethodPost, target: "/document/1/suggestions/2/accept/", status: http.StatusOK},
+		{role: RoleEditor, method: http.MethodDelete, target: "/document/1/comments/2/replies/3/", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.method+" "+tt.target, func(t *testing.T) {
+			login := httptest.NewRecorder()
+			sessionManager.CreateSession(e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), login), &User{
+				Name:  "jane",
+				Roles: []string{tt.role},
+			})
+
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			request.AddCookie(login.Result().Cookies()[0])
+			response := httptest.NewRecorder()
+			e.ServeHTTP(response, request)
+			if response.Code != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, response.Code)
+			}
+		})
+	}
+}
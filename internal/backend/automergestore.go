@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"errors"
+	automerge "github.com/automerge/automerge-go"
+	"os"
+	"path/filepath"
+	mutexSync "sync"
+)
+
+const (
+	automergeStateFileExtension = ".automerge"
+
+	// number of incremental saves after which the state of a document is compacted right away
+	maxIncrementalSaves = 100
+)
+
+// AutomergeStateStore persists the automerge state of documents in the state directory,
+// each document is stored as a full save followed by incremental saves of later changes
+type AutomergeStateStore struct {
+	stateDir string
+
+	lock mutexSync.Mutex
+	// incrementalSaves document id -> number of incremental saves since the last compaction
+	incrementalSaves map[string]int
+}
+
+func NewAutomergeStateStore(stateDir string) (*AutomergeStateStore, error) {
+	err := os.MkdirAll(stateDir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AutomergeStateStore{
+		stateDir:         stateDir,
+		incrementalSaves: make(map[string]int),
+	}, nil
+}
+
+// returns the path of the state file of the given document
+func (s *AutomergeStateStore) statePath(documentId string) string {
+	return filepath.Join(s.stateDir, documentId+automergeStateFileExtension)
+}
+
+// Load loads the stored state of the given document, returns nil if there is none
+func (s *AutomergeStateStore) Load(documentId string) (*automerge.Doc, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := os.ReadFile(s.statePath(documentId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return automerge.Load(data)
+}
+
+// SaveIncremental appends the changes made to the given document since it was last saved
+func (s *AutomergeStateStore) SaveIncremental(documentId string, doc *automerge.Doc) error {
+	changes := doc.SaveIncremental()
+	if len(changes) <= 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	f, err := os.OpenFile(s.statePath(documentId), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	_, err = f.Write(changes)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	s.incrementalSaves[documentId]++
+	needsCompaction := s.incrementalSaves[documentId] >= maxIncrementalSaves
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if needsCompaction {
+		return s.Compact(documentId, doc)
+	}
+	return nil
+}
+
+// Compact replaces the stored state of the given document with a single full save
+func (s *AutomergeStateStore) Compact(documentId string, doc *automerge.Doc) error {
+	data := doc.Save()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := writeFileAtomic(s.statePath(documentId), data, 0600)
+	if err != nil {
+		return err
+	}
+	delete(s.incrementalSaves, documentId)
+	return nil
+}
+
+// Relocate moves the stored state of a document to its new id, e.g. after the document has been renamed
+func (s *AutomergeStateStore) Relocate(oldId string, newId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := os.Rename(s.statePath(oldId), s.statePath(newId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if saves, ok := s.incrementalSaves[oldId]; ok {
+		delete(s.incrementalSaves, oldId)
+		s.incrementalSaves[newId] = saves
+	}
+	return nil
+}
+
+// Remove deletes the stored state of a document, e.g. after the document has been deleted
+func (s *AutomergeStateStore) Remove(documentId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := os.Remove(s.statePath(documentId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(s.incrementalSaves, documentId)
+	return nil
+}
+
+// NeedsCompaction returns true if incremental saves have been appended to the state of the given document
+func (s *AutomergeStateStore) NeedsCompaction(documentId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.incrementalSaves[documentId] > 0
+}
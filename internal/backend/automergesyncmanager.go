@@ -1,13 +1,18 @@
 package backend
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
 	automerge "github.com/automerge/automerge-go"
-	"github.com/gorilla/websocket"
 	"log"
+	"slices"
 	mutexSync "sync"
+	"time"
+	"unicode/utf8"
 )
 
 type (
@@ -15,7 +20,8 @@ type (
 		Type       string `json:"type" xml:"type" form:"type" query:"type"`
 		RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
 		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
-		// *automerge.Doc as base64 encoded string
+		// *automerge.Doc as base64 encoded string, sent by the server with the initial content
+		// and by clients that reconnect with changes made while they were offline
 		DocumentState string `json:"documentState" xml:"documentState" form:"documentState" query:"documentState"`
 		// *automerge.SyncMessage as base64 encoded string
 		SyncMessage string `json:"syncMessage" xml:"syncMessage" form:"syncMessage" query:"syncMessage"`
@@ -34,25 +40,101 @@ func (s SyncRequest) GetSyncMessageBytes() ([]byte, error) {
 	return decodedBytes, nil
 }
 
+func (s SyncRequest) GetDocumentStateBytes() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(s.DocumentState)
+}
+
+// ContainsChanges returns true if the request would change the document,
+// requests that cannot be decoded are considered to contain changes
+func (s SyncRequest) ContainsChanges() bool {
+	if s.DocumentState != "" {
+		return true
+	}
+	syncMessageBytes, err := s.GetSyncMessageBytes()
+	if err != nil {
+		return true
+	}
+	if len(syncMessageBytes) <= 0 {
+		return false
+	}
+	syncMessage, err := automerge.LoadSyncMessage(syncMessageBytes)
+	return err != nil || len(syncMessage.Changes()) > 0
+}
+
 // AutomergeSyncManager manages processing of SyncRequests from clients
 type AutomergeSyncManager struct {
 	treeManager                *TreeManager
 	websocketConnectionManager *WebsocketConnectionManager
+	persister                  *DocumentPersister
+	presenceManager            *PresenceManager
+	lockManager                *LockManager
+	commentManager             *CommentManager
+	suggestionManager          *SuggestionManager
+	actorRegistry              *ActorRegistry
 
-	// automergeDocuments client connection -> automerge.Doc
-	automergeDocuments map[*websocket.Conn]*automerge.Doc
+	// persisted automerge state of all documents
+	store *AutomergeStateStore
+	// documents document id -> automerge.Doc of all documents that are currently open, shared by all clients
+	documents map[string]*automerge.Doc
+	// syncStates client -> state of the synchronization between the client and the shared document
+	syncStates map[*WebsocketClient]*automerge.SyncState
+	// forks client -> copy of the shared document a client in suggestion mode edits instead of the document itself
+	forks map[*WebsocketClient]*automerge.Doc
+	// serverActors document id -> user -> automerge actor of the changes the server makes on behalf of the user,
+	// the changes of the server itself are made by the actor of the empty user
+	serverActors map[string]map[string]string
+	// persistedContent document id -> content of the document file as it was last read or written by the server
+	persistedContent map[string]string
+	// lock for the documents, their sync states and changes to them
+	documentsLock mutexSync.Mutex
+	// blames document id -> blame of the document as of the version it has last been requested for
+	blames map[string]*documentBlame
+	// lock for the blames, acquired before the documents lock
+	blamesLock mutexSync.Mutex
 
-	// lock for synchronizing the tree to the disk
-	lock mutexSync.RWMutex
+	onContentChanged func(origin *WebsocketClient, documentId string)
 }
 
 func NewAutomergeSyncManager(
 	treeManager *TreeManager,
+	persister *DocumentPersister,
+	store *AutomergeStateStore,
+	presenceManager *PresenceManager,
+	lockManager *LockManager,
+	commentManager *CommentManager,
+	suggestionManager *SuggestionManager,
+	actorRegistry *ActorRegistry,
 ) *AutomergeSyncManager {
 	s := &AutomergeSyncManager{
-		treeManager:        treeManager,
-		automergeDocuments: make(map[*websocket.Conn]*automerge.Doc),
+		treeManager:       treeManager,
+		persister:         persister,
+		presenceManager:   presenceManager,
+		lockManager:       lockManager,
+		commentManager:    commentManager,
+		suggestionManager: suggestionManager,
+		actorRegistry:     actorRegistry,
+		store:             store,
+		documents:         make(map[string]*automerge.Doc),
+		syncStates:        make(map[*WebsocketClient]*automerge.SyncState),
+		forks:             make(map[*WebsocketClient]*automerge.Doc),
+		serverActors:      make(map[string]map[string]string),
+		persistedContent:  make(map[string]string),
+		blames:            make(map[string]*documentBlame),
 	}
+	persister.SetContentProvider(s.readContent)
+	persister.SetOnBeforeWriteListener(s.setPersistedContent)
+	persister.SetOnStateChangedListener(s.sendPersistenceState)
+	presenceManager.SetAnchorResolver(s.resolveAnchor)
+	presenceManager.SetOnPresenceExpiredListener(func(client *WebsocketClient, presence Presence) {
+		s.relayPresence(client, presence.ToRequest(TypePresenceRemoved))
+	})
+	commentManager.SetAnchorResolver(s.resolveAnchor)
+	commentManager.SetContentProvider(s.readContent)
+	commentManager.SetOnCommentChangedListener(s.sendComment)
+	suggestionManager.SetAnchorResolver(s.resolveAnchor)
+	suggestionManager.SetOnSuggestionChangedListener(s.sendSuggestion)
+
+	go s.compactPeriodically(configuration.CurrentConfig.Sync.CompactionInterval)
 
 	return s
 }
@@ -74,202 +156,1121 @@ func (sm *AutomergeSyncManager) IsItemBeingEditedRecursive(s *Section) (err erro
 	return nil
 }
 
-// sets the initial server shadow for a new client connection
-func (sm *AutomergeSyncManager) initClient(conn *websocket.Conn, document *automerge.Doc) {
-	sm.automergeDocuments[conn] = document
+// returns the automerge document of the document with the given id, loading it from the state store if necessary
+func (sm *AutomergeSyncManager) getDocument(documentId string) (doc *automerge.Doc, err error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+	return sm.getDocumentLocked(documentId)
 }
 
-// removes the shadow for the given client
-func (sm *AutomergeSyncManager) removeClient(conn *websocket.Conn) {
-	delete(sm.automergeDocuments, conn)
-}
+// returns the automerge document the given client is synchronized with: the shared document or,
+// for clients in suggestion mode, their own fork of it, must be called with the documents lock held
+func (sm *AutomergeSyncManager) clientDocumentLocked(client *WebsocketClient) (*automerge.Doc, error) {
+	automergeDocument, err := sm.getDocumentLocked(client.DocumentId())
+	if err != nil || !client.Suggesting {
+		return automergeDocument, err
+	}
 
-func (sm *AutomergeSyncManager) getDocument(documentId string) (doc *automerge.Doc, err error) {
-	//doc, err := automerge.Load()
-	doc = automerge.New()
-	// doc.NewText(documentId)
+	fork, ok := sm.forks[client]
+	if !ok {
+		fork, err = automergeDocument.Fork()
+		if err != nil {
+			return nil, err
+		}
+		sm.forks[client] = fork
+	}
+	return fork, nil
+}
 
-	d := sm.treeManager.GetDocument(documentId)
+// same as getDocument, but must be called with the documents lock held
+func (sm *AutomergeSyncManager) getDocumentLocked(documentId string) (doc *automerge.Doc, err error) {
+	if doc, ok := sm.documents[documentId]; ok {
+		return doc, nil
+	}
 
-	text := doc.Path(ContentPath).Text()
-	err = text.Set(d.Content)
+	doc, content, err := sm.loadDocumentLocked(documentId)
 	if err != nil {
 		return nil, err
 	}
+	sm.documents[documentId] = doc
+	sm.persistedContent[documentId] = content
+	return doc, nil
+}
 
+// same as getDocumentLocked, but a document that is not open is only loaded to read it and not kept in memory,
+// used for requests that are not made by a connected client, as only their disconnect closes a document
+func (sm *AutomergeSyncManager) readDocumentLocked(documentId string) (*automerge.Doc, error) {
+	if doc, ok := sm.documents[documentId]; ok {
+		return doc, nil
+	}
+	doc, _, err := sm.loadDocumentLocked(documentId)
 	return doc, err
 }
 
-// handles incoming edit requests from the client
-func (sm *AutomergeSyncManager) handleSyncRequest(client *websocket.Conn, syncRequest SyncRequest) (err error) {
-	documentId := syncRequest.DocumentId
+// loads the automerge document of the given document from the state store, or starts its history if there is none,
+// returns the document along with the content of the document file, must be called with the documents lock held
+func (sm *AutomergeSyncManager) loadDocumentLocked(documentId string) (doc *automerge.Doc, content string, err error) {
+	content, ok := sm.treeManager.GetDocumentContent(documentId)
+	if !ok {
+		return nil, "", fmt.Errorf("document %s does not exist", documentId)
+	}
+
+	doc, err = sm.store.Load(documentId)
+	if err != nil {
+		log.Printf("Unable to load automerge state of document %s, starting with a new history: %v", documentId, err)
+		doc = nil
+	}
+
+	if doc == nil {
+		doc = automerge.New()
+		err = doc.Path(ContentPath).Text().Set(content)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = doc.Commit("Initial content")
+		if err != nil {
+			return nil, "", err
+		}
+		err = sm.store.Compact(documentId, doc)
+	} else {
+		err = sm.rebaseOntoContent(documentId, doc, content)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return doc, content, nil
+}
+
+// applies changes made to the document file outside of this server to the stored automerge state
+func (sm *AutomergeSyncManager) rebaseOntoContent(documentId string, doc *automerge.Doc, content string) error {
+	text := doc.Path(ContentPath).Text()
+	storedContent, err := text.Get()
+	if err != nil {
+		return err
+	}
+	if storedContent == content {
+		return nil
+	}
 
-	// get/create automerge document based on the document id
-	automergeDocument, err := sm.getDocument(documentId)
+	log.Printf("Document '%s' has been changed outside of the editor, rebasing its editing state", documentId)
+	err = SpliceTextDiff(text, storedContent, content)
 	if err != nil {
-		log.Printf("%v: error getting document: %v", client.RemoteAddr(), err)
 		return err
 	}
-	text := automergeDocument.Path(ContentPath).Text()
-	syncState := automerge.NewSyncState(automergeDocument)
-	// sm.automergeDocuments[client]
+	_, err = doc.Commit("External change")
+	if err != nil {
+		return err
+	}
+	return sm.store.SaveIncremental(documentId, doc)
+}
+
+// selects the automerge actor for the changes the server makes to the shared document on behalf of the given user,
+// every user gets an actor of their own, so the changes can be attributed to them,
+// must be called with the documents lock held
+func (sm *AutomergeSyncManager) useActorLocked(documentId string, doc *automerge.Doc, user string) error {
+	actors, ok := sm.serverActors[documentId]
+	if !ok {
+		// the actor the document has been loaded with makes the changes of the server itself
+		actors = map[string]string{"": doc.ActorID()}
+		sm.serverActors[documentId] = actors
+	}
+	actorId, ok := actors[user]
+	if !ok {
+		actorId = serverActorId(documentId, user)
+		actors[user] = actorId
+		sm.actorRegistry.Register(actorId, user)
+	}
+
+	if doc.ActorID() == actorId {
+		return nil
+	}
+	return doc.SetActorID(actorId)
+}
+
+// returns the actor of the changes the server makes to the given document on behalf of the given user,
+// the actor is derived from both, so it is the same whenever the document is opened again,
+// only the server makes changes with it and always knows all of its earlier changes
+func serverActorId(documentId string, user string) string {
+	hash := sha256.Sum256([]byte(documentId + "\x00" + user))
+	return hex.EncodeToString(hash[:16])
+}
+
+// returns the changes contained in the given sync message and document state received from a client
+func receivedChanges(syncMessageBytes []byte, offlineDocument *automerge.Doc) ([]*automerge.Change, error) {
+	var changes []*automerge.Change
+	if len(syncMessageBytes) > 0 {
+		syncMessage, err := automerge.LoadSyncMessage(syncMessageBytes)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, syncMessage.Changes()...)
+	}
+	if offlineDocument != nil {
+		offlineChanges, err := offlineDocument.Changes()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, offlineChanges...)
+	}
+	return changes, nil
+}
+
+// makes sure that the given changes received from the given client, which are not part of the given document yet,
+// have been made with the actor of the client or with an earlier actor of its user, so no client can make changes
+// in the name of another user or of the server, must be called with the documents lock held
+func (sm *AutomergeSyncManager) checkActorsLocked(client *WebsocketClient, doc *automerge.Doc, changes []*automerge.Change) error {
+	// actor id -> whether the client may make changes with it
+	allowed := map[string]bool{client.ActorId: true}
+	for _, change := range changes {
+		actorId := change.ActorID()
+		ok, checked := allowed[actorId]
+		if !checked {
+			ok = actorId != serverActorId(client.DocumentId(), client.User.Name) &&
+				sm.actorRegistry.GetUser(actorId) == client.User.Name
+			allowed[actorId] = ok
+		}
+		if ok {
+			continue
+		}
+		if _, err := doc.Change(change.Hash()); err == nil {
+			// the client only passes on a change the document already knows
+			continue
+		}
+		return fmt.Errorf("change %s has been made by actor %s, which does not belong to the client", change.Hash(), actorId)
+	}
+	return nil
+}
+
+// assigns the actors of the changes since the given heads, which have been received from the given client,
+// to the user of the client if they are not known yet, must be called with the documents lock held
+func (sm *AutomergeSyncManager) registerActorsLocked(client *WebsocketClient, doc *automerge.Doc, since []automerge.ChangeHash) {
+	changes, err := doc.Changes(since...)
+	if err != nil {
+		log.Printf("%v: unable to read received changes: %v", client.RemoteAddr, err)
+		return
+	}
+	actorIds := make(map[string]bool)
+	for _, change := range changes {
+		actorIds[change.ActorID()] = true
+	}
+	for actorId := range actorIds {
+		sm.actorRegistry.Register(actorId, client.User.Name)
+	}
+}
+
+// stores the changes of the given document and removes it from memory if it is not open anymore
+func (sm *AutomergeSyncManager) closeDocument(documentId string) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	if doc, ok := sm.documents[documentId]; ok {
+		sm.closeDocumentLocked(documentId, doc)
+	}
+}
+
+// same as closeDocument, but must be called with the documents lock held,
+// also used for documents that have only been loaded for a single request
+func (sm *AutomergeSyncManager) closeDocumentLocked(documentId string, doc *automerge.Doc) {
+	if err := sm.store.Compact(documentId, doc); err != nil {
+		log.Printf("Unable to store automerge state of document %s: %v", documentId, err)
+	}
+	delete(sm.documents, documentId)
+	delete(sm.serverActors, documentId)
+	delete(sm.persistedContent, documentId)
+}
+
+// RemoveDocument discards the automerge state and the actors of a deleted document,
+// so a document created at the same path later on does not inherit its history
+func (sm *AutomergeSyncManager) RemoveDocument(documentId string) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	doc, ok := sm.documents[documentId]
+	if !ok {
+		var err error
+		doc, err = sm.store.Load(documentId)
+		if err != nil {
+			log.Printf("Unable to load automerge state of deleted document %s: %v", documentId, err)
+		}
+	}
+	if doc != nil {
+		// actors are never shared between documents, every client and every document has actors of its own
+		changes, err := doc.Changes()
+		if err != nil {
+			log.Printf("Unable to read the history of deleted document %s: %v", documentId, err)
+		}
+		var actorIds []string
+		for _, change := range changes {
+			if !slices.Contains(actorIds, change.ActorID()) {
+				actorIds = append(actorIds, change.ActorID())
+			}
+		}
+		sm.actorRegistry.Remove(actorIds)
+	}
+
+	delete(sm.documents, documentId)
+	delete(sm.serverActors, documentId)
+	delete(sm.persistedContent, documentId)
+	if err := sm.store.Remove(documentId); err != nil {
+		log.Printf("Unable to remove automerge state of deleted document %s: %v", documentId, err)
+	}
+}
+
+// compacts the stored state of all open documents in the given interval
+func (sm *AutomergeSyncManager) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sm.documentsLock.Lock()
+		for documentId, doc := range sm.documents {
+			if !sm.store.NeedsCompaction(documentId) {
+				continue
+			}
+			if err := sm.store.Compact(documentId, doc); err != nil {
+				log.Printf("Unable to compact automerge state of document %s: %v", documentId, err)
+			}
+		}
+		sm.documentsLock.Unlock()
+	}
+}
+
+// handles incoming sync messages from the client: merges its changes into the shared document
+// and passes them on to all other clients of the document,
+// a client that has been offline may send its whole document state instead of (or along with) a sync message,
+// the changes of a client in suggestion mode are merged into its fork and turned into suggestions
+func (sm *AutomergeSyncManager) handleSyncRequest(client *WebsocketClient, syncRequest SyncRequest) (err error) {
+	documentId := client.DocumentId()
+
+	if syncRequest.ContainsChanges() && !client.Suggesting {
+		err = sm.lockManager.CheckEdit(client.User, documentId)
+		if err != nil {
+			return &messageError{code: ErrorCodeLocked, requestId: syncRequest.RequestId, err: err}
+		}
+	}
 
 	syncMessageBytes, err := syncRequest.GetSyncMessageBytes()
 	if err != nil {
-		log.Printf("%v: error getting sync message bytes: %v", client.RemoteAddr(), err)
+		log.Printf("%v: error getting sync message bytes: %v", client.RemoteAddr, err)
+		return err
+	}
+
+	var offlineDocument *automerge.Doc
+	if syncRequest.DocumentState != "" {
+		documentStateBytes, err := syncRequest.GetDocumentStateBytes()
+		if err != nil {
+			log.Printf("%v: error getting document state bytes: %v", client.RemoteAddr, err)
+			return err
+		}
+		offlineDocument, err = automerge.Load(documentStateBytes)
+		if err != nil {
+			log.Printf("%v: error loading document state: %v", client.RemoteAddr, err)
+			return err
+		}
+	}
+	changes, err := receivedChanges(syncMessageBytes, offlineDocument)
+	if err != nil {
+		log.Printf("%v: error reading received changes: %v", client.RemoteAddr, err)
 		return err
 	}
-	_, err = syncState.ReceiveMessage(syncMessageBytes)
+
+	sm.documentsLock.Lock()
+	// the document may have been moved in the meantime, clients are only moved while the lock is held
+	documentId = client.DocumentId()
+	automergeDocument, err := sm.clientDocumentLocked(client)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		log.Printf("%v: error getting document: %v", client.RemoteAddr, err)
+		return err
+	}
+
+	syncState, ok := sm.syncStates[client]
+	if !ok {
+		sm.documentsLock.Unlock()
+		return fmt.Errorf("no sync state for client %v", client.RemoteAddr)
+	}
+
+	err = sm.checkActorsLocked(client, automergeDocument, changes)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return &messageError{code: ErrorCodeForeignActor, requestId: syncRequest.RequestId, err: err}
+	}
+
+	headsBefore := automergeDocument.Heads()
+	if offlineDocument != nil {
+		if !sharesHistory(automergeDocument, offlineDocument) {
+			sm.documentsLock.Unlock()
+			return sm.rejectOfflineDocument(client, offlineDocument)
+		}
+		_, err = automergeDocument.Merge(offlineDocument)
+		if err != nil {
+			sm.documentsLock.Unlock()
+			log.Printf("%v: error merging document state: %v", client.RemoteAddr, err)
+			return err
+		}
+		log.Printf("%v: merged offline changes into document %s", client.RemoteAddr, documentId)
+	}
+	if len(syncMessageBytes) > 0 {
+		_, err = syncState.ReceiveMessage(syncMessageBytes)
+		if err != nil {
+			sm.documentsLock.Unlock()
+			log.Printf("%v: error receiving sync state: %v", client.RemoteAddr, err)
+			return err
+		}
+	}
+	// the shared document is not changed by clients in suggestion mode
+	documentChanged := !client.Suggesting && !sameHeads(headsBefore, automergeDocument.Heads())
+
+	if documentChanged {
+		err = sm.store.SaveIncremental(documentId, automergeDocument)
+		if err != nil {
+			log.Printf("Unable to store automerge state of document %s: %v", documentId, err)
+		}
+		sm.registerActorsLocked(client, automergeDocument, headsBefore)
+	}
+	patchedText, err := automergeDocument.Path(ContentPath).Text().Get()
 	if err != nil {
-		log.Printf("%v: error receiving sync state: %v", client.RemoteAddr(), err)
+		sm.documentsLock.Unlock()
+		log.Printf("%v: error reading document text: %v", client.RemoteAddr, err)
 		return err
 	}
 
-	// NOTE: this is not needed when using the SyncState API
-	// apply patches to the automerge document
-	//for _, change := range syncRequest.SyncMessage.Changes() {
-	//	err := automergeDocument.Apply(change)
-	//	if err != nil {
-	//		return err
-	//	}
-	//}
+	// answer the client and pass new changes on to all other clients of the document
+	outgoing := sm.generateSyncMessagesLocked(documentId)
+	sm.documentsLock.Unlock()
+
+	sm.sendSyncMessages(outgoing, client, syncRequest.RequestId)
 
 	// then patch the server document version
-	d := sm.treeManager.GetDocument(documentId)
-	patchedText := text.String()
-	if d.Content != patchedText {
-		// TODO: maybe we need to save the automerge documents here too?
-		defer sm.saveCurrentDocumentContent(documentId)
+	if documentChanged {
+		sm.applyContentChange(client, documentId, patchedText)
+	}
+	return nil
+}
+
+// keeps the content of a document state without common history as a conflict copy,
+// and resets the client to the current state of the shared document
+func (sm *AutomergeSyncManager) rejectOfflineDocument(client *WebsocketClient, offlineDocument *automerge.Doc) error {
+	d := sm.treeManager.GetDocument(client.DocumentId())
+	if d == nil {
+		return fmt.Errorf("document %s does not exist", client.DocumentId())
 	}
-	d.Content = patchedText
 
-	//err = sm.sendSyncRequestResponse(client, documentId)
-	//if err != nil {
-	//	log.Printf("%v: error sending response: %v", client.RemoteAddr(), err)
-	//	return err
-	//}
+	log.Printf("%v: document state has no common history with document %s", client.RemoteAddr, d.ID)
+	offlineContent, err := offlineDocument.Path(ContentPath).Text().Get()
+	if err != nil {
+		return err
+	}
+	sm.writeConflictCopy(d, offlineContent)
 
-	return err
+	return sm.sendInitialTextResponse(client, d)
 }
 
-// send the latest document state to the client
-func (sm *AutomergeSyncManager) sendInitialTextResponse(client *websocket.Conn, document *Document) (err error) {
-	automergeDocument, err := sm.getDocument(document.ID)
+// returns true if both documents have been created from the same initial change
+func sharesHistory(a *automerge.Doc, b *automerge.Doc) bool {
+	changes, err := a.Changes()
+	if err != nil {
+		return false
+	}
+	for _, change := range changes {
+		if len(change.Dependencies()) > 0 {
+			continue
+		}
+		if _, err := b.Change(change.Hash()); err == nil {
+			return true
+		}
+	}
+	return false
+}
 
-	heads := automergeDocument.Heads()
+// GetContent returns the current content of the shared document
+func (sm *AutomergeSyncManager) GetContent(documentId string) (string, error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
 
-	syncState := automerge.NewSyncState(automergeDocument)
+	automergeDocument, err := sm.getDocumentLocked(documentId)
+	if err != nil {
+		return "", err
+	}
+	return automergeDocument.Path(ContentPath).Text().Get()
+}
+
+// same as GetContent, but does not keep documents that are not open in memory,
+// used for comments of REST requests and for writing documents whose last client may have disconnected
+func (sm *AutomergeSyncManager) readContent(documentId string) (string, error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	automergeDocument, err := sm.readDocumentLocked(documentId)
+	if err != nil {
+		return "", err
+	}
+	return automergeDocument.Path(ContentPath).Text().Get()
+}
+
+// UpdateContent changes the content of the shared document using the given function, used for the edits of clients
+// that do not speak the automerge protocol and external changes (without a client),
+// the change is passed on to all other clients of the document
+func (sm *AutomergeSyncManager) UpdateContent(client *WebsocketClient, documentId string, update func(content string) (string, error)) error {
+	sm.documentsLock.Lock()
+	automergeDocument, err := sm.getDocumentLocked(documentId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
 
-	documentContentText := automergeDocument.Path(ContentPath).Text()
-	err = documentContentText.Set(document.Content)
+	text := automergeDocument.Path(ContentPath).Text()
+	content, err := text.Get()
 	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	updatedContent, err := update(content)
+	if err != nil || updatedContent == content {
+		sm.documentsLock.Unlock()
 		return err
 	}
 
-	commitMessage := "Initial Text"
-	commit, err := automergeDocument.Commit(commitMessage)
-	log.Printf("Commit: %v", commit)
+	commitMessage := "External change"
+	user := ""
+	if client != nil {
+		commitMessage = "Edit of " + client.User.Name
+		user = client.User.Name
+	}
+	err = sm.useActorLocked(documentId, automergeDocument, user)
+	if err == nil {
+		err = SpliceTextDiff(text, content, updatedContent)
+	}
+	if err == nil {
+		_, err = automergeDocument.Commit(commitMessage)
+	}
 	if err != nil {
+		sm.documentsLock.Unlock()
 		return err
 	}
+	err = sm.store.SaveIncremental(documentId, automergeDocument)
+	if err != nil {
+		log.Printf("Unable to store automerge state of document %s: %v", documentId, err)
+	}
 
-	changes, err := automergeDocument.Changes(heads...)
-	changes[0].Save()
+	outgoing := sm.generateSyncMessagesLocked(documentId)
+	sm.documentsLock.Unlock()
 
-	// set initial state in backend
-	sm.initClient(client, automergeDocument)
+	sm.sendSyncMessages(outgoing, nil, "")
+	sm.applyContentChange(client, documentId, updatedContent)
+	return nil
+}
+
+// updates the document in the tree with the given content, writes it to disk if it differs
+// and notifies the listener about the change
+func (sm *AutomergeSyncManager) applyContentChange(client *WebsocketClient, documentId string, content string) {
+	if sm.treeManager.SetDocumentContent(documentId, content) {
+		sm.persister.Schedule(client, documentId)
+	}
+
+	if sm.onContentChanged != nil {
+		sm.onContentChanged(client, documentId)
+	}
+}
+
+// AcceptSuggestion applies the given suggestion to the shared document on behalf of the given user
+// and passes the change on to all clients of the document
+func (sm *AutomergeSyncManager) AcceptSuggestion(user *User, documentId string, suggestionId string) error {
+	err := sm.lockManager.CheckEdit(user, documentId)
+	if err != nil {
+		return err
+	}
+
+	sm.documentsLock.Lock()
+	_, open := sm.documents[documentId]
+	automergeDocument, err := sm.readDocumentLocked(documentId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	suggestion, err := sm.suggestionManager.GetSuggestion(documentId, suggestionId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	start, err := resolveAnchorInDocument(automergeDocument, suggestion.Range.Anchor)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+
+	text := automergeDocument.Path(ContentPath).Text()
+	content, err := text.Get()
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	runes := []rune(content)
+	end := start.Index + utf8.RuneCountInString(suggestion.Original)
+	if start.Index < 0 || end > len(runes) || string(runes[start.Index:end]) != suggestion.Original {
+		sm.documentsLock.Unlock()
+		return errSuggestionConflict
+	}
+	updatedContent := string(runes[:start.Index]) + suggestion.Replacement + string(runes[end:])
 
-	syncStateMessage, valid := syncState.GenerateMessage()
-	if valid == false {
-		log.Printf("Error generating sync state message: %v", err)
+	// the change is attributed to the author of the suggestion
+	err = sm.useActorLocked(documentId, automergeDocument, suggestion.Author)
+	if err == nil {
+		err = SpliceTextDiff(text, content, updatedContent)
+	}
+	if err == nil {
+		_, err = automergeDocument.Commit(fmt.Sprintf("Suggestion of %s accepted by %s", suggestion.Author, user.Name))
+	}
+	if err != nil {
+		if !open {
+			delete(sm.serverActors, documentId)
+		}
+		sm.documentsLock.Unlock()
+		return err
+	}
+	if open {
+		err = sm.store.SaveIncremental(documentId, automergeDocument)
+		if err != nil {
+			log.Printf("Unable to store automerge state of document %s: %v", documentId, err)
+		}
+	} else {
+		// no client has the document open, it has only been loaded for the suggestion
+		sm.closeDocumentLocked(documentId, automergeDocument)
+	}
+
+	err = sm.suggestionManager.RemoveSuggestion(documentId, suggestionId, SuggestionAccepted)
+	if err != nil {
+		log.Printf("Unable to remove accepted suggestion %s of document %s: %v", suggestionId, documentId, err)
+	}
+	sm.rebaseForksLocked(documentId, suggestion.ClientId)
+	outgoing := sm.generateSyncMessagesLocked(documentId)
+	sm.documentsLock.Unlock()
+
+	sm.sendSyncMessages(outgoing, nil, "")
+	sm.applyContentChange(nil, documentId, updatedContent)
+	return nil
+}
+
+// RejectSuggestion discards the given suggestion, the change is also reverted in the fork of its author
+func (sm *AutomergeSyncManager) RejectSuggestion(documentId string, suggestionId string) error {
+	sm.documentsLock.Lock()
+	_, err := sm.readDocumentLocked(documentId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	suggestion, err := sm.suggestionManager.GetSuggestion(documentId, suggestionId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	err = sm.suggestionManager.RemoveSuggestion(documentId, suggestionId, SuggestionRejected)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+
+	sm.rebaseForksLocked(documentId, suggestion.ClientId)
+	outgoing := sm.generateSyncMessagesLocked(documentId)
+	sm.documentsLock.Unlock()
+
+	sm.sendSyncMessages(outgoing, nil, "")
+	return nil
+}
+
+// resets the fork of the given client (if it is still connected) to the shared document
+// with its remaining suggestions applied, e.g. after one of its suggestions has been accepted or rejected,
+// must be called with the documents lock held
+func (sm *AutomergeSyncManager) rebaseForksLocked(documentId string, clientId string) {
+	automergeDocument, ok := sm.documents[documentId]
+	if !ok {
+		return
+	}
+	for client, fork := range sm.forks {
+		if client.DocumentId() != documentId || client.Id != clientId {
+			continue
+		}
+		err := sm.rebaseForkLocked(client, fork, automergeDocument)
+		if err != nil {
+			log.Printf("%v: unable to rebase suggestions onto document %s: %v", client.RemoteAddr, documentId, err)
+		}
+	}
+}
+
+// same as rebaseForksLocked, but for the given fork
+func (sm *AutomergeSyncManager) rebaseForkLocked(client *WebsocketClient, fork *automerge.Doc, automergeDocument *automerge.Doc) error {
+	_, err := fork.Merge(automergeDocument)
+	if err != nil {
+		return err
+	}
+	content, err := automergeDocument.Path(ContentPath).Text().Get()
+	if err != nil {
+		return err
+	}
+	suggestions, err := sm.suggestionManager.GetClientSuggestions(client.DocumentId(), client.Id)
+	if err != nil {
+		return err
+	}
+
+	changes := make([]TextChange, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		start, err := resolveAnchorInDocument(automergeDocument, suggestion.Range.Anchor)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, TextChange{
+			Index:       start.Index,
+			Original:    suggestion.Original,
+			Replacement: suggestion.Replacement,
+		})
+	}
+
+	text := fork.Path(ContentPath).Text()
+	forkContent, err := text.Get()
+	if err != nil {
+		return err
+	}
+	suggestedContent := ApplyTextChanges(content, changes)
+	if forkContent == suggestedContent {
+		return nil
+	}
+	err = SpliceTextDiff(text, forkContent, suggestedContent)
+	if err != nil {
 		return err
 	}
+	_, err = fork.Commit("Rebase suggestions of " + client.User.Name)
+	return err
+}
+
+// MergeExternalChanges merges changes made to the files of open documents outside of the editor
+// (e.g. by a text editor or git) into the shared documents and passes them on to all clients
+func (sm *AutomergeSyncManager) MergeExternalChanges() {
+	changedDocuments := make(map[*Document]string)
+
+	// files that are being written by the server contain neither the old nor the new content
+	sm.persister.WithoutWrites(func() {
+		sm.documentsLock.Lock()
+		defer sm.documentsLock.Unlock()
+
+		for documentId := range sm.documents {
+			d := sm.treeManager.GetDocument(documentId)
+			if d == nil {
+				continue
+			}
+			// the document in the tree may already contain changes that have not been written yet
+			fileContent, err := ReadFile(d.Path)
+			if err == nil && fileContent != sm.persistedContent[documentId] {
+				changedDocuments[d] = fileContent
+			}
+		}
+	})
+
+	for d, fileContent := range changedDocuments {
+		sm.mergeExternalChange(d, fileContent)
+	}
+}
+
+// merges the external change of the given document into the shared document,
+// if that is not possible the changed file is kept as a conflict copy
+func (sm *AutomergeSyncManager) mergeExternalChange(d *Document, externalContent string) {
+	sm.documentsLock.Lock()
+	persistedContent := sm.persistedContent[d.ID]
+	sm.persistedContent[d.ID] = externalContent
+	sm.documentsLock.Unlock()
+
+	log.Printf("Document '%s' has been changed outside of the editor, merging the change", d.ID)
+
+	conflict := false
+	err := sm.UpdateContent(nil, d.ID, func(content string) (string, error) {
+		merged, ok := MergeTextChanges(persistedContent, externalContent, content)
+		conflict = !ok
+		return merged, nil
+	})
+	if err != nil {
+		log.Printf("Unable to merge external change of document %s: %v", d.ID, err)
+		return
+	}
+	if !conflict {
+		return
+	}
+
+	log.Printf("Unable to merge external change of document %s", d.ID)
+	if !sm.writeConflictCopy(d, externalContent) {
+		return
+	}
+
+	// the file has to contain the content of the shared document again
+	sm.persister.Schedule(nil, d.ID)
+}
+
+// keeps the given content of a document, that could not be merged, in a file next to the document
+func (sm *AutomergeSyncManager) writeConflictCopy(d *Document, content string) bool {
+	conflictPath := fmt.Sprintf("%s.%s.conflict", d.Path, time.Now().Format("20060102-150405"))
+	log.Printf("Keeping conflicting content of document %s in %s", d.ID, conflictPath)
+	err := WriteFile(conflictPath, []byte(content))
+	if err != nil {
+		log.Printf("Unable to write conflict copy of document %s: %v", d.ID, err)
+		return false
+	}
+	return true
+}
+
+// remembers the content of the document file, so the file watcher does not mistake it for an external change
+func (sm *AutomergeSyncManager) setPersistedContent(documentId string, content string) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+	if _, ok := sm.documents[documentId]; ok {
+		sm.persistedContent[documentId] = content
+	}
+}
+
+// generates the pending sync messages for all clients of the given document,
+// must be called with the documents lock held
+func (sm *AutomergeSyncManager) generateSyncMessagesLocked(documentId string) map[*WebsocketClient][]byte {
+	sm.updateForksLocked(documentId)
+
+	messages := make(map[*WebsocketClient][]byte)
+	for client, syncState := range sm.syncStates {
+		if client.DocumentId() != documentId {
+			continue
+		}
+		syncMessage, valid := syncState.GenerateMessage()
+		if valid {
+			messages[client] = syncMessage.Bytes()
+		}
+	}
+	return messages
+}
+
+// merges the changes of the shared document into the forks of its clients in suggestion mode
+// and updates their suggestions, must be called with the documents lock held
+func (sm *AutomergeSyncManager) updateForksLocked(documentId string) {
+	automergeDocument, ok := sm.documents[documentId]
+	if !ok {
+		return
+	}
+	for client, fork := range sm.forks {
+		if client.DocumentId() != documentId {
+			continue
+		}
+		_, err := fork.Merge(automergeDocument)
+		if err == nil {
+			err = sm.updateSuggestionsLocked(client, fork, automergeDocument)
+		}
+		if err != nil {
+			log.Printf("%v: unable to update suggestions for document %s: %v", client.RemoteAddr, documentId, err)
+		}
+	}
+}
+
+// stores the differences between the fork of the given client and the shared document as its suggestions,
+// must be called with the documents lock held
+func (sm *AutomergeSyncManager) updateSuggestionsLocked(client *WebsocketClient, fork *automerge.Doc, automergeDocument *automerge.Doc) error {
+	content, err := automergeDocument.Path(ContentPath).Text().Get()
+	if err != nil {
+		return err
+	}
+	forkContent, err := fork.Path(ContentPath).Text().Get()
+	if err != nil {
+		return err
+	}
+
+	heads := encodeHeads(automergeDocument.Heads())
+	changes := DiffTextChanges(content, forkContent)
+	return sm.suggestionManager.UpdateClientSuggestions(client, heads, content, changes, func(anchor TextAnchor) TextAnchor {
+		resolved, err := resolveAnchorInDocument(automergeDocument, anchor)
+		if err != nil {
+			return anchor
+		}
+		return resolved
+	})
+}
+
+// sends the given sync messages to their clients, the message to the client that sent the request
+// it answers carries the id of that request
+func (sm *AutomergeSyncManager) sendSyncMessages(messages map[*WebsocketClient][]byte, requester *WebsocketClient, requestId string) {
+	for client, message := range messages {
+		messageRequestId := ""
+		if client == requester {
+			messageRequestId = requestId
+		}
+		_ = sm.websocketConnectionManager.syncStateToClient(client, SyncRequest{
+			Type:        TypeSyncRequest,
+			RequestId:   messageRequestId,
+			DocumentId:  client.DocumentId(),
+			SyncMessage: encodeBase64(message),
+		})
+	}
+}
+
+// returns true if both lists contain the same change hashes
+func sameHeads(a []automerge.ChangeHash, b []automerge.ChangeHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// send the latest document state to the client
+func (sm *AutomergeSyncManager) sendInitialTextResponse(client *WebsocketClient, document *Document) (err error) {
+	sm.documentsLock.Lock()
+	automergeDocument, err := sm.clientDocumentLocked(client)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+
+	// set initial state in backend
+	syncState := automerge.NewSyncState(automergeDocument)
+	sm.syncStates[client] = syncState
+
+	syncStateMessage, _ := syncState.GenerateMessage()
+	documentState := automergeDocument.Save()
+	sm.documentsLock.Unlock()
 
 	// Write current document state to the client
 	request := SyncRequest{
 		Type:          TypeInitialContent,
 		DocumentId:    document.ID,
 		RequestId:     "",
-		DocumentState: encodeBase64(automergeDocument.Save()),
-		SyncMessage:   encodeBase64(syncStateMessage.Bytes()),
+		DocumentState: encodeBase64(documentState),
+	}
+	if syncStateMessage != nil {
+		request.SyncMessage = encodeBase64(syncStateMessage.Bytes())
 	}
-	err = client.WriteJSON(request)
+	err = sm.websocketConnectionManager.syncStateToClient(client, request)
 	if err != nil {
-		log.Printf("%v: error writing initial content response: %v", client.RemoteAddr(), err)
+		log.Printf("%v: error writing initial content response: %v", client.RemoteAddr, err)
 		return err
 	}
 
 	return
 }
 
-func encodeBase64(buffer []byte) string {
-	return base64.StdEncoding.EncodeToString(buffer)
+// moves the given text anchor to the current version of the document
+func (sm *AutomergeSyncManager) resolveAnchor(documentId string, anchor TextAnchor) (TextAnchor, error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	automergeDocument, err := sm.readDocumentLocked(documentId)
+	if err != nil {
+		return anchor, err
+	}
+	return resolveAnchorInDocument(automergeDocument, anchor)
 }
 
-// responds to a client with the changes from the server site document version
-func (sm *AutomergeSyncManager) sendSyncRequestResponse(client *websocket.Conn, documentId string) (err error) {
-	// d := sm.treeManager.GetDocument(documentId)
+// moves the given text anchor to the current version of the given automerge document
+func resolveAnchorInDocument(automergeDocument *automerge.Doc, anchor TextAnchor) (TextAnchor, error) {
+	heads := automergeDocument.Heads()
+	resolved := TextAnchor{
+		Heads: encodeHeads(heads),
+		Index: anchor.Index,
+	}
+	if len(anchor.Heads) <= 0 {
+		// no version given, so the index already refers to the current one
+		return resolved, nil
+	}
 
-	automergeDocument, err := sm.getDocument(documentId)
+	anchorHeads, err := decodeHeads(anchor.Heads)
 	if err != nil {
-		log.Printf("%v: error getting document: %v", client.RemoteAddr(), err)
-		return err
+		return anchor, err
+	}
+	if sameHeads(anchorHeads, heads) {
+		return resolved, nil
 	}
 
-	syncState := automerge.NewSyncState(automergeDocument)
-	syncStateMessage, valid := syncState.GenerateMessage()
-	if valid == false {
-		log.Printf("Error generating sync state message: %v", err)
-		return err
+	anchorDocument, err := automergeDocument.Fork(anchorHeads...)
+	if err != nil {
+		// the client knows changes that have not been synchronized yet, keep its position as it is
+		return anchor, nil
+	}
+	anchorText, err := anchorDocument.Path(ContentPath).Text().Get()
+	if err != nil {
+		return anchor, err
+	}
+	currentText, err := automergeDocument.Path(ContentPath).Text().Get()
+	if err != nil {
+		return anchor, err
 	}
 
-	return sm.websocketConnectionManager.syncStateToClient(
-		client,
-		SyncRequest{
-			Type:          TypeSyncRequest,
-			RequestId:     "",
-			DocumentId:    documentId,
-			DocumentState: encodeBase64(automergeDocument.Save()),
-			SyncMessage:   encodeBase64(syncStateMessage.Bytes()),
-		})
+	resolved.Index = TransformTextIndex(anchorText, currentText, anchor.Index)
+	return resolved, nil
 }
 
-func (sm *AutomergeSyncManager) saveCurrentDocumentContent(documentId string) {
-	sm.lock.RLock()
-	defer sm.lock.RUnlock()
+// handles incoming presence updates from the client and relays them to all other clients of the document
+func (sm *AutomergeSyncManager) handlePresence(client *WebsocketClient, request PresenceRequest) error {
+	presence := sm.presenceManager.Update(client, request)
+	sm.relayPresence(client, presence.ToRequest(TypePresence))
+	return nil
+}
 
-	log.Printf("Synchronizing document '%s' synchronized to disk", documentId)
+// sends the given presence message to all clients of the document except the one it originates from
+func (sm *AutomergeSyncManager) relayPresence(origin *WebsocketClient, request PresenceRequest) {
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(request.DocumentId) {
+		if client == origin {
+			continue
+		}
+		_ = sm.websocketConnectionManager.sendPresenceToClient(client, request)
+	}
+}
 
-	d := sm.treeManager.GetDocument(documentId)
-	if d == nil {
-		log.Printf("Unable to write document content for document %s: Document was nil", documentId)
+// writes the document of the client to disk right away and acknowledges the request once the content is durable
+func (sm *AutomergeSyncManager) handleFlush(client *WebsocketClient, request FlushRequest) error {
+	state := sm.persister.FlushFor(client, client.DocumentId())
+	state.RequestId = request.RequestId
+	return sm.websocketConnectionManager.sendPersistenceState(client, state)
+}
+
+// sends a created, changed or deleted comment thread to all clients of its document
+func (sm *AutomergeSyncManager) sendComment(message CommentMessage) {
+	if sm.websocketConnectionManager == nil {
+		return
+	}
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(message.DocumentId) {
+		_ = sm.websocketConnectionManager.sendComment(client, message)
+	}
+}
+
+// sends a created, changed or removed suggestion to all clients of its document
+func (sm *AutomergeSyncManager) sendSuggestion(message SuggestionMessage) {
+	if sm.websocketConnectionManager == nil {
+		return
+	}
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(message.DocumentId) {
+		_ = sm.websocketConnectionManager.sendSuggestion(client, message)
+	}
+}
+
+// sends the persistence state of a document to all of its clients except the one that requested it,
+// which receives it as the response to its request
+func (sm *AutomergeSyncManager) sendPersistenceState(state PersistenceState, requester *WebsocketClient) {
+	if sm.websocketConnectionManager == nil {
 		return
 	}
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(state.DocumentId) {
+		if client == requester {
+			continue
+		}
+		_ = sm.websocketConnectionManager.sendPersistenceState(client, state)
+	}
+}
 
-	err := WriteFile(d.Path, []byte(d.Content))
+// moves the sync state of the previous connection of a client to its new connection
+// and sends it the changes it has missed in the meantime
+func (sm *AutomergeSyncManager) resumeClient(previous *WebsocketClient, client *WebsocketClient, document *Document) error {
+	sm.documentsLock.Lock()
+	previousSyncState, ok := sm.syncStates[previous]
+	delete(sm.syncStates, previous)
+	if fork, ok := sm.forks[previous]; ok {
+		delete(sm.forks, previous)
+		sm.forks[client] = fork
+	}
+	if !ok {
+		sm.documentsLock.Unlock()
+		return sm.sendInitialTextResponse(client, document)
+	}
+
+	automergeDocument, err := sm.clientDocumentLocked(client)
 	if err != nil {
-		log.Printf("Unable to write modified document content for document %s: %v", documentId, err)
+		sm.documentsLock.Unlock()
+		return err
 	}
+	// messages sent to the previous connection may have been lost,
+	// only the heads both sides had in common are kept
+	syncState, err := automerge.LoadSyncState(automergeDocument, previousSyncState.Save())
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return err
+	}
+	sm.syncStates[client] = syncState
+	outgoing := sm.generateSyncMessagesLocked(document.ID)
+	sm.documentsLock.Unlock()
 
-	log.Printf("Document '%s' synchronized to disk successfully", documentId)
+	sm.sendSyncMessages(outgoing, nil, "")
+	return nil
+}
+
+// removes the sync state and the fork of the given client, its suggestions are kept
+func (sm *AutomergeSyncManager) removeClient(client *WebsocketClient) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+	delete(sm.syncStates, client)
+	delete(sm.forks, client)
+}
+
+func encodeBase64(buffer []byte) string {
+	return base64.StdEncoding.EncodeToString(buffer)
+}
+
+// converts the given change hashes to their hex representation
+func encodeHeads(heads []automerge.ChangeHash) []string {
+	result := make([]string, len(heads))
+	for i, head := range heads {
+		result[i] = head.String()
+	}
+	return result
+}
+
+// parses the given hex encoded change hashes
+func decodeHeads(heads []string) ([]automerge.ChangeHash, error) {
+	result := make([]automerge.ChangeHash, len(heads))
+	for i, head := range heads {
+		hash, err := automerge.NewChangeHash(head)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = hash
+	}
+	return result, nil
 }
 
 func (sm *AutomergeSyncManager) SetWebsocketConnectionManager(manager *WebsocketConnectionManager) {
 	sm.websocketConnectionManager = manager
 
-	sm.websocketConnectionManager.SetOnNewClientListener(func(client *websocket.Conn, document *Document) error {
+	sm.websocketConnectionManager.AddOnNewClientListener(func(client *WebsocketClient, document *Document) error {
+		if client.Protocol != ProtocolAutomerge {
+			return nil
+		}
 		fmt.Println("New client connected", client)
 		return sm.sendInitialTextResponse(client, document)
 	})
-	sm.websocketConnectionManager.SetOnSyncRequestMessageListener(func(client *websocket.Conn, request SyncRequest) error {
+	sm.websocketConnectionManager.AddOnClientResumedListener(func(previous *WebsocketClient, client *WebsocketClient, document *Document) error {
+		sm.presenceManager.Replace(previous, client)
+		if client.Protocol != ProtocolAutomerge {
+			return nil
+		}
+		fmt.Println("Client resumed", client)
+		return sm.resumeClient(previous, client, document)
+	})
+	sm.websocketConnectionManager.SetOnSyncRequestMessageListener(func(client *WebsocketClient, request SyncRequest) error {
 		fmt.Println("Incoming sync message from client", client)
 		return sm.handleSyncRequest(client, request)
 	})
-	sm.websocketConnectionManager.SetOnClientDisconnectedListener(func(client *websocket.Conn, documentId string, remainingConnections uint) {
+	sm.websocketConnectionManager.SetOnFlushRequestListener(func(client *WebsocketClient, request FlushRequest) error {
+		return sm.handleFlush(client, request)
+	})
+	sm.websocketConnectionManager.SetOnPresenceMessageListener(func(client *WebsocketClient, request PresenceRequest) error {
+		return sm.handlePresence(client, request)
+	})
+	sm.websocketConnectionManager.AddOnClientDisconnectedListener(func(client *WebsocketClient, documentId string, remainingConnections uint) {
 		fmt.Println("Client disconnected", client)
 		sm.removeClient(client)
+		if presence, ok := sm.presenceManager.Remove(client); ok {
+			sm.relayPresence(client, presence.ToRequest(TypePresenceRemoved))
+		}
+		sm.persister.Flush(documentId)
 		if remainingConnections <= 0 {
-			sm.saveCurrentDocumentContent(documentId)
+			sm.closeDocument(documentId)
 		}
 	})
 }
+
+// SetOnContentChangedListener sets the listener that is notified whenever the content of a shared document has changed
+func (sm *AutomergeSyncManager) SetOnContentChangedListener(f func(origin *WebsocketClient, documentId string)) {
+	sm.onContentChanged = f
+}
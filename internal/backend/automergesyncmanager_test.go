@@ -0,0 +1,379 @@
+package backend
+
+import (
+	"encoding/json"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	automerge "github.com/automerge/automerge-go"
+	"github.com/gorilla/websocket"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var testEditor = &User{Name: "jane", Roles: []string{RoleEditor}}
+
+// testSyncSetup is a docs directory with all managers needed to edit its documents
+type testSyncSetup struct {
+	docsPath string
+	stateDir string
+
+	treeManager       *TreeManager
+	lockManager       *LockManager
+	commentManager    *CommentManager
+	suggestionManager *SuggestionManager
+	actorRegistry     *ActorRegistry
+	persister         *DocumentPersister
+	syncManager       *AutomergeSyncManager
+	connections       *WebsocketConnectionManager
+}
+
+// creates a docs directory containing the given documents (file name -> content) and the managers for it,
+// the configuration is restored when the test is finished
+func setupSync(t *testing.T, documents map[string]string) *testSyncSetup {
+	previous := configuration.CurrentConfig
+	t.Cleanup(func() {
+		configuration.CurrentConfig = previous
+	})
+
+	projectPath := t.TempDir()
+	docsPath := filepath.Join(projectPath, "docs")
+	stateDir := filepath.Join(projectPath, ".mkdocsrest")
+	for name, content := range documents {
+		path := filepath.Join(docsPath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(docsPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	configuration.CurrentConfig.MkDocs = configuration.MkDocsConfiguration{
+		ProjectPath: projectPath,
+		DocsPath:    docsPath,
+		ConfigFile:  filepath.Join(projectPath, "mkdocs.yml"),
+	}
+	configuration.CurrentConfig.Sync = configuration.SyncConfiguration{
+		DefaultProtocol:    ProtocolAutomerge,
+		StateDir:           stateDir,
+		CompactionInterval: time.Hour,
+		WriteDelay:         time.Hour,
+		PresenceTimeout:    time.Minute,
+		LockLease:          5 * time.Minute,
+		MaxLockLease:       time.Hour,
+	}
+	configuration.CurrentConfig.Server.Audit.File = ""
+	configuration.CurrentConfig.Server.Websocket.SendQueueSize = 1024
+
+	s := &testSyncSetup{
+		docsPath: docsPath,
+		stateDir: stateDir,
+	}
+	s.start(t)
+	return s
+}
+
+// creates the managers for the docs directory, calling it again is like restarting the server
+func (s *testSyncSetup) start(t *testing.T) {
+	store, err := NewAutomergeStateStore(s.stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.treeManager = NewTreeManager()
+	s.lockManager = NewLockManager(s.treeManager)
+	s.commentManager = NewCommentManager(s.stateDir)
+	s.suggestionManager = NewSuggestionManager(s.stateDir)
+	s.actorRegistry = NewActorRegistry(s.stateDir)
+	s.persister = NewDocumentPersister(s.treeManager, NewAuditLog())
+	s.syncManager = NewAutomergeSyncManager(s.treeManager, s.persister, store, NewPresenceManager(),
+		s.lockManager, s.commentManager, s.suggestionManager, s.actorRegistry)
+	s.connections = NewWebsocketConnectionManager(s.treeManager, nil)
+	s.syncManager.SetWebsocketConnectionManager(s.connections)
+}
+
+// returns the id of the document at the given path within the docs directory
+func (s *testSyncSetup) documentId(name string) string {
+	return s.treeManager.generateId(filepath.Join(s.docsPath, name))
+}
+
+// testClient is an automerge client that calls the sync manager directly instead of using a websocket connection
+type testClient struct {
+	t      *testing.T
+	setup  *testSyncSetup
+	client *WebsocketClient
+
+	doc       *automerge.Doc
+	syncState *automerge.SyncState
+	// errors the client has been sent
+	errors []ErrorMessage
+}
+
+// connects a new client of the given user in the given mode to the document with the given id
+// and receives its initial content
+func (s *testSyncSetup) connect(t *testing.T, documentId string, user *User, mode string) *testClient {
+	client := &WebsocketClient{
+		Id:          randomToken(12),
+		Protocol:    ProtocolAutomerge,
+		Version:     ProtocolVersion2,
+		ReadOnly:    mode == ModeView,
+		Suggesting:  mode == ModeSuggest,
+		User:        user,
+		RemoteAddr:  "test",
+		ConnectedAt: time.Now(),
+		send:        make(chan outboundMessage, configuration.CurrentConfig.Server.Websocket.SendQueueSize),
+		done:        make(chan struct{}),
+	}
+	client.setDocumentId(documentId)
+	if !client.ReadOnly {
+		client.ActorId = automerge.NewActorID()
+	}
+
+	s.connections.lock.Lock()
+	s.connections.clients[client] = true
+	s.connections.connectionsPerDocument[documentId] = s.connections.connectionsPerDocument[documentId] + 1
+	s.connections.lock.Unlock()
+
+	d := s.treeManager.GetDocument(documentId)
+	if d == nil {
+		t.Fatalf("document %s does not exist", documentId)
+	}
+	if err := s.syncManager.sendInitialTextResponse(client, d); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testClient{t: t, setup: s, client: client}
+	tc.receive()
+	if tc.doc == nil {
+		t.Fatalf("no initial content received")
+	}
+	return tc
+}
+
+// disconnects the client, the document is closed when it was its last client
+func (tc *testClient) disconnect() {
+	s := tc.setup
+	documentId := tc.client.DocumentId()
+	s.connections.lock.Lock()
+	delete(s.connections.clients, tc.client)
+	s.connections.connectionsPerDocument[documentId] = s.connections.connectionsPerDocument[documentId] - 1
+	remaining := s.connections.connectionsPerDocument[documentId]
+	s.connections.lock.Unlock()
+
+	for _, onClientDisconnected := range s.connections.onClientDisconnected {
+		onClientDisconnected(tc.client, documentId, remaining)
+	}
+}
+
+// processes all messages the server has queued for the client
+func (tc *testClient) receive() {
+	for {
+		select {
+		case message := <-tc.client.send:
+			tc.handleMessage(message)
+		default:
+			return
+		}
+	}
+}
+
+func (tc *testClient) handleMessage(message outboundMessage) {
+	var request SyncRequest
+	if message.messageType == websocket.BinaryMessage {
+		var err error
+		request, err = decodeSyncRequestFrame(message.data)
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+	} else {
+		if err := json.Unmarshal(message.data, &request); err != nil {
+			tc.t.Fatal(err)
+		}
+		if request.Type == TypeError {
+			var errorMessage ErrorMessage
+			_ = json.Unmarshal(message.data, &errorMessage)
+			tc.errors = append(tc.errors, errorMessage)
+			return
+		}
+	}
+
+	if request.Type == TypeInitialContent {
+		documentState, err := request.GetDocumentStateBytes()
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		tc.doc, err = automerge.Load(documentState)
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		if tc.client.ActorId != "" {
+			if err = tc.doc.SetActorID(tc.client.ActorId); err != nil {
+				tc.t.Fatal(err)
+			}
+		}
+		tc.syncState = automerge.NewSyncState(tc.doc)
+	}
+	if request.SyncMessage != "" && tc.syncState != nil {
+		syncMessage, err := request.GetSyncMessageBytes()
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		if _, err = tc.syncState.ReceiveMessage(syncMessage); err != nil {
+			tc.t.Fatal(err)
+		}
+	}
+}
+
+// appends the given text to the document of the client
+func (tc *testClient) append(text string) {
+	if err := tc.doc.Path(ContentPath).Text().Append(text); err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.commit()
+}
+
+// replaces the first occurrence of the given text in the document of the client
+func (tc *testClient) replace(original string, replacement string) {
+	index := strings.Index(tc.content(), original)
+	if index < 0 {
+		tc.t.Fatalf("%q not found in %q", original, tc.content())
+	}
+	index = utf8.RuneCountInString(tc.content()[:index])
+	err := tc.doc.Path(ContentPath).Text().Splice(index, utf8.RuneCountInString(original), replacement)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.commit()
+}
+
+func (tc *testClient) commit() {
+	if _, err := tc.doc.Commit("edit"); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// exchanges sync messages with the server until the client has nothing left to send,
+// returns the first error of the sync manager
+func (tc *testClient) sync() error {
+	tc.receive()
+	for i := 0; i < 10; i++ {
+		syncMessage, valid := tc.syncState.GenerateMessage()
+		if !valid {
+			return nil
+		}
+		err := tc.setup.syncManager.handleSyncRequest(tc.client, SyncRequest{
+			Type:        TypeSyncRequest,
+			SyncMessage: encodeBase64(syncMessage.Bytes()),
+		})
+		if err != nil {
+			return err
+		}
+		tc.receive()
+	}
+	return nil
+}
+
+// sends the whole state of the document of the client, like a client that has been offline
+func (tc *testClient) sendState() error {
+	return tc.setup.syncManager.handleSyncRequest(tc.client, SyncRequest{
+		Type:          TypeSyncRequest,
+		DocumentState: encodeBase64(tc.doc.Save()),
+	})
+}
+
+// returns the content of the document of the client
+func (tc *testClient) content() string {
+	content, err := tc.doc.Path(ContentPath).Text().Get()
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return content
+}
+
+func TestMergeExternalChanges(t *testing.T) {
+	const content = "# Title\n\nFirst paragraph\n\nSecond paragraph\n"
+
+	tests := []struct {
+		name string
+		// content of the file after it has been changed outside of the editor
+		external string
+		expected string
+		conflict bool
+	}{
+		{
+			name:     "change of another paragraph",
+			external: "# Title\n\nFirst paragraph\n\nSecond paragraph changed\n",
+			expected: "# Title\n\nFirst paragraph edited\n\nSecond paragraph changed\n",
+		},
+		{
+			name:     "change of the edited paragraph",
+			external: "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			expected: "# Title\n\nFirst paragraph edited\n\nSecond paragraph\n",
+			conflict: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": content})
+			documentId := s.documentId("a.md")
+			path := filepath.Join(s.docsPath, "a.md")
+			client := s.connect(t, documentId, testEditor, ModeEdit)
+
+			// the edit of the client has not been written to the file yet
+			client.replace("First paragraph", "First paragraph edited")
+			if err := client.sync(); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(tt.external), 0640); err != nil {
+				t.Fatal(err)
+			}
+			s.syncManager.MergeExternalChanges()
+
+			if err := client.sync(); err != nil {
+				t.Fatal(err)
+			}
+			if client.content() != tt.expected {
+				t.Fatalf("expected client content %q, got %q", tt.expected, client.content())
+			}
+
+			conflictCopies, err := filepath.Glob(path + ".*.conflict")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(conflictCopies) != 0) != tt.conflict {
+				t.Fatalf("expected conflict = %v, got conflict copies %v", tt.conflict, conflictCopies)
+			}
+			if tt.conflict {
+				conflictContent, err := os.ReadFile(conflictCopies[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(conflictContent) != tt.external {
+					t.Fatalf("expected conflict copy %q, got %q", tt.external, conflictContent)
+				}
+			}
+
+			s.persister.Flush(documentId)
+			fileContent, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fileContent) != tt.expected {
+				t.Fatalf("expected file content %q, got %q", tt.expected, fileContent)
+			}
+			// writing the merged content is not mistaken for another external change
+			s.syncManager.MergeExternalChanges()
+			if err = client.sync(); err != nil {
+				t.Fatal(err)
+			}
+			if client.content() != tt.expected {
+				t.Fatalf("the merged content has changed again: %q", client.content())
+			}
+		})
+	}
+}
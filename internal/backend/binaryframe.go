@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// size of the header length prefix of a binary frame
+const binaryFrameHeaderLengthSize = 4
+
+// binaryFrameHeader describes the payload of a binary websocket frame (protocol version 2)
+type binaryFrameHeader struct {
+	Type       string `json:"type" xml:"type" form:"type" query:"type"`
+	RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+	// number of payload bytes that belong to the document state, the rest of the payload is the sync message
+	DocumentStateSize int `json:"documentStateSize" xml:"documentStateSize" form:"documentStateSize" query:"documentStateSize"`
+}
+
+// encodeSyncRequestFrame encodes a SyncRequest as binary frame:
+// the length of the JSON header as 32 bit big endian integer, the header, the raw document state and the raw sync message
+func encodeSyncRequestFrame(request SyncRequest) ([]byte, error) {
+	documentState, err := request.GetDocumentStateBytes()
+	if err != nil {
+		return nil, err
+	}
+	syncMessage, err := request.GetSyncMessageBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(binaryFrameHeader{
+		Type:              request.Type,
+		RequestId:         request.RequestId,
+		DocumentId:        request.DocumentId,
+		DocumentStateSize: len(documentState),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binaryFrameHeaderLengthSize, binaryFrameHeaderLengthSize+len(header)+len(documentState)+len(syncMessage))
+	binary.BigEndian.PutUint32(frame, uint32(len(header)))
+	frame = append(frame, header...)
+	frame = append(frame, documentState...)
+	frame = append(frame, syncMessage...)
+	return frame, nil
+}
+
+// decodeSyncRequestFrame decodes a binary frame created by encodeSyncRequestFrame,
+// the frame may carry any message type with the fields of a SyncRequest
+func decodeSyncRequestFrame(frame []byte) (SyncRequest, error) {
+	if len(frame) < binaryFrameHeaderLengthSize {
+		return SyncRequest{}, errors.New("binary frame is too short")
+	}
+	headerLength := int(binary.BigEndian.Uint32(frame))
+	frame = frame[binaryFrameHeaderLengthSize:]
+	if headerLength > len(frame) {
+		return SyncRequest{}, errors.New("binary frame header exceeds the frame")
+	}
+
+	var header binaryFrameHeader
+	err := json.Unmarshal(frame[:headerLength], &header)
+	if err != nil {
+		return SyncRequest{}, err
+	}
+
+	payload := frame[headerLength:]
+	if header.DocumentStateSize < 0 || header.DocumentStateSize > len(payload) {
+		return SyncRequest{}, errors.New("document state exceeds the frame")
+	}
+
+	return SyncRequest{
+		Type:          header.Type,
+		RequestId:     header.RequestId,
+		DocumentId:    header.DocumentId,
+		DocumentState: base64.StdEncoding.EncodeToString(payload[:header.DocumentStateSize]),
+		SyncMessage:   base64.StdEncoding.EncodeToString(payload[header.DocumentStateSize:]),
+	}, nil
+}
@@ -0,0 +1,412 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	mutexSync "sync"
+	"time"
+)
+
+const commentsFileExtension = ".comments.json"
+
+type (
+	// CommentThread is a discussion about a range of the text of a document
+	CommentThread struct {
+		Id         string `json:"id" xml:"id" form:"id" query:"id"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		// commented text range, moved along with the edits of the document
+		Range TextSelection `json:"range" xml:"range" form:"range" query:"range"`
+		// commented text at the time the thread was created
+		Quote      string         `json:"quote" xml:"quote" form:"quote" query:"quote"`
+		Author     string         `json:"author" xml:"author" form:"author" query:"author"`
+		Text       string         `json:"text" xml:"text" form:"text" query:"text"`
+		CreatedAt  time.Time      `json:"createdAt" xml:"createdAt" form:"createdAt" query:"createdAt"`
+		Replies    []CommentReply `json:"replies" xml:"replies" form:"replies" query:"replies"`
+		Resolved   bool           `json:"resolved" xml:"resolved" form:"resolved" query:"resolved"`
+		ResolvedBy string         `json:"resolvedBy,omitempty" xml:"resolvedBy,omitempty" form:"resolvedBy" query:"resolvedBy"`
+		ResolvedAt *time.Time     `json:"resolvedAt,omitempty" xml:"resolvedAt,omitempty" form:"resolvedAt" query:"resolvedAt"`
+	}
+
+	CommentReply struct {
+		Id        string    `json:"id" xml:"id" form:"id" query:"id"`
+		Author    string    `json:"author" xml:"author" form:"author" query:"author"`
+		Text      string    `json:"text" xml:"text" form:"text" query:"text"`
+		CreatedAt time.Time `json:"createdAt" xml:"createdAt" form:"createdAt" query:"createdAt"`
+	}
+
+	NewCommentRequest struct {
+		Range TextSelection `json:"range" xml:"range" form:"range" query:"range"`
+		Text  string        `json:"text" xml:"text" form:"text" query:"text" validate:"required"`
+	}
+
+	CommentReplyRequest struct {
+		Text string `json:"text" xml:"text" form:"text" query:"text" validate:"required"`
+	}
+
+	UpdateCommentRequest struct {
+		Resolved bool `json:"resolved" xml:"resolved" form:"resolved" query:"resolved"`
+	}
+
+	// CommentMessage tells the clients of a document about a created, changed or deleted comment thread
+	CommentMessage struct {
+		Type       string `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		CommentId  string `json:"commentId" xml:"commentId" form:"commentId" query:"commentId"`
+		// the current state of the thread, not set if it has been deleted
+		Comment *CommentThread `json:"comment,omitempty" xml:"comment,omitempty" form:"comment" query:"comment"`
+	}
+)
+
+var (
+	errCommentNotFound  = errors.New("comment not found")
+	errNotCommentAuthor = errors.New("only the author of a comment may delete it")
+	errEmptyComment     = errors.New("the text of a comment must not be empty")
+)
+
+// CommentManager stores the comment threads of all documents in the state directory,
+// separate from the markdown files, so published pages are not affected by them
+type CommentManager struct {
+	stateDir string
+
+	lock mutexSync.Mutex
+	// threads document id -> comment threads of the document, oldest first, loaded on first access
+	threads map[string][]*CommentThread
+
+	resolveAnchor func(documentId string, anchor TextAnchor) (TextAnchor, error)
+	getContent    func(documentId string) (string, error)
+	onChanged     func(message CommentMessage)
+}
+
+func NewCommentManager(stateDir string) *CommentManager {
+	return &CommentManager{
+		stateDir: stateDir,
+		threads:  make(map[string][]*CommentThread),
+	}
+}
+
+// returns the path of the comments file of the given document
+func (cm *CommentManager) commentsPath(documentId string) string {
+	return filepath.Join(cm.stateDir, documentId+commentsFileExtension)
+}
+
+// GetComments returns all comment threads of the given document, with their ranges moved to the current version of the document
+func (cm *CommentManager) GetComments(documentId string) ([]CommentThread, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	threads, err := cm.loadLocked(documentId)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CommentThread, 0, len(threads))
+	for _, thread := range threads {
+		thread.Range = cm.resolveRange(documentId, thread.Range)
+		result = append(result, *thread)
+	}
+	return result, nil
+}
+
+// Create starts a new comment thread on the given range of the document
+func (cm *CommentManager) Create(user *User, documentId string, request NewCommentRequest) (CommentThread, error) {
+	if strings.TrimSpace(request.Text) == "" {
+		return CommentThread{}, errEmptyComment
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	threads, err := cm.loadLocked(documentId)
+	if err != nil {
+		return CommentThread{}, err
+	}
+
+	thread := &CommentThread{
+		Id:         randomToken(12),
+		DocumentId: documentId,
+		Range:      cm.resolveRange(documentId, request.Range),
+		Author:     user.Name,
+		Text:       request.Text,
+		CreatedAt:  time.Now(),
+		Replies:    []CommentReply{},
+	}
+	thread.Quote = cm.quote(documentId, thread.Range)
+
+	err = cm.saveLocked(documentId, append(threads, thread))
+	if err != nil {
+		return CommentThread{}, err
+	}
+	cm.notifyChanged(thread)
+	return *thread, nil
+}
+
+// Reply adds a reply to the given comment thread
+func (cm *CommentManager) Reply(user *User, documentId string, commentId string, request CommentReplyRequest) (CommentThread, error) {
+	if strings.TrimSpace(request.Text) == "" {
+		return CommentThread{}, errEmptyComment
+	}
+
+	return cm.update(documentId, commentId, func(thread *CommentThread) error {
+		thread.Replies = append(thread.Replies, CommentReply{
+			Id:        randomToken(12),
+			Author:    user.Name,
+			Text:      request.Text,
+			CreatedAt: time.Now(),
+		})
+		return nil
+	})
+}
+
+// SetResolved resolves the given comment thread or reopens it
+func (cm *CommentManager) SetResolved(user *User, documentId string, commentId string, resolved bool) (CommentThread, error) {
+	return cm.update(documentId, commentId, func(thread *CommentThread) error {
+		if thread.Resolved == resolved {
+			return nil
+		}
+		thread.Resolved = resolved
+		if resolved {
+			now := time.Now()
+			thread.ResolvedBy = user.Name
+			thread.ResolvedAt = &now
+		} else {
+			thread.ResolvedBy = ""
+			thread.ResolvedAt = nil
+		}
+		return nil
+	})
+}
+
+// DeleteReply removes a reply from the given comment thread, only its author or an admin may delete it
+func (cm *CommentManager) DeleteReply(user *User, documentId string, commentId string, replyId string) (CommentThread, error) {
+	return cm.update(documentId, commentId, func(thread *CommentThread) error {
+		for i, reply := range thread.Replies {
+			if reply.Id != replyId {
+				continue
+			}
+			if reply.Author != user.Name && !user.HasRole(RoleAdmin) {
+				return errNotCommentAuthor
+			}
+			thread.Replies = append(thread.Replies[:i:i], thread.Replies[i+1:]...)
+			return nil
+		}
+		return errCommentNotFound
+	})
+}
+
+// Delete removes the given comment thread including all replies, only its author or an admin may delete it
+func (cm *CommentManager) Delete(user *User, documentId string, commentId string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	threads, err := cm.loadLocked(documentId)
+	if err != nil {
+		return err
+	}
+
+	for i, thread := range threads {
+		if thread.Id != commentId {
+			continue
+		}
+		if thread.Author != user.Name && !user.HasRole(RoleAdmin) {
+			return errNotCommentAuthor
+		}
+		remaining := append(threads[:i:i], threads[i+1:]...)
+		err = cm.saveLocked(documentId, remaining)
+		if err != nil {
+			return err
+		}
+		if cm.onChanged != nil {
+			cm.onChanged(CommentMessage{
+				Type:       TypeCommentRemoved,
+				DocumentId: documentId,
+				CommentId:  commentId,
+			})
+		}
+		return nil
+	}
+	return errCommentNotFound
+}
+
+// RemoveComments removes all comment threads of the given document, e.g. after it has been deleted
+func (cm *CommentManager) RemoveComments(documentId string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	delete(cm.threads, documentId)
+	err := os.Remove(cm.commentsPath(documentId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Unable to remove comments of document %s: %v", documentId, err)
+	}
+}
+
+// RelocateComments moves all comment threads of a document to its new id, e.g. after the document has been renamed
+func (cm *CommentManager) RelocateComments(oldId string, newId string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	threads, err := cm.loadLocked(oldId)
+	if err != nil {
+		return err
+	}
+	for _, thread := range threads {
+		thread.DocumentId = newId
+	}
+	err = cm.saveLocked(newId, threads)
+	if err != nil {
+		return err
+	}
+	delete(cm.threads, oldId)
+	err = os.Remove(cm.commentsPath(oldId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// applies the given change to a comment thread, stores it and passes it on to the clients of the document
+func (cm *CommentManager) update(documentId string, commentId string, change func(thread *CommentThread) error) (CommentThread, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	threads, err := cm.loadLocked(documentId)
+	if err != nil {
+		return CommentThread{}, err
+	}
+
+	for _, thread := range threads {
+		if thread.Id != commentId {
+			continue
+		}
+		previous := *thread
+		err = change(thread)
+		if err == nil {
+			thread.Range = cm.resolveRange(documentId, thread.Range)
+			err = cm.saveLocked(documentId, threads)
+		}
+		if err != nil {
+			*thread = previous
+			return CommentThread{}, err
+		}
+		cm.notifyChanged(thread)
+		return *thread, nil
+	}
+	return CommentThread{}, errCommentNotFound
+}
+
+// returns the comment threads of the given document, reading them from disk if necessary,
+// must be called with the lock held
+func (cm *CommentManager) loadLocked(documentId string) ([]*CommentThread, error) {
+	if threads, ok := cm.threads[documentId]; ok {
+		return threads, nil
+	}
+
+	var threads []*CommentThread
+	data, err := os.ReadFile(cm.commentsPath(documentId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &threads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cm.threads[documentId] = threads
+	return threads, nil
+}
+
+// writes the given comment threads of a document to disk, must be called with the lock held
+func (cm *CommentManager) saveLocked(documentId string, threads []*CommentThread) error {
+	if len(threads) <= 0 {
+		err := os.Remove(cm.commentsPath(documentId))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		cm.threads[documentId] = threads
+		return nil
+	}
+
+	data, err := json.Marshal(threads)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(cm.commentsPath(documentId), data, 0600)
+	if err != nil {
+		return err
+	}
+	cm.threads[documentId] = threads
+	return nil
+}
+
+// moves the given range to the current version of the document, if a resolver is set
+func (cm *CommentManager) resolveRange(documentId string, selection TextSelection) TextSelection {
+	if cm.resolveAnchor == nil {
+		return selection
+	}
+	resolved := selection
+	var err error
+	if resolved.Anchor, err = cm.resolveAnchor(documentId, selection.Anchor); err != nil {
+		log.Printf("Unable to resolve comment range in document %s: %v", documentId, err)
+		return selection
+	}
+	if resolved.Head, err = cm.resolveAnchor(documentId, selection.Head); err != nil {
+		log.Printf("Unable to resolve comment range in document %s: %v", documentId, err)
+		return selection
+	}
+	return resolved
+}
+
+// returns the text covered by the given range of the current version of the document
+func (cm *CommentManager) quote(documentId string, selection TextSelection) string {
+	if cm.getContent == nil {
+		return ""
+	}
+	content, err := cm.getContent(documentId)
+	if err != nil {
+		log.Printf("Unable to get content of document %s: %v", documentId, err)
+		return ""
+	}
+
+	text := []rune(content)
+	start := max(min(selection.Anchor.Index, selection.Head.Index), 0)
+	end := min(max(selection.Anchor.Index, selection.Head.Index), len(text))
+	if start >= end {
+		return ""
+	}
+	return string(text[start:end])
+}
+
+// passes the current state of the given thread on to the listener
+func (cm *CommentManager) notifyChanged(thread *CommentThread) {
+	if cm.onChanged == nil {
+		return
+	}
+	comment := *thread
+	cm.onChanged(CommentMessage{
+		Type:       TypeComment,
+		DocumentId: thread.DocumentId,
+		CommentId:  thread.Id,
+		Comment:    &comment,
+	})
+}
+
+// SetAnchorResolver sets the function used to move text anchors to the current version of a document
+func (cm *CommentManager) SetAnchorResolver(f func(documentId string, anchor TextAnchor) (TextAnchor, error)) {
+	cm.resolveAnchor = f
+}
+
+// SetContentProvider sets the function used to get the current content of a document
+func (cm *CommentManager) SetContentProvider(f func(documentId string) (string, error)) {
+	cm.getContent = f
+}
+
+// SetOnCommentChangedListener sets the listener that is notified whenever a comment thread has been created, changed or deleted
+func (cm *CommentManager) SetOnCommentChangedListener(f func(message CommentMessage)) {
+	cm.onChanged = f
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCommentRangeFollowsEdits(t *testing.T) {
+	const content = "# Title\n\nHello world, how are you?\n"
+
+	tests := []struct {
+		name string
+		// edits of another client made after the comment has been created
+		edit func(client *testClient)
+		// edits of another client the author of the comment does not know about yet
+		concurrentEdit func(client *testClient)
+		// the comment manager is created again after the edits, e.g. after a restart of the server
+		restart bool
+		// edits of another client made after the restart
+		editAfterRestart func(client *testClient)
+		// text covered by the range of the comment after the edits
+		expected string
+	}{
+		{
+			name:     "no edit",
+			expected: "world",
+		},
+		{
+			name:     "insertion before the range",
+			edit:     func(client *testClient) { client.replace("Hello", "Hello there") },
+			expected: "world",
+		},
+		{
+			name:     "insertion after the range",
+			edit:     func(client *testClient) { client.replace("how", "how exactly") },
+			expected: "world",
+		},
+		{
+			name:     "insertion within the range",
+			edit:     func(client *testClient) { client.replace("world", "wide world") },
+			expected: "wide world",
+		},
+		{
+			name:     "deletion before the range",
+			edit:     func(client *testClient) { client.replace("# Title\n\n", "") },
+			expected: "world",
+		},
+		{
+			name:     "deletion of the commented text",
+			edit:     func(client *testClient) { client.replace("world, ", "") },
+			expected: "",
+		},
+		{
+			name:           "comment on an outdated version",
+			concurrentEdit: func(client *testClient) { client.replace("# Title", "# A much longer title") },
+			expected:       "world",
+		},
+		{
+			name:     "restart",
+			edit:     func(client *testClient) { client.append("More text\n") },
+			restart:  true,
+			expected: "world",
+		},
+		{
+			name:             "edit after restart",
+			restart:          true,
+			editAfterRestart: func(client *testClient) { client.replace("Hello", "Oh, hello") },
+			expected:         "world",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": content})
+			documentId := s.documentId("a.md")
+			author := s.connect(t, documentId, testEditor, ModeEdit)
+			editor := s.connect(t, documentId, &User{Name: "john", Roles: []string{RoleEditor}}, ModeEdit)
+
+			// the author selects "world" in the version of the document it knows
+			heads := encodeHeads(author.doc.Heads())
+			start := utf8.RuneCountInString(content[:strings.Index(content, "world")])
+			selection := TextSelection{
+				Anchor: TextAnchor{Heads: heads, Index: start},
+				Head:   TextAnchor{Heads: heads, Index: start + utf8.RuneCountInString("world")},
+			}
+			edit := func(f func(client *testClient)) {
+				if f == nil {
+					return
+				}
+				f(editor)
+				if err := editor.sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			edit(tt.concurrentEdit)
+			created, err := s.commentManager.Create(testEditor, documentId, NewCommentRequest{Range: selection, Text: "Which world?"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Quote != "world" {
+				t.Fatalf("expected quote %q, got %q", "world", created.Quote)
+			}
+
+			edit(tt.edit)
+			commentManager := s.commentManager
+			if tt.restart {
+				commentManager = NewCommentManager(s.stateDir)
+				commentManager.SetAnchorResolver(s.syncManager.resolveAnchor)
+				commentManager.SetContentProvider(s.syncManager.readContent)
+			}
+			edit(tt.editAfterRestart)
+
+			threads, err := commentManager.GetComments(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(threads) != 1 || threads[0].Id != created.Id || threads[0].Quote != "world" {
+				t.Fatalf("unexpected comments %+v", threads)
+			}
+			if quoted := commentManager.quote(documentId, threads[0].Range); quoted != tt.expected {
+				t.Fatalf("expected range covering %q, got %q in %q", tt.expected, quoted, editor.content())
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package backend
 
 import (
+	automerge "github.com/automerge/automerge-go"
 	"github.com/sergi/go-diff/diffmatchpatch"
+	"slices"
+	"unicode/utf8"
 )
 
 var (
@@ -22,3 +25,181 @@ func CreatePatch(oldText string, newText string) (patches string, err error) {
 	patches = dmp.PatchToText(patchArray)
 	return patches, nil
 }
+
+// SpliceTextDiff applies the difference between oldText and newText to the given automerge text
+// as a minimal set of insertions and deletions, so concurrent edits of other clients are preserved
+func SpliceTextDiff(text *automerge.Text, oldText string, newText string) (err error) {
+	diffs := dmp.DiffMain(oldText, newText, false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	// automerge text positions are counted in unicode code points
+	position := 0
+	for _, diff := range diffs {
+		length := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			position += length
+		case diffmatchpatch.DiffDelete:
+			err = text.Delete(position, length)
+		case diffmatchpatch.DiffInsert:
+			err = text.Insert(position, diff.Text)
+			position += length
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransformTextIndex maps a position in oldText to the corresponding position in newText,
+// positions are counted in unicode code points
+func TransformTextIndex(oldText string, newText string, index int) int {
+	diffs := dmp.DiffMain(oldText, newText, false)
+
+	oldPosition := 0
+	newPosition := 0
+	for _, diff := range diffs {
+		length := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			if index < oldPosition+length {
+				return newPosition + index - oldPosition
+			}
+			oldPosition += length
+			newPosition += length
+		case diffmatchpatch.DiffDelete:
+			if index < oldPosition+length {
+				// the position has been deleted, move it to where the deleted text was
+				return newPosition
+			}
+			oldPosition += length
+		case diffmatchpatch.DiffInsert:
+			newPosition += length
+		}
+	}
+	return newPosition
+}
+
+// MergeTextChanges applies the changes made between base and changed to the given text,
+// a change is only applied where the text it replaces and the text around it are found unchanged,
+// returns false if any of the changes could not be applied
+func MergeTextChanges(base string, changed string, text string) (merged string, ok bool) {
+	baseRunes := []rune(base)
+	runes := []rune(text)
+	result := make([]rune, 0, len(runes))
+	// text has been copied to the result up to copied, baseEnd is the corresponding position in base
+	copied := 0
+	baseEnd := 0
+	offset := 0
+	for _, change := range DiffTextChanges(base, changed) {
+		end := change.Index + utf8.RuneCountInString(change.Original)
+		// like the context of a patch, the context is widened until the change can only be applied at one position
+		var before, after, pattern []rune
+		for margin := dmp.PatchMargin; ; margin += dmp.PatchMargin {
+			before = baseRunes[max(baseEnd, change.Index-margin):change.Index]
+			after = baseRunes[end:min(len(baseRunes), end+margin)]
+			pattern = slices.Concat(before, []rune(change.Original), after)
+			if margin >= dmp.MatchMaxBits || occursOnce(baseRunes, pattern) {
+				break
+			}
+		}
+
+		start := nearestIndex(runes, pattern, copied, change.Index-len(before)+offset)
+		if start < 0 {
+			return text, false
+		}
+		offset = start + len(before) - change.Index
+		result = append(result, runes[copied:start+len(before)]...)
+		result = append(result, []rune(change.Replacement)...)
+		copied = start + len(pattern) - len(after)
+		baseEnd = end
+	}
+	result = append(result, runes[copied:]...)
+	return string(result), true
+}
+
+// returns true if pattern occurs exactly once in text
+func occursOnce(text []rune, pattern []rune) bool {
+	first := nearestIndex(text, pattern, 0, 0)
+	return first >= 0 && nearestIndex(text, pattern, first+1, first+1) < 0
+}
+
+// returns the position of the occurrence of pattern in text closest to the expected position,
+// only occurrences starting at from or later are considered, returns -1 if there is none
+func nearestIndex(text []rune, pattern []rune, from int, expected int) int {
+	last := len(text) - len(pattern)
+	if last < from {
+		return -1
+	}
+	expected = min(max(expected, from), last)
+	for distance := 0; expected-distance >= from || expected+distance <= last; distance++ {
+		for _, position := range []int{expected - distance, expected + distance} {
+			if position >= from && position <= last && slices.Equal(text[position:position+len(pattern)], pattern) {
+				return position
+			}
+		}
+	}
+	return -1
+}
+
+// TextChange replaces the text Original at Index (counted in unicode code points) with Replacement
+type TextChange struct {
+	Index       int    `json:"index" xml:"index" form:"index" query:"index"`
+	Original    string `json:"original" xml:"original" form:"original" query:"original"`
+	Replacement string `json:"replacement" xml:"replacement" form:"replacement" query:"replacement"`
+}
+
+// DiffTextChanges returns the changes between oldText and newText, adjacent insertions and deletions
+// are combined into a single change, positions refer to oldText
+func DiffTextChanges(oldText string, newText string) []TextChange {
+	diffs := dmp.DiffMain(oldText, newText, false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	var changes []TextChange
+	var current *TextChange
+	position := 0
+	for _, diff := range diffs {
+		if diff.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				changes = append(changes, *current)
+				current = nil
+			}
+			position += utf8.RuneCountInString(diff.Text)
+			continue
+		}
+
+		if current == nil {
+			current = &TextChange{Index: position}
+		}
+		if diff.Type == diffmatchpatch.DiffDelete {
+			current.Original += diff.Text
+			position += utf8.RuneCountInString(diff.Text)
+		} else {
+			current.Replacement += diff.Text
+		}
+	}
+	if current != nil {
+		changes = append(changes, *current)
+	}
+	return changes
+}
+
+// ApplyTextChanges applies the given changes, which must not overlap, to the given text,
+// changes whose original text does not match the text are skipped
+func ApplyTextChanges(text string, changes []TextChange) string {
+	sorted := slices.Clone(changes)
+	slices.SortFunc(sorted, func(a, b TextChange) int {
+		return b.Index - a.Index
+	})
+
+	runes := []rune(text)
+	for _, change := range sorted {
+		end := change.Index + utf8.RuneCountInString(change.Original)
+		if change.Index < 0 || end > len(runes) || string(runes[change.Index:end]) != change.Original {
+			continue
+		}
+		runes = slices.Concat(runes[:change.Index], []rune(change.Replacement), runes[end:])
+	}
+	return string(runes)
+}
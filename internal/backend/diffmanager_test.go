@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"testing"
+)
+
+func TestMergeTextChanges(t *testing.T) {
+	const base = "# Title\n\nFirst paragraph\n\nSecond paragraph\n"
+
+	tests := []struct {
+		name    string
+		changed string
+		// content of the shared document the changes are merged into
+		text     string
+		expected string
+		conflict bool
+	}{
+		{
+			name:     "no concurrent edit",
+			changed:  "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			text:     base,
+			expected: "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+		},
+		{
+			name:     "concurrent edit in another paragraph",
+			changed:  "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			text:     "# Title\n\nFirst paragraph\n\nSecond paragraph edited\n",
+			expected: "# Title\n\nFirst paragraph changed\n\nSecond paragraph edited\n",
+		},
+		{
+			name:     "concurrent insertion before the change",
+			changed:  "# Title\n\nFirst paragraph\n\nSecond paragraph changed\n",
+			text:     "# Title\n\nIntroduction\n\nFirst paragraph\n\nSecond paragraph\n",
+			expected: "# Title\n\nIntroduction\n\nFirst paragraph\n\nSecond paragraph changed\n",
+		},
+		{
+			name:     "deletion",
+			changed:  "# Title\n\nSecond paragraph\n",
+			text:     "# Main Title\n\nFirst paragraph\n\nSecond paragraph\n",
+			expected: "# Main Title\n\nSecond paragraph\n",
+		},
+		{
+			name:     "same change on both sides",
+			changed:  "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			text:     "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			conflict: true,
+		},
+		{
+			name:     "concurrent edit of the changed text",
+			changed:  "# Title\n\nFirst chapter\n\nSecond paragraph\n",
+			text:     "# Title\n\nFirst section\n\nSecond paragraph\n",
+			conflict: true,
+		},
+		{
+			name:     "concurrent edit next to the changed text",
+			changed:  "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			text:     "# Title\n\nFirst paragraphs\n\nSecond paragraph\n",
+			conflict: true,
+		},
+		{
+			name:     "changed text has been deleted",
+			changed:  "# Title\n\nFirst paragraph changed\n\nSecond paragraph\n",
+			text:     "# Title\n\nSecond paragraph\n",
+			conflict: true,
+		},
+		{
+			name:     "multibyte characters",
+			changed:  "# Title\n\nFirst paragraph\n\nSecond paragraph ✓\n",
+			text:     "# Tïtle ✎\n\nFirst paragraph\n\nSecond paragraph\n",
+			expected: "# Tïtle ✎\n\nFirst paragraph\n\nSecond paragraph ✓\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, ok := MergeTextChanges(base, tt.changed, tt.text)
+			if ok == tt.conflict {
+				t.Fatalf("expected conflict = %v, got %q", tt.conflict, merged)
+			}
+			if tt.conflict {
+				if merged != tt.text {
+					t.Fatalf("the text has been changed despite the conflict: %q", merged)
+				}
+				return
+			}
+			if merged != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, merged)
+			}
+		})
+	}
+}
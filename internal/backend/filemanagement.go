@@ -5,6 +5,7 @@ import (
 	"io"
 	"mime/multipart"
 	"os"
+	"path/filepath"
 )
 
 // ReadFile read the content of a file
@@ -17,12 +18,66 @@ func ReadFile(path string) (string, error) {
 	return string(data), nil
 }
 
+// WriteFile replaces the content of a file atomically, an existing file keeps its mode and ownership
 func WriteFile(path string, data []byte) (err error) {
-	err = os.WriteFile(path, data, 0x660)
+	perm := os.FileMode(0660)
+	existing, statErr := os.Stat(path)
+	if statErr == nil {
+		perm = existing.Mode().Perm()
+	} else {
+		existing = nil
+	}
+
+	err = writeFileAtomicAs(path, data, perm, existing)
 	isError(err)
 	return err
 }
 
+// writes data to a temporary file next to the target and renames it afterwards,
+// so the target never contains partially written content
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	return writeFileAtomicAs(path, data, perm, nil)
+}
+
+// same as writeFileAtomic, but the written file gets the owner and group of the given file (if any)
+func writeFileAtomicAs(path string, data []byte, perm os.FileMode, owner os.FileInfo) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tempPath, perm); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err = copyOwnership(tempPath, owner); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory entry has been written
+	return syncDirectory(filepath.Dir(path))
+}
+
 // CreateFile create a new file with the given content
 func CreateFile(path string, content string) {
 	// detect if file exists
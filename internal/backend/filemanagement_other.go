@@ -0,0 +1,15 @@
+//go:build !unix
+
+package backend
+
+import "os"
+
+// file ownership can not be changed on this platform
+func copyOwnership(path string, owner os.FileInfo) error {
+	return nil
+}
+
+// directories can not be synced on this platform
+func syncDirectory(path string) error {
+	return nil
+}
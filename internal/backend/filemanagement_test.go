@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// mode of the file before it is written, it does not exist if 0
+		existing os.FileMode
+		expected os.FileMode
+	}{
+		{name: "new file", expected: 0660},
+		{name: "existing file", existing: 0640, expected: 0640},
+		{name: "private file", existing: 0600, expected: 0600},
+		{name: "executable file", existing: 0755, expected: 0755},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a.md")
+			if tt.existing != 0 {
+				if err := os.WriteFile(path, []byte("old content\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				// not affected by the umask
+				if err := os.Chmod(path, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := WriteFile(path, []byte("new content\n")); err != nil {
+				t.Fatal(err)
+			}
+			assertFile(t, path, "new content\n", tt.expected)
+			assertNoTemporaryFiles(t, dir)
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		perm     os.FileMode
+	}{
+		{name: "new file", perm: 0600},
+		{name: "replaced file", existing: true, perm: 0600},
+		{name: "replaced file with other mode", existing: true, perm: 0640},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "state.bin")
+			if tt.existing {
+				if err := os.WriteFile(path, []byte("old content"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(path, []byte("new content"), tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			assertFile(t, path, "new content", tt.perm)
+			assertNoTemporaryFiles(t, dir)
+		})
+	}
+}
+
+func TestWriteFileAtomicFailureKeepsTarget(t *testing.T) {
+	dir := t.TempDir()
+	// the target is a directory, so the temporary file cannot be renamed to it
+	path := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new content"), 0600); err == nil {
+		t.Fatalf("the directory has been replaced")
+	}
+	if _, err := os.Stat(filepath.Join(path, "child")); err != nil {
+		t.Fatalf("the target has been changed: %v", err)
+	}
+	assertNoTemporaryFiles(t, dir)
+}
+
+// fails the test if the file at the given path does not have the given content and mode
+func assertFile(t *testing.T, path string, content string, perm os.FileMode) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Fatalf("expected content %q, got %q", content, data)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != perm {
+		t.Fatalf("expected mode %v, got %v", perm, info.Mode().Perm())
+	}
+}
+
+// fails the test if a temporary file of an atomic write has been left in the given directory
+func assertNoTemporaryFiles(t *testing.T, dir string) {
+	t.Helper()
+	temporaryFiles, err := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temporaryFiles) > 0 {
+		t.Fatalf("temporary files have been left behind: %v", temporaryFiles)
+	}
+}
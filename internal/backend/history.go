@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	automerge "github.com/automerge/automerge-go"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type (
+	// DocumentChange is a single change in the automerge history of a document
+	DocumentChange struct {
+		// hex encoded hash of the change
+		Hash string `json:"hash" xml:"hash" form:"hash" query:"hash"`
+		// hex encoded id of the automerge actor that made the change
+		Actor string `json:"actor" xml:"actor" form:"actor" query:"actor"`
+		// user the actor belongs to, empty for changes of the server itself and unknown actors
+		User string `json:"user" xml:"user" form:"user" query:"user"`
+		// number of the change among all changes of its actor, starting at 1
+		Seq     uint64    `json:"seq" xml:"seq" form:"seq" query:"seq"`
+		Time    time.Time `json:"time" xml:"time" form:"time" query:"time"`
+		Message string    `json:"message" xml:"message" form:"message" query:"message"`
+		// size of the encoded change in bytes
+		Size int `json:"size" xml:"size" form:"size" query:"size"`
+		// hashes of the changes this change is based on
+		Dependencies []string `json:"dependencies" xml:"dependencies" form:"dependencies" query:"dependencies"`
+	}
+
+	// DocumentDiff describes the differences between two versions of a document
+	DocumentDiff struct {
+		// heads of the older version, empty for the beginning of the history
+		From []string `json:"from" xml:"from" form:"from" query:"from"`
+		// heads of the newer version
+		To []string `json:"to" xml:"to" form:"to" query:"to"`
+		// the differences as diff-match-patch patch
+		Patch   string       `json:"patch" xml:"patch" form:"patch" query:"patch"`
+		Changes []TextChange `json:"changes" xml:"changes" form:"changes" query:"changes"`
+	}
+
+	// documentBlame is the blame of a document as of the version with the given heads
+	documentBlame struct {
+		heads []automerge.ChangeHash
+		// copy of the document the changes are replayed on
+		replay *automerge.Doc
+		text   []rune
+		// the change that has inserted each character of the text
+		origins []*automerge.Change
+		usedAt  time.Time
+	}
+
+	// BlameSpan is a part of the text of a document that has last been changed by the same change
+	BlameSpan struct {
+		// position of the span in the text, counted in unicode code points
+		Index int    `json:"index" xml:"index" form:"index" query:"index"`
+		Text  string `json:"text" xml:"text" form:"text" query:"text"`
+		// hash of the change that has inserted the text
+		Change string    `json:"change" xml:"change" form:"change" query:"change"`
+		Actor  string    `json:"actor" xml:"actor" form:"actor" query:"actor"`
+		User   string    `json:"user" xml:"user" form:"user" query:"user"`
+		Time   time.Time `json:"time" xml:"time" form:"time" query:"time"`
+	}
+)
+
+const (
+	// number of documents whose blame is kept to update it with later changes
+	maxCachedBlames = 16
+	// changes of the same actor made within this time of each other are blamed together
+	blameSessionGap = time.Minute
+)
+
+var (
+	errInvalidHeads = errors.New("invalid heads")
+	errUnknownHeads = errors.New("the document has no version with the given heads")
+)
+
+// ParseHeads splits a comma separated list of hex encoded change hashes, as used in query params
+func ParseHeads(value string) []string {
+	var heads []string
+	for _, head := range strings.Split(value, ",") {
+		head = strings.TrimSpace(head)
+		if head != "" {
+			heads = append(heads, head)
+		}
+	}
+	return heads
+}
+
+// GetChanges returns the automerge history of the given document, every change after the changes it depends on
+func (sm *AutomergeSyncManager) GetChanges(documentId string) ([]DocumentChange, error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	automergeDocument, err := sm.historyDocumentLocked(documentId)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := automergeDocument.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]DocumentChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, DocumentChange{
+			Hash:         change.Hash().String(),
+			Actor:        change.ActorID(),
+			User:         sm.actorRegistry.GetUser(change.ActorID()),
+			Seq:          change.ActorSeq(),
+			Time:         change.Timestamp(),
+			Message:      change.Message(),
+			Size:         len(change.Save()),
+			Dependencies: encodeHeads(change.Dependencies()),
+		})
+	}
+	return result, nil
+}
+
+// GetContentAt returns the content of the given document as it was at the version with the given heads
+func (sm *AutomergeSyncManager) GetContentAt(documentId string, heads []string) (string, error) {
+	sm.documentsLock.Lock()
+	defer sm.documentsLock.Unlock()
+
+	automergeDocument, err := sm.historyDocumentLocked(documentId)
+	if err != nil {
+		return "", err
+	}
+	return contentAt(automergeDocument, heads)
+}
+
+// GetDiff returns the differences between the versions of the given document with the given heads,
+// no from heads refer to the beginning of the history, no to heads to the current version
+func (sm *AutomergeSyncManager) GetDiff(documentId string, from []string, to []string) (DocumentDiff, error) {
+	sm.documentsLock.Lock()
+	automergeDocument, err := sm.historyDocumentLocked(documentId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return DocumentDiff{}, err
+	}
+	if len(to) <= 0 {
+		to = encodeHeads(automergeDocument.Heads())
+	}
+
+	oldText := ""
+	if len(from) > 0 {
+		oldText, err = contentAt(automergeDocument, from)
+	} else {
+		from = []string{}
+	}
+	newText := ""
+	if err == nil {
+		newText, err = contentAt(automergeDocument, to)
+	}
+	sm.documentsLock.Unlock()
+	if err != nil {
+		return DocumentDiff{}, err
+	}
+
+	patch, err := CreatePatch(oldText, newText)
+	if err != nil {
+		return DocumentDiff{}, err
+	}
+	changes := DiffTextChanges(oldText, newText)
+	if changes == nil {
+		changes = []TextChange{}
+	}
+	return DocumentDiff{
+		From:    from,
+		To:      to,
+		Patch:   patch,
+		Changes: changes,
+	}, nil
+}
+
+// GetBlame returns the current text of the given document split into spans of text that have been inserted
+// in the same editing session, the blame is kept and only updated with the changes made since it has been requested
+func (sm *AutomergeSyncManager) GetBlame(documentId string) ([]BlameSpan, error) {
+	sm.blamesLock.Lock()
+	defer sm.blamesLock.Unlock()
+
+	sm.documentsLock.Lock()
+	automergeDocument, err := sm.historyDocumentLocked(documentId)
+	if err != nil {
+		sm.documentsLock.Unlock()
+		return nil, err
+	}
+	blame := sm.blames[documentId]
+	// the document may have been replaced by another one with the same id
+	if blame != nil && !containsChanges(automergeDocument, blame.heads) {
+		blame = nil
+	}
+	var changes []*automerge.Change
+	if blame != nil {
+		changes, err = automergeDocument.Changes(blame.heads...)
+	} else {
+		changes, err = automergeDocument.Changes()
+	}
+	heads := automergeDocument.Heads()
+	sm.documentsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if blame == nil {
+		blame = &documentBlame{replay: automerge.New()}
+		sm.cacheBlameLocked(documentId, blame)
+	}
+	err = blame.apply(changes)
+	if err != nil {
+		delete(sm.blames, documentId)
+		return nil, err
+	}
+	blame.heads = heads
+	blame.usedAt = time.Now()
+
+	spans := []BlameSpan{}
+	for start := 0; start < len(blame.text); {
+		end := start + 1
+		for end < len(blame.text) && blame.origins[end] == blame.origins[start] {
+			end++
+		}
+		change := blame.origins[start]
+		spans = append(spans, BlameSpan{
+			Index:  start,
+			Text:   string(blame.text[start:end]),
+			Change: change.Hash().String(),
+			Actor:  change.ActorID(),
+			User:   sm.actorRegistry.GetUser(change.ActorID()),
+			Time:   change.Timestamp(),
+		})
+		start = end
+	}
+	return spans, nil
+}
+
+// keeps the given blame, the least recently used blame is dropped if too many are kept,
+// must be called with the blames lock held
+func (sm *AutomergeSyncManager) cacheBlameLocked(documentId string, blame *documentBlame) {
+	if len(sm.blames) >= maxCachedBlames {
+		var oldestId string
+		for id, b := range sm.blames {
+			if oldestId == "" || b.usedAt.Before(sm.blames[oldestId].usedAt) {
+				oldestId = id
+			}
+		}
+		delete(sm.blames, oldestId)
+	}
+	sm.blames[documentId] = blame
+}
+
+// replays the given changes and attributes the text they insert to them, automerge records about one change
+// per keystroke, so the consecutive changes of an editing session are blamed together as its last change
+// instead of reading the whole text after every single change
+func (b *documentBlame) apply(changes []*automerge.Change) error {
+	for i, change := range changes {
+		// applying the change itself would apply all changes it has been read with
+		err := b.replay.LoadIncremental(change.Save())
+		if err != nil {
+			return err
+		}
+		if i+1 < len(changes) && continuesSession(change, changes[i+1]) {
+			continue
+		}
+		changedText, err := b.replay.Path(ContentPath).Text().Get()
+		if err != nil {
+			return err
+		}
+		b.update([]rune(changedText), change)
+	}
+	return nil
+}
+
+// returns true if the given next change has been made right after the given change in the same editing session
+func continuesSession(change *automerge.Change, next *automerge.Change) bool {
+	dependencies := next.Dependencies()
+	return next.ActorID() == change.ActorID() &&
+		len(dependencies) == 1 && dependencies[0] == change.Hash() &&
+		next.Timestamp().Sub(change.Timestamp()) < blameSessionGap
+}
+
+// attributes the text inserted into the blamed text by the given change to the change,
+// only the part between the unchanged start and end of the text is compared
+func (b *documentBlame) update(text []rune, change *automerge.Change) {
+	prefix := 0
+	for prefix < len(b.text) && prefix < len(text) && b.text[prefix] == text[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(b.text)-prefix && suffix < len(text)-prefix && b.text[len(b.text)-1-suffix] == text[len(text)-1-suffix] {
+		suffix++
+	}
+	oldMiddle := b.text[prefix : len(b.text)-suffix]
+	newMiddle := text[prefix : len(text)-suffix]
+	if len(oldMiddle) <= 0 && len(newMiddle) <= 0 {
+		return
+	}
+
+	origins := make([]*automerge.Change, 0, len(newMiddle))
+	if len(oldMiddle) <= 0 || len(newMiddle) <= 0 {
+		for range newMiddle {
+			origins = append(origins, change)
+		}
+	} else {
+		position := prefix
+		for _, diff := range dmp.DiffMainRunes(oldMiddle, newMiddle, false) {
+			length := utf8.RuneCountInString(diff.Text)
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				origins = append(origins, b.origins[position:position+length]...)
+				position += length
+			case diffmatchpatch.DiffDelete:
+				position += length
+			case diffmatchpatch.DiffInsert:
+				for range length {
+					origins = append(origins, change)
+				}
+			}
+		}
+	}
+	b.origins = slices.Replace(b.origins, prefix, len(b.text)-suffix, origins...)
+	b.text = text
+}
+
+// returns true if the given automerge document contains all changes with the given hashes
+func containsChanges(automergeDocument *automerge.Doc, hashes []automerge.ChangeHash) bool {
+	for _, hash := range hashes {
+		if _, err := automergeDocument.Change(hash); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the automerge document of the given document to read its history from, documents that are not open
+// are loaded from the state store without opening them, must be called with the documents lock held
+func (sm *AutomergeSyncManager) historyDocumentLocked(documentId string) (*automerge.Doc, error) {
+	if automergeDocument, ok := sm.documents[documentId]; ok {
+		return automergeDocument, nil
+	}
+	if sm.treeManager.GetDocument(documentId) == nil {
+		return nil, fmt.Errorf("document %s does not exist", documentId)
+	}
+
+	automergeDocument, err := sm.store.Load(documentId)
+	if err != nil || automergeDocument != nil {
+		return automergeDocument, err
+	}
+	// no history has been recorded yet
+	return sm.readDocumentLocked(documentId)
+}
+
+// returns the text of the given automerge document at the version with the given heads
+func contentAt(automergeDocument *automerge.Doc, heads []string) (string, error) {
+	changeHashes, err := decodeHeads(heads)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidHeads, err)
+	}
+	for _, hash := range changeHashes {
+		if _, err := automergeDocument.Change(hash); err != nil {
+			return "", errUnknownHeads
+		}
+	}
+
+	version, err := automergeDocument.Fork(changeHashes...)
+	if err != nil {
+		return "", err
+	}
+	return version.Path(ContentPath).Text().Get()
+}
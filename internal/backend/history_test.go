@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	otherEditor := &User{Name: "john", Roles: []string{RoleEditor}}
+
+	tests := []struct {
+		name string
+		// the clients disconnect, so the blame is read from the stored document state
+		disconnect bool
+		// the server is restarted before the blame is requested
+		restart bool
+		// the blame is requested after the restart and updated with another edit
+		editAfterRestart bool
+		// text -> user it is expected to be attributed to
+		expected map[string]string
+	}{
+		{
+			name:     "open document",
+			expected: map[string]string{"Jane was here\n": testEditor.Name, "John too\n": otherEditor.Name},
+		},
+		{
+			name:       "closed document",
+			disconnect: true,
+			expected:   map[string]string{"Jane was here\n": testEditor.Name, "John too\n": otherEditor.Name},
+		},
+		{
+			name:       "restart",
+			disconnect: true,
+			restart:    true,
+			expected:   map[string]string{"Jane was here\n": testEditor.Name, "John too\n": otherEditor.Name},
+		},
+		{
+			name:             "edit after restart",
+			disconnect:       true,
+			restart:          true,
+			editAfterRestart: true,
+			expected: map[string]string{
+				"Jane was here\n": testEditor.Name,
+				"John too\n":      otherEditor.Name,
+				"Back again\n":    testEditor.Name,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": "# A\n"})
+			documentId := s.documentId("a.md")
+			jane := s.connect(t, documentId, testEditor, ModeEdit)
+			john := s.connect(t, documentId, otherEditor, ModeEdit)
+			jane.append("Jane was here\n")
+			if err := jane.sync(); err != nil {
+				t.Fatal(err)
+			}
+			if err := john.sync(); err != nil {
+				t.Fatal(err)
+			}
+			john.append("John too\n")
+			if err := john.sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.disconnect {
+				jane.disconnect()
+				john.disconnect()
+			}
+			if tt.restart {
+				s.start(t)
+			}
+			if tt.editAfterRestart {
+				if _, err := s.syncManager.GetBlame(documentId); err != nil {
+					t.Fatal(err)
+				}
+				jane = s.connect(t, documentId, testEditor, ModeEdit)
+				jane.append("Back again\n")
+				if err := jane.sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			spans, err := s.syncManager.GetBlame(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := s.syncManager.readContent(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blamed strings.Builder
+			for _, span := range spans {
+				if span.Index != len([]rune(blamed.String())) {
+					t.Fatalf("span %+v does not start where the previous one ends", span)
+				}
+				blamed.WriteString(span.Text)
+			}
+			if blamed.String() != content {
+				t.Fatalf("expected the spans to cover %q, got %q", content, blamed.String())
+			}
+			for text, user := range tt.expected {
+				found := false
+				for _, span := range spans {
+					if strings.Contains(span.Text, text) {
+						found = true
+						if span.User != user {
+							t.Fatalf("expected %q to be attributed to %s, got %+v", text, user, span)
+						}
+					}
+				}
+				if !found {
+					t.Fatalf("%q has not been blamed on its own, got %+v", text, spans)
+				}
+			}
+		})
+	}
+}
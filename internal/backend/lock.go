@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"path/filepath"
+	"sort"
+	"strings"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	// LockModeShared protects an item against being deleted, renamed or moved by other users,
+	// other users may still edit its content
+	LockModeShared = "shared"
+	// LockModeExclusive additionally prevents other users from editing the content of the item
+	LockModeExclusive = "exclusive"
+)
+
+type (
+	// Lock is held by a single user on a document or a section, a lock on a section covers everything within it
+	Lock struct {
+		ItemId   string `json:"itemId" xml:"itemId" form:"itemId" query:"itemId"`
+		ItemType string `json:"itemType" xml:"itemType" form:"itemType" query:"itemType"`
+		// path of the item relative to the docs directory
+		Path       string    `json:"path" xml:"path" form:"path" query:"path"`
+		Owner      string    `json:"owner" xml:"owner" form:"owner" query:"owner"`
+		Reason     string    `json:"reason" xml:"reason" form:"reason" query:"reason"`
+		Mode       string    `json:"mode" xml:"mode" form:"mode" query:"mode"`
+		AcquiredAt time.Time `json:"acquiredAt" xml:"acquiredAt" form:"acquiredAt" query:"acquiredAt"`
+		ExpiresAt  time.Time `json:"expiresAt" xml:"expiresAt" form:"expiresAt" query:"expiresAt"`
+
+		// absolute path of the item
+		path string
+	}
+
+	LockRequest struct {
+		Reason string `json:"reason" xml:"reason" form:"reason" query:"reason"`
+		// "shared" (default) or "exclusive"
+		Mode string `json:"mode" xml:"mode" form:"mode" query:"mode"`
+		// duration of the lease, e.g. "10m", defaults to the configured lock lease
+		Lease string `json:"lease" xml:"lease" form:"lease" query:"lease"`
+	}
+)
+
+// LockedError is returned for operations on items that are locked by another user
+type LockedError struct {
+	Lock Lock
+}
+
+func (e *LockedError) Error() string {
+	message := fmt.Sprintf("the %s '%s' is locked by %s until %s", e.Lock.ItemType, e.Lock.Path, e.Lock.Owner, e.Lock.ExpiresAt.Format(time.RFC3339))
+	if e.Lock.Reason != "" {
+		message += ": " + e.Lock.Reason
+	}
+	return message
+}
+
+var errNotLockOwner = errors.New("the lock is held by another user")
+
+// LockManager keeps track of the locks users hold on documents and sections,
+// locks are released by their owner or when their lease expires
+type LockManager struct {
+	treeManager *TreeManager
+	lease       time.Duration
+	maxLease    time.Duration
+
+	lock mutexSync.Mutex
+	// locks item id -> lock
+	locks map[string]*Lock
+}
+
+func NewLockManager(treeManager *TreeManager) *LockManager {
+	return &LockManager{
+		treeManager: treeManager,
+		lease:       configuration.CurrentConfig.Sync.LockLease,
+		maxLease:    configuration.CurrentConfig.Sync.MaxLockLease,
+		locks:       make(map[string]*Lock),
+	}
+}
+
+// ParseLockRequest validates the given request and returns its mode and lease,
+// leases longer than the configured maximum are shortened
+func (lm *LockManager) ParseLockRequest(request LockRequest) (mode string, lease time.Duration, err error) {
+	mode = request.Mode
+	switch mode {
+	case "":
+		mode = LockModeShared
+	case LockModeShared, LockModeExclusive:
+	default:
+		return "", 0, fmt.Errorf("unknown lock mode '%s'", mode)
+	}
+
+	lease = lm.lease
+	if request.Lease != "" {
+		lease, err = time.ParseDuration(request.Lease)
+		if err != nil {
+			return "", 0, err
+		}
+		if lease <= 0 {
+			return "", 0, errors.New("the lease must be positive")
+		}
+	}
+	return mode, min(lease, lm.maxLease), nil
+}
+
+// Acquire locks the item at the given path for the given user, a user who already holds the lock renews it,
+// the lock is refused if another user holds a lock on the item, on a section containing it or on an item within it
+func (lm *LockManager) Acquire(user *User, itemType string, itemId string, path string, mode string, lease time.Duration, reason string) (Lock, error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+
+	for _, l := range lm.locks {
+		if l.Owner != user.Name && (isWithinPath(path, l.path) || isWithinPath(l.path, path)) {
+			return Lock{}, &LockedError{Lock: *l}
+		}
+	}
+
+	now := time.Now()
+	l, ok := lm.locks[itemId]
+	if !ok {
+		l = &Lock{
+			ItemId:     itemId,
+			ItemType:   itemType,
+			Path:       lm.treeManager.RelativePath(path),
+			Owner:      user.Name,
+			AcquiredAt: now,
+			path:       path,
+		}
+		lm.locks[itemId] = l
+	}
+	l.Reason = reason
+	l.Mode = mode
+	l.ExpiresAt = now.Add(lease)
+	return *l, nil
+}
+
+// Release removes the lock on the given item, locks of other users can only be released by admins,
+// returns false if the item is not locked
+func (lm *LockManager) Release(user *User, itemId string) (released bool, err error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+
+	l, ok := lm.locks[itemId]
+	if !ok {
+		return false, nil
+	}
+	if l.Owner != user.Name && !user.HasRole(RoleAdmin) {
+		return false, errNotLockOwner
+	}
+	delete(lm.locks, itemId)
+	return true, nil
+}
+
+// GetLocks returns all locks that have not expired yet, oldest first
+func (lm *LockManager) GetLocks() []Lock {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+
+	locks := make([]Lock, 0, len(lm.locks))
+	for _, l := range lm.locks {
+		locks = append(locks, *l)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].AcquiredAt.Before(locks[j].AcquiredAt)
+	})
+	return locks
+}
+
+// CheckChange returns a LockedError if the item at the given path may not be deleted, renamed or moved by the given user
+func (lm *LockManager) CheckChange(user *User, path string) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+
+	for _, l := range lm.locks {
+		if l.Owner != user.Name && (isWithinPath(path, l.path) || isWithinPath(l.path, path)) {
+			return &LockedError{Lock: *l}
+		}
+	}
+	return nil
+}
+
+// CheckEdit returns a LockedError if the content of the given document may not be edited by the given user
+func (lm *LockManager) CheckEdit(user *User, documentId string) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+	if len(lm.locks) <= 0 {
+		return nil
+	}
+
+	path := lm.treeManager.GetItemPath(documentId, TypeDocument)
+	for _, l := range lm.locks {
+		if l.Owner != user.Name && l.Mode == LockModeExclusive && isWithinPath(path, l.path) {
+			return &LockedError{Lock: *l}
+		}
+	}
+	return nil
+}
+
+// HoldsExclusiveLock returns true if the given user holds an exclusive lock on the item at the given path
+// or on a section containing it, no other user can change the item in the meantime
+func (lm *LockManager) HoldsExclusiveLock(user *User, path string) bool {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.pruneLocked()
+
+	for _, l := range lm.locks {
+		if l.Owner == user.Name && l.Mode == LockModeExclusive && isWithinPath(path, l.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Relocate moves the locks on the item at the given path and on everything within it to the new path of the item
+func (lm *LockManager) Relocate(oldPath string, newPath string) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	var moved []*Lock
+	for id, l := range lm.locks {
+		if isWithinPath(l.path, oldPath) {
+			moved = append(moved, l)
+			delete(lm.locks, id)
+		}
+	}
+	for _, l := range moved {
+		l.path = newPath + strings.TrimPrefix(l.path, oldPath)
+		l.Path = lm.treeManager.RelativePath(l.path)
+		l.ItemId = lm.treeManager.generateId(l.path)
+		lm.locks[l.ItemId] = l
+	}
+}
+
+// RemoveLocks removes the locks on the item at the given path and on everything within it, e.g. after it has been deleted
+func (lm *LockManager) RemoveLocks(path string) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+
+	for id, l := range lm.locks {
+		if isWithinPath(l.path, path) {
+			delete(lm.locks, id)
+		}
+	}
+}
+
+// removes all locks whose lease has expired, must be called with the lock held
+func (lm *LockManager) pruneLocked() {
+	now := time.Now()
+	for id, l := range lm.locks {
+		if now.After(l.ExpiresAt) {
+			delete(lm.locks, id)
+		}
+	}
+}
+
+// returns true if the given path is the given parent path or lies within it
+func isWithinPath(path string, parentPath string) bool {
+	return path == parentPath || strings.HasPrefix(path, parentPath+string(filepath.Separator))
+}
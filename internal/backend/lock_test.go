@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockConflicts(t *testing.T) {
+	otherUser := &User{Name: "john", Roles: []string{RoleEditor}}
+
+	const (
+		acquire = "acquire"
+		change  = "change"
+		edit    = "edit"
+	)
+	tests := []struct {
+		name string
+		// item the other user holds a lock on, relative to the docs directory
+		locked string
+		mode   string
+		// operation of the test user on the given item
+		operation string
+		item      string
+		// the operation is done by the owner of the lock instead
+		owner    bool
+		rejected bool
+	}{
+		{name: "acquire locked document", locked: "a.md", mode: LockModeShared, operation: acquire, item: "a.md", rejected: true},
+		{name: "renew own lock", locked: "a.md", mode: LockModeShared, operation: acquire, item: "a.md", owner: true},
+		{name: "acquire other document", locked: "a.md", mode: LockModeExclusive, operation: acquire, item: "sub/b.md"},
+		{name: "acquire document within locked section", locked: "sub", mode: LockModeShared, operation: acquire, item: "sub/deep/c.md", rejected: true},
+		{name: "acquire section containing locked document", locked: "sub/deep/c.md", mode: LockModeShared, operation: acquire, item: "sub", rejected: true},
+		{name: "change shared locked document", locked: "a.md", mode: LockModeShared, operation: change, item: "a.md", rejected: true},
+		{name: "change own locked document", locked: "a.md", mode: LockModeExclusive, operation: change, item: "a.md", owner: true},
+		{name: "change document within locked section", locked: "sub", mode: LockModeShared, operation: change, item: "sub/b.md", rejected: true},
+		{name: "change section containing locked document", locked: "sub/deep/c.md", mode: LockModeShared, operation: change, item: "sub", rejected: true},
+		{name: "change document next to locked section", locked: "sub", mode: LockModeExclusive, operation: change, item: "subway.md"},
+		{name: "edit shared locked document", locked: "a.md", mode: LockModeShared, operation: edit, item: "a.md"},
+		{name: "edit exclusively locked document", locked: "a.md", mode: LockModeExclusive, operation: edit, item: "a.md", rejected: true},
+		{name: "edit own exclusively locked document", locked: "a.md", mode: LockModeExclusive, operation: edit, item: "a.md", owner: true},
+		{name: "edit document within exclusively locked section", locked: "sub", mode: LockModeExclusive, operation: edit, item: "sub/b.md", rejected: true},
+		{name: "edit document in nested section of exclusively locked section", locked: "sub", mode: LockModeExclusive, operation: edit, item: "sub/deep/c.md", rejected: true},
+		{name: "edit document within shared locked section", locked: "sub", mode: LockModeShared, operation: edit, item: "sub/deep/c.md"},
+		{name: "edit document in section containing exclusively locked section", locked: "sub/deep", mode: LockModeExclusive, operation: edit, item: "sub/b.md"},
+		{name: "edit document next to exclusively locked section", locked: "sub", mode: LockModeExclusive, operation: edit, item: "subway.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{
+				"a.md":          "# A\n",
+				"subway.md":     "# Subway\n",
+				"sub/b.md":      "# B\n",
+				"sub/deep/c.md": "# C\n",
+			})
+			lockedPath := filepath.Join(s.docsPath, tt.locked)
+			_, err := s.lockManager.Acquire(otherUser, TypeDocument, s.documentId(tt.locked), lockedPath, tt.mode, time.Minute, "review")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user := testEditor
+			if tt.owner {
+				user = otherUser
+			}
+			path := filepath.Join(s.docsPath, tt.item)
+			switch tt.operation {
+			case acquire:
+				_, err = s.lockManager.Acquire(user, TypeDocument, s.documentId(tt.item), path, LockModeShared, time.Minute, "")
+			case change:
+				err = s.lockManager.CheckChange(user, path)
+			case edit:
+				err = s.lockManager.CheckEdit(user, s.documentId(tt.item))
+			}
+
+			var lockedErr *LockedError
+			if errors.As(err, &lockedErr) != tt.rejected {
+				t.Fatalf("expected rejected = %v, got error %v", tt.rejected, err)
+			}
+			if tt.rejected && (lockedErr.Lock.Owner != otherUser.Name || lockedErr.Lock.Path != tt.locked) {
+				t.Fatalf("unexpected lock in error %+v", lockedErr.Lock)
+			}
+		})
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	otherUser := &User{Name: "john", Roles: []string{RoleEditor}}
+	const lease = 100 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// the lock is renewed by its owner after half of its lease
+		renewed bool
+		locked  bool
+	}{
+		{name: "expired", locked: false},
+		{name: "renewed", renewed: true, locked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": "# A\n"})
+			documentId := s.documentId("a.md")
+			path := filepath.Join(s.docsPath, "a.md")
+			acquired, err := s.lockManager.Acquire(otherUser, TypeDocument, documentId, path, LockModeExclusive, lease, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(lease / 2)
+			if tt.renewed {
+				renewed, err := s.lockManager.Acquire(otherUser, TypeDocument, documentId, path, LockModeExclusive, lease, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !renewed.AcquiredAt.Equal(acquired.AcquiredAt) || !renewed.ExpiresAt.After(acquired.ExpiresAt) {
+					t.Fatalf("unexpected renewed lock %+v of lock %+v", renewed, acquired)
+				}
+			}
+			time.Sleep(lease/2 + 10*time.Millisecond)
+
+			if (s.lockManager.CheckEdit(testEditor, documentId) != nil) != tt.locked {
+				t.Fatalf("expected locked = %v for editing", tt.locked)
+			}
+			if (s.lockManager.CheckChange(testEditor, path) != nil) != tt.locked {
+				t.Fatalf("expected locked = %v for changes", tt.locked)
+			}
+			if (len(s.lockManager.GetLocks()) > 0) != tt.locked {
+				t.Fatalf("expected locked = %v, got locks %+v", tt.locked, s.lockManager.GetLocks())
+			}
+		})
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	owner := &User{Name: "john", Roles: []string{RoleEditor}}
+	admin := &User{Name: "joe", Roles: []string{RoleAdmin}}
+
+	tests := []struct {
+		name     string
+		user     *User
+		released bool
+		err      error
+	}{
+		{name: "owner", user: owner, released: true},
+		{name: "other user", user: testEditor, err: errNotLockOwner},
+		{name: "admin", user: admin, released: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": "# A\n"})
+			documentId := s.documentId("a.md")
+			_, err := s.lockManager.Acquire(owner, TypeDocument, documentId, filepath.Join(s.docsPath, "a.md"), LockModeShared, time.Minute, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			released, err := s.lockManager.Release(tt.user, documentId)
+			if released != tt.released || !errors.Is(err, tt.err) {
+				t.Fatalf("expected released = %v and error %v, got %v and %v", tt.released, tt.err, released, err)
+			}
+			if (len(s.lockManager.GetLocks()) == 0) != tt.released {
+				t.Fatalf("unexpected locks %+v", s.lockManager.GetLocks())
+			}
+			if released, _ = s.lockManager.Release(owner, documentId); released == tt.released {
+				t.Fatalf("expected released = %v for the second release", !tt.released)
+			}
+		})
+	}
+}
+
+func TestParseLockRequest(t *testing.T) {
+	s := setupSync(t, nil)
+
+	tests := []struct {
+		name    string
+		request LockRequest
+		mode    string
+		lease   time.Duration
+		invalid bool
+	}{
+		{name: "defaults", request: LockRequest{}, mode: LockModeShared, lease: 5 * time.Minute},
+		{name: "exclusive", request: LockRequest{Mode: LockModeExclusive, Lease: "10m"}, mode: LockModeExclusive, lease: 10 * time.Minute},
+		{name: "lease longer than the maximum", request: LockRequest{Lease: "3h"}, mode: LockModeShared, lease: time.Hour},
+		{name: "unknown mode", request: LockRequest{Mode: "read"}, invalid: true},
+		{name: "invalid lease", request: LockRequest{Lease: "soon"}, invalid: true},
+		{name: "negative lease", request: LockRequest{Lease: "-1m"}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, lease, err := s.lockManager.ParseLockRequest(tt.request)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("expected invalid = %v, got error %v", tt.invalid, err)
+			}
+			if !tt.invalid && (mode != tt.mode || lease != tt.lease) {
+				t.Fatalf("expected mode %s and lease %v, got %s and %v", tt.mode, tt.lease, mode, lease)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	automerge "github.com/automerge/automerge-go"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net"
+	"time"
+)
+
+type (
+	// SubscriptionRequest subscribes a multiplexed connection to a document or ends the subscription
+	SubscriptionRequest struct {
+		Type       string `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		// sync protocol of the document channel, the configured default protocol if empty
+		Protocol string `json:"protocol" xml:"protocol" form:"protocol" query:"protocol"`
+		// ModeEdit (default), ModeView or ModeSuggest
+		Mode string `json:"mode" xml:"mode" form:"mode" query:"mode"`
+	}
+
+	// UnsubscribedMessage tells a multiplexed connection that the channel of a document has been closed,
+	// either because the client unsubscribed or because the server closed the channel
+	UnsubscribedMessage struct {
+		Type       string `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		// why the server closed the channel, empty if the client unsubscribed
+		Reason string `json:"reason" xml:"reason" form:"reason" query:"reason"`
+	}
+
+	// TreeEvent tells multiplexed connections that an item of the tree has been created, renamed or deleted
+	TreeEvent struct {
+		Type string `json:"type" xml:"type" form:"type" query:"type"`
+		// one of AuditActionCreate, AuditActionRename and AuditActionDelete
+		Action   string `json:"action" xml:"action" form:"action" query:"action"`
+		ItemType string `json:"itemType" xml:"itemType" form:"itemType" query:"itemType"`
+		ItemId   string `json:"itemId" xml:"itemId" form:"itemId" query:"itemId"`
+		Path     string `json:"path" xml:"path" form:"path" query:"path"`
+		// previous path of a renamed item
+		OldPath string `json:"oldPath,omitempty" xml:"oldPath,omitempty" form:"oldPath" query:"oldPath"`
+	}
+)
+
+// HandleMultiplexedConnection handles a websocket connection that is not bound to a single document,
+// the client subscribes to any number of documents and gets a separate channel for each of them,
+// all messages use the format of protocol version 2 and carry the id of their document
+func (wcm *WebsocketConnectionManager) HandleMultiplexedConnection(c echo.Context) (err error) {
+	if allowed, retryAfter := wcm.rateLimits.AllowWebsocketConnection(c); !allowed {
+		return tooManyRequests(c, retryAfter)
+	}
+
+	conn, err := wcm.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	conn.SetReadLimit(wcm.config.MaxMessageSize)
+
+	connection := &WebsocketClient{
+		conn:        conn,
+		Id:          randomToken(12),
+		Version:     ProtocolVersion2,
+		User:        getUser(c),
+		RemoteAddr:  c.RealIP(),
+		ConnectedAt: time.Now(),
+		send:        make(chan outboundMessage, wcm.config.SendQueueSize),
+		done:        make(chan struct{}),
+		channels:    make(map[string]*WebsocketClient),
+	}
+	connection.lastMessage.Store(connection.ConnectedAt.UnixNano())
+
+	wcm.lock.Lock()
+	wcm.connections[connection] = true
+	wcm.lock.Unlock()
+
+	// Make sure we Close the connection and all of its channels when the function returns
+	defer wcm.disconnectMultiplexedConnection(connection)
+
+	wcm.extendReadDeadline(connection)
+	conn.SetPongHandler(func(string) error {
+		wcm.extendReadDeadline(connection)
+		return nil
+	})
+	go wcm.writePump(connection)
+
+	err = wcm.sendSession(connection, false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		request, err := wcm.parseEnvelope(conn)
+		wcm.extendReadDeadline(connection)
+		connection.lastMessage.Store(time.Now().UnixNano())
+		connection.messagesReceived.Add(1)
+		var messageErr *messageError
+		if errors.As(err, &messageErr) {
+			// the connection is still usable, only this message is skipped
+			wcm.handleRequestError(connection, messageErr.requestId, messageErr.code, messageErr.err)
+			continue
+		}
+		if err != nil {
+			wcm.handleReadError(conn, err)
+			break
+		}
+
+		wcm.routeRequest(connection, request)
+	}
+
+	return nil
+}
+
+// passes a request of a multiplexed connection on to the channel of the document it refers to
+func (wcm *WebsocketConnectionManager) routeRequest(connection *WebsocketClient, request interface{}) {
+	if subscriptionRequest, ok := request.(SubscriptionRequest); ok {
+		var err error
+		if subscriptionRequest.Type == TypeSubscribe {
+			err = wcm.subscribe(connection, subscriptionRequest)
+		} else {
+			err = wcm.handleUnsubscribe(connection, subscriptionRequest)
+		}
+		if err != nil {
+			wcm.handleChannelError(connection, subscriptionRequest.DocumentId, subscriptionRequest.RequestId, err)
+		}
+		return
+	}
+
+	documentId, requestId := requestTarget(request)
+	wcm.lock.RLock()
+	channel := connection.channels[documentId]
+	wcm.lock.RUnlock()
+	if channel == nil {
+		wcm.handleChannelError(connection, documentId, requestId, errNotSubscribed(documentId))
+		return
+	}
+
+	channel.lastMessage.Store(time.Now().UnixNano())
+	channel.messagesReceived.Add(1)
+	wcm.handleRequest(channel, request)
+}
+
+// returns the document and the id of the given request
+func requestTarget(request interface{}) (documentId string, requestId string) {
+	switch request := request.(type) {
+	case EditRequest:
+		return request.DocumentId, request.RequestId
+	case SyncRequest:
+		return request.DocumentId, request.RequestId
+	case FlushRequest:
+		return request.DocumentId, request.RequestId
+	case PresenceRequest:
+		return request.DocumentId, request.RequestId
+	}
+	return "", ""
+}
+
+// returns the error for a request to a document the multiplexed connection is not subscribed to
+func errNotSubscribed(documentId string) error {
+	return &messageError{
+		code: ErrorCodeNotSubscribed,
+		err:  fmt.Errorf("the connection is not subscribed to document %s", documentId),
+	}
+}
+
+// opens a channel of the given multiplexed connection to the requested document,
+// the channel counts as a connection to the document and gets the same messages as a single document connection
+func (wcm *WebsocketConnectionManager) subscribe(connection *WebsocketClient, request SubscriptionRequest) error {
+	d := wcm.treeManager.GetDocument(request.DocumentId)
+	if d == nil {
+		return fmt.Errorf("document %s does not exist", request.DocumentId)
+	}
+
+	protocol := request.Protocol
+	if protocol == "" {
+		protocol = configuration.CurrentConfig.Sync.DefaultProtocol
+	}
+	if !isSupportedProtocol(protocol) {
+		return &messageError{code: ErrorCodeUnsupportedMessage, err: fmt.Errorf("unsupported sync protocol: %s", protocol)}
+	}
+	mode := request.Mode
+	if mode != "" && mode != ModeEdit && mode != ModeView && mode != ModeSuggest {
+		return &messageError{code: ErrorCodeUnsupportedMessage, err: fmt.Errorf("unsupported mode: %s", mode)}
+	}
+	mode = allowedMode(connection.User, mode)
+	if mode == ModeSuggest && protocol != ProtocolAutomerge {
+		return &messageError{code: ErrorCodeUnsupportedMessage, err: errors.New("suggestion mode requires the automerge protocol")}
+	}
+
+	channel := &WebsocketClient{
+		conn:        connection.conn,
+		connection:  connection,
+		Id:          randomToken(12),
+		Protocol:    protocol,
+		Version:     connection.Version,
+		ReadOnly:    mode == ModeView,
+		Suggesting:  mode == ModeSuggest,
+		User:        connection.User,
+		RemoteAddr:  connection.RemoteAddr,
+		ConnectedAt: time.Now(),
+		done:        make(chan struct{}),
+	}
+	channel.setDocumentId(request.DocumentId)
+	channel.lastMessage.Store(channel.ConnectedAt.UnixNano())
+	if protocol == ProtocolAutomerge && !channel.ReadOnly {
+		channel.ActorId = automerge.NewActorID()
+	}
+
+	wcm.lock.Lock()
+	if _, ok := connection.channels[request.DocumentId]; ok {
+		wcm.lock.Unlock()
+		return fmt.Errorf("the connection is already subscribed to document %s", request.DocumentId)
+	}
+	if reason := wcm.checkConnectionLimits(channel); reason != "" {
+		wcm.lock.Unlock()
+		return errors.New(reason)
+	}
+	if channel.ReadOnly {
+		wcm.viewersPerDocument[request.DocumentId] = wcm.viewersPerDocument[request.DocumentId] + 1
+	} else {
+		wcm.connectionsPerDocument[request.DocumentId] = wcm.connectionsPerDocument[request.DocumentId] + 1
+	}
+	wcm.clients[channel] = true
+	connection.channels[request.DocumentId] = channel
+	wcm.lock.Unlock()
+
+	err := wcm.sendSession(channel, false)
+	if err != nil {
+		return err
+	}
+	for _, onNewClient := range wcm.onNewClient {
+		err = onNewClient(channel, d)
+		if err != nil {
+			wcm.unsubscribe(channel, request.RequestId, "the subscription failed")
+			return err
+		}
+	}
+	return nil
+}
+
+// closes the channel of the given multiplexed connection to the document of the given request
+func (wcm *WebsocketConnectionManager) handleUnsubscribe(connection *WebsocketClient, request SubscriptionRequest) error {
+	wcm.lock.RLock()
+	channel := connection.channels[request.DocumentId]
+	wcm.lock.RUnlock()
+	if channel == nil {
+		return errNotSubscribed(request.DocumentId)
+	}
+
+	wcm.unsubscribe(channel, request.RequestId, "")
+	return nil
+}
+
+// closes the given document channel, notifies the listeners about the disconnected client
+// and tells the multiplexed connection about it
+func (wcm *WebsocketConnectionManager) unsubscribe(channel *WebsocketClient, requestId string, reason string) {
+	channel.closeOnce.Do(func() {
+		close(channel.done)
+	})
+
+	connection := channel.connection
+	wcm.lock.Lock()
+	if !wcm.clients[channel] {
+		// the channel has already been closed
+		wcm.lock.Unlock()
+		return
+	}
+	delete(wcm.clients, channel)
+	delete(connection.channels, channel.DocumentId())
+	wcm.lock.Unlock()
+
+	wcm.removeClient(channel)
+
+	err := wcm.writeJSON(connection, UnsubscribedMessage{
+		Type:       TypeUnsubscribed,
+		RequestId:  requestId,
+		DocumentId: channel.DocumentId(),
+		Reason:     reason,
+	})
+	if err != nil && !errors.Is(err, errClientDisconnected) {
+		log.Printf("%v: error writing UnsubscribedMessage to websocket client: %v", connection.RemoteAddr, err)
+	}
+}
+
+// logs a request of a multiplexed connection that could not be processed and tells the client about it
+func (wcm *WebsocketConnectionManager) handleChannelError(connection *WebsocketClient, documentId string, requestId string, err error) {
+	code := ErrorCodeRequestFailed
+	var messageErr *messageError
+	if errors.As(err, &messageErr) {
+		code = messageErr.code
+		err = messageErr.err
+	}
+	log.Printf("%v: error: %v", connection.RemoteAddr, err)
+
+	writeErr := wcm.writeJSON(connection, ErrorMessage{
+		Type:       TypeError,
+		RequestId:  requestId,
+		DocumentId: documentId,
+		Code:       code,
+		Message:    err.Error(),
+	})
+	if writeErr != nil {
+		log.Printf("%v: error writing ErrorMessage to websocket client: %v", connection.RemoteAddr, writeErr)
+	}
+}
+
+// disconnects a multiplexed connection and closes all of its channels, the session can not be resumed
+func (wcm *WebsocketConnectionManager) disconnectMultiplexedConnection(connection *WebsocketClient) {
+	connection.closeOnce.Do(func() {
+		close(connection.done)
+	})
+	// the connection may already have been closed with a reason
+	err := connection.conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("%v: error closing websocket connection: %v", connection.RemoteAddr, err)
+	}
+
+	wcm.lock.Lock()
+	delete(wcm.connections, connection)
+	channels := make([]*WebsocketClient, 0, len(connection.channels))
+	for _, channel := range connection.channels {
+		channels = append(channels, channel)
+	}
+	wcm.lock.Unlock()
+
+	for _, channel := range channels {
+		wcm.unsubscribe(channel, "", "")
+	}
+}
+
+// SendTreeEvent tells all multiplexed connections about a change of the tree
+func (wcm *WebsocketConnectionManager) SendTreeEvent(event TreeEvent) {
+	event.Type = TypeTreeEvent
+
+	wcm.lock.RLock()
+	connections := make([]*WebsocketClient, 0, len(wcm.connections))
+	for connection := range wcm.connections {
+		connections = append(connections, connection)
+	}
+	wcm.lock.RUnlock()
+
+	for _, connection := range connections {
+		err := wcm.writeJSON(connection, event)
+		if err != nil && !errors.Is(err, errClientDisconnected) {
+			log.Printf("%v: error writing TreeEvent to websocket client: %v", connection.RemoteAddr, err)
+		}
+	}
+}
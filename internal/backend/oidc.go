@@ -0,0 +1,237 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	// time a user has to complete the login at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+type (
+	// pendingLogin holds the state of an authorization code flow that has been started but not completed yet
+	pendingLogin struct {
+		codeVerifier string
+		nonce        string
+		redirect     string
+		expiresAt    time.Time
+	}
+)
+
+// OIDCAuthenticator implements the OpenID Connect authorization code flow (with PKCE) against the configured issuer
+type OIDCAuthenticator struct {
+	config         configuration.OIDCConfiguration
+	sessionManager *SessionManager
+	auditLog       *AuditLog
+
+	provider     *oidc.Provider
+	verifier     *oidc.IDTokenVerifier
+	oauth2Config oauth2.Config
+
+	lock mutexSync.Mutex
+	// pendingLogins state -> pending login
+	pendingLogins map[string]*pendingLogin
+}
+
+// NewOIDCAuthenticator discovers the configured issuer, returns nil if OpenID Connect is not configured
+func NewOIDCAuthenticator(sessionManager *SessionManager, auditLog *AuditLog) (*OIDCAuthenticator, error) {
+	var oidcConf = configuration.CurrentConfig.Server.OIDC
+	if !oidcConf.IsEnabled() {
+		return nil, nil
+	}
+
+	provider, err := oidc.NewProvider(context.Background(), oidcConf.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover OpenID Connect issuer %s: %w", oidcConf.Issuer, err)
+	}
+
+	return &OIDCAuthenticator{
+		config:         oidcConf,
+		sessionManager: sessionManager,
+		auditLog:       auditLog,
+		provider:       provider,
+		verifier:       provider.Verifier(&oidc.Config{ClientID: oidcConf.ClientId}),
+		oauth2Config: oauth2.Config{
+			ClientID:     oidcConf.ClientId,
+			ClientSecret: oidcConf.ClientSecret,
+			RedirectURL:  oidcConf.RedirectUrl,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       oidcConf.Scopes,
+		},
+		pendingLogins: make(map[string]*pendingLogin),
+	}, nil
+}
+
+// redirects the user to the identity provider to start a new login
+func (oa *OIDCAuthenticator) login(c echo.Context) error {
+	state := randomToken(16)
+	login := &pendingLogin{
+		codeVerifier: oauth2.GenerateVerifier(),
+		nonce:        randomToken(16),
+		redirect:     sanitizeRedirect(c.QueryParam("redirect")),
+		expiresAt:    time.Now().Add(oidcLoginTimeout),
+	}
+
+	oa.lock.Lock()
+	oa.removeExpiredLogins()
+	oa.pendingLogins[state] = login
+	oa.lock.Unlock()
+
+	authUrl := oa.oauth2Config.AuthCodeURL(
+		state,
+		oidc.Nonce(login.nonce),
+		oauth2.S256ChallengeOption(login.codeVerifier),
+	)
+	return c.Redirect(http.StatusFound, authUrl)
+}
+
+// completes a login after the identity provider redirected the user back to this server
+func (oa *OIDCAuthenticator) callback(c echo.Context) error {
+	if errorCode := c.QueryParam("error"); errorCode != "" {
+		log.Printf("OpenID Connect login failed: %s: %s", errorCode, c.QueryParam("error_description"))
+		return echo.NewHTTPError(http.StatusUnauthorized, "Login failed: "+errorCode)
+	}
+
+	login := oa.takePendingLogin(c.QueryParam("state"))
+	if login == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown or expired login state")
+	}
+
+	ctx := c.Request().Context()
+	token, err := oa.oauth2Config.Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(login.codeVerifier))
+	if err != nil {
+		log.Printf("Unable to exchange OpenID Connect authorization code: %v", err)
+		return echo.NewHTTPError(http.StatusUnauthorized, "Unable to exchange authorization code")
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Token response did not contain an ID token")
+	}
+
+	user, err := oa.verifyIdToken(ctx, rawIdToken, login.nonce)
+	if err != nil {
+		log.Printf("Unable to verify OpenID Connect ID token: %v", err)
+		oa.auditLog.Record(AuditEntry{
+			Action:     AuditActionLoginFailed,
+			RemoteAddr: c.RealIP(),
+		})
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+
+	oa.sessionManager.CreateSession(c, user)
+	oa.auditLog.Record(AuditEntry{
+		Action:     AuditActionLogin,
+		User:       user.Name,
+		RemoteAddr: c.RealIP(),
+	})
+	return c.Redirect(http.StatusFound, login.redirect)
+}
+
+// validates the given ID token and maps its claims to a user
+func (oa *OIDCAuthenticator) verifyIdToken(ctx context.Context, rawIdToken string, nonce string) (*User, error) {
+	idToken, err := oa.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[oa.config.UsernameClaim].(string)
+	if name == "" {
+		name = idToken.Subject
+	}
+
+	roles := oa.mapGroupsToRoles(claimAsStrings(claims[oa.config.GroupsClaim]))
+	if len(roles) <= 0 {
+		return nil, fmt.Errorf("user %s is not a member of any group that grants access", name)
+	}
+
+	return &User{
+		Name:  name,
+		Roles: roles,
+	}, nil
+}
+
+// maps the given identity provider groups to the roles of this server
+func (oa *OIDCAuthenticator) mapGroupsToRoles(groups []string) []string {
+	var roles []string
+	for _, mapping := range oa.config.Roles {
+		if slices.Contains(groups, mapping.Group) && !slices.Contains(roles, mapping.Role) {
+			roles = append(roles, mapping.Role)
+		}
+	}
+
+	if len(roles) <= 0 && oa.config.DefaultRole != "" {
+		roles = append(roles, oa.config.DefaultRole)
+	}
+	return roles
+}
+
+// returns and removes the pending login with the given state
+func (oa *OIDCAuthenticator) takePendingLogin(state string) *pendingLogin {
+	oa.lock.Lock()
+	defer oa.lock.Unlock()
+
+	login := oa.pendingLogins[state]
+	delete(oa.pendingLogins, state)
+	if login == nil || time.Now().After(login.expiresAt) {
+		return nil
+	}
+	return login
+}
+
+// removes all pending logins that have not been completed in time, must be called with the lock held
+func (oa *OIDCAuthenticator) removeExpiredLogins() {
+	now := time.Now()
+	for state, login := range oa.pendingLogins {
+		if now.After(login.expiresAt) {
+			delete(oa.pendingLogins, state)
+		}
+	}
+}
+
+// converts a claim that may either be a single string or a list of strings
+func claimAsStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var result []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// only allows local redirect targets to prevent open redirects
+func sanitizeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
@@ -0,0 +1,368 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	mutexSync "sync"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientId     = "mkdocsrest"
+	mockClientSecret = "secret"
+	mockRedirectUrl  = "http://localhost/auth/callback/"
+)
+
+// mockIssuer is a minimal OpenID Connect identity provider that authorizes every request of the configured user
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	username string
+	groups   []string
+
+	lock mutexSync.Mutex
+	// authorization code -> pending authorization
+	codes map[string]mockAuthorization
+	// number of token requests whose code verifier matched the code challenge
+	verifiedExchanges int
+}
+
+type mockAuthorization struct {
+	nonce         string
+	codeChallenge string
+}
+
+func newMockIssuer(t *testing.T, username string, groups []string) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mi := &mockIssuer{
+		t:        t,
+		key:      key,
+		username: username,
+		groups:   groups,
+		codes:    make(map[string]mockAuthorization),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", mi.discovery)
+	mux.HandleFunc("/keys", mi.keys)
+	mux.HandleFunc("/authorize", mi.authorize)
+	mux.HandleFunc("/token", mi.token)
+	mi.server = httptest.NewServer(mux)
+	t.Cleanup(mi.server.Close)
+	return mi
+}
+
+func (mi *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, map[string]interface{}{
+		"issuer":                                mi.server.URL,
+		"authorization_endpoint":                mi.server.URL + "/authorize",
+		"token_endpoint":                        mi.server.URL + "/token",
+		"jwks_uri":                              mi.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (mi *mockIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(mi.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(mi.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizes the user right away and redirects back to the client with an authorization code
+func (mi *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != mockClientId || query.Get("redirect_uri") != mockRedirectUrl {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "PKCE is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomToken(16)
+	mi.lock.Lock()
+	mi.codes[code] = mockAuthorization{
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	mi.lock.Unlock()
+
+	redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// exchanges an authorization code for an ID token, the code verifier has to match the code challenge
+func (mi *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != mockClientId || clientSecret != mockClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeTestJSON(w, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	mi.lock.Lock()
+	authorization, ok := mi.codes[r.PostForm.Get("code")]
+	delete(mi.codes, r.PostForm.Get("code"))
+	mi.lock.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	mi.lock.Lock()
+	mi.verifiedExchanges++
+	mi.lock.Unlock()
+
+	now := time.Now()
+	writeTestJSON(w, map[string]interface{}{
+		"access_token": randomToken(16),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token": mi.signToken(map[string]interface{}{
+			"iss":                mi.server.URL,
+			"sub":                "user-1",
+			"aud":                mockClientId,
+			"iat":                now.Unix(),
+			"exp":                now.Add(time.Hour).Unix(),
+			"nonce":              authorization.nonce,
+			"preferred_username": mi.username,
+			"groups":             mi.groups,
+		}),
+	})
+}
+
+// returns the given claims as JWT signed with RS256
+func (mi *mockIssuer) signToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, mi.key, crypto.SHA256, hash[:])
+	if err != nil {
+		mi.t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// configures OpenID Connect against the given issuer and creates the authenticators
+func setupOIDC(t *testing.T, issuer string) (*OIDCAuthenticator, *Authenticator, *SessionManager) {
+	previous := configuration.CurrentConfig
+	t.Cleanup(func() {
+		configuration.CurrentConfig = previous
+	})
+
+	configuration.CurrentConfig.Server.OIDC = configuration.OIDCConfiguration{
+		Issuer:        issuer,
+		ClientId:      mockClientId,
+		ClientSecret:  mockClientSecret,
+		RedirectUrl:   mockRedirectUrl,
+		Scopes:        []string{"openid", "profile"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		Roles: []configuration.OIDCRoleMapping{
+			{Group: "writers", Role: RoleEditor},
+		},
+	}
+	configuration.CurrentConfig.Server.Session = configuration.SessionConfiguration{
+		CookieName: "mkdocsrest_session",
+		MaxAge:     time.Hour,
+	}
+	configuration.CurrentConfig.Server.Audit.File = ""
+
+	sessionManager := NewSessionManager()
+	auditLog := NewAuditLog()
+	oidcAuthenticator, err := NewOIDCAuthenticator(sessionManager, auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oidcAuthenticator, NewAuthenticator(sessionManager, oidcAuthenticator, auditLog, nil), sessionManager
+}
+
+// runs the given handler for a request to the given target and returns the response
+func serveTestRequest(t *testing.T, handler echo.HandlerFunc, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	c := echo.New().NewContext(request, recorder)
+	if err := handler(c); err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatal(err)
+		}
+		recorder.Code = httpErr.Code
+	}
+	return recorder
+}
+
+// follows the redirect of the login endpoint to the issuer and returns the callback url the issuer redirected to
+func authorizeAtIssuer(t *testing.T, loginResponse *httptest.ResponseRecorder) *url.URL {
+	if loginResponse.Code != http.StatusFound {
+		t.Fatalf("login responded with %d, expected a redirect", loginResponse.Code)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Get(loginResponse.Header().Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("issuer rejected the authorization request with %d", response.StatusCode)
+	}
+
+	callbackUrl, err := url.Parse(response.Header.Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callbackUrl
+}
+
+func TestOIDCLoginCallbackAndLogout(t *testing.T) {
+	issuer := newMockIssuer(t, "jane", []string{"writers"})
+	oidcAuthenticator, authenticator, sessionManager := setupOIDC(t, issuer.server.URL)
+
+	loginResponse := serveTestRequest(t, oidcAuthenticator.login, EndpointPathLogin+"?redirect=/section/")
+	authUrl, _ := url.Parse(loginResponse.Header().Get(echo.HeaderLocation))
+	if !strings.HasPrefix(authUrl.String(), issuer.server.URL+"/authorize") {
+		t.Fatalf("login redirected to %s instead of the issuer", authUrl)
+	}
+	if authUrl.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("login did not use PKCE: %s", authUrl)
+	}
+
+	callbackUrl := authorizeAtIssuer(t, loginResponse)
+	callbackResponse := serveTestRequest(t, oidcAuthenticator.callback, EndpointPathCallback+"?"+callbackUrl.RawQuery)
+	if callbackResponse.Code != http.StatusFound || callbackResponse.Header().Get(echo.HeaderLocation) != "/section/" {
+		t.Fatalf("callback responded with %d to %q", callbackResponse.Code, callbackResponse.Header().Get(echo.HeaderLocation))
+	}
+	if issuer.verifiedExchanges != 1 {
+		t.Fatalf("expected one code exchange with a valid code verifier, got %d", issuer.verifiedExchanges)
+	}
+
+	cookies := callbackResponse.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	session := sessionManager.sessions[cookies[0].Value]
+	if session == nil || session.User.Name != "jane" || !session.User.HasRole(RoleEditor) || session.User.HasRole(RoleAdmin) {
+		t.Fatalf("unexpected session %+v", session)
+	}
+
+	// the state of a completed login can not be used again
+	replayResponse := serveTestRequest(t, oidcAuthenticator.callback, EndpointPathCallback+"?"+callbackUrl.RawQuery)
+	if replayResponse.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback responded with %d", replayResponse.Code)
+	}
+
+	logoutResponse := serveTestRequest(t, authenticator.logout, EndpointPathLogout, cookies[0])
+	if logoutResponse.Code != http.StatusOK {
+		t.Fatalf("logout responded with %d", logoutResponse.Code)
+	}
+	if len(sessionManager.sessions) != 0 {
+		t.Fatalf("session has not been destroyed by the logout")
+	}
+}
+
+func TestOIDCCallbackRequiresCodeVerifier(t *testing.T) {
+	issuer := newMockIssuer(t, "jane", []string{"writers"})
+	oidcAuthenticator, _, sessionManager := setupOIDC(t, issuer.server.URL)
+
+	loginResponse := serveTestRequest(t, oidcAuthenticator.login, EndpointPathLogin)
+	callbackUrl := authorizeAtIssuer(t, loginResponse)
+
+	// a different verifier does not match the challenge sent to the issuer
+	oidcAuthenticator.lock.Lock()
+	oidcAuthenticator.pendingLogins[callbackUrl.Query().Get("state")].codeVerifier = randomToken(32)
+	oidcAuthenticator.lock.Unlock()
+
+	callbackResponse := serveTestRequest(t, oidcAuthenticator.callback, EndpointPathCallback+"?"+callbackUrl.RawQuery)
+	if callbackResponse.Code != http.StatusUnauthorized {
+		t.Fatalf("callback with a wrong code verifier responded with %d", callbackResponse.Code)
+	}
+	if len(sessionManager.sessions) != 0 {
+		t.Fatalf("a session has been created without a valid code verifier")
+	}
+}
+
+func TestOIDCCallbackRejectsUsersWithoutRole(t *testing.T) {
+	issuer := newMockIssuer(t, "john", []string{"guests"})
+	oidcAuthenticator, _, sessionManager := setupOIDC(t, issuer.server.URL)
+
+	loginResponse := serveTestRequest(t, oidcAuthenticator.login, EndpointPathLogin)
+	callbackUrl := authorizeAtIssuer(t, loginResponse)
+
+	callbackResponse := serveTestRequest(t, oidcAuthenticator.callback, EndpointPathCallback+"?"+callbackUrl.RawQuery)
+	if callbackResponse.Code != http.StatusUnauthorized {
+		t.Fatalf("callback for a user without a role responded with %d", callbackResponse.Code)
+	}
+	if len(sessionManager.sessions) != 0 {
+		t.Fatalf("a session has been created for a user without a role")
+	}
+}
+
+func TestOIDCDiscoveryFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	previous := configuration.CurrentConfig
+	defer func() {
+		configuration.CurrentConfig = previous
+	}()
+	configuration.CurrentConfig.Server.OIDC = configuration.OIDCConfiguration{
+		Issuer:      server.URL,
+		ClientId:    mockClientId,
+		RedirectUrl: mockRedirectUrl,
+	}
+
+	oidcAuthenticator, err := NewOIDCAuthenticator(NewSessionManager(), NewAuditLog())
+	if err == nil || oidcAuthenticator != nil {
+		t.Fatalf("expected a discovery error, got %v", err)
+	}
+}
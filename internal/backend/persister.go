@@ -0,0 +1,288 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"log"
+	"os"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	// a document that is changed continuously is written at the latest after this many write delays
+	maxWriteDelayFactor = 5
+
+	// PersistenceStateDirty the document has changes that have not been written yet
+	PersistenceStateDirty = "dirty"
+	// PersistenceStateSaving the document is being written
+	PersistenceStateSaving = "saving"
+	// PersistenceStateSaved all changes of the document have been written
+	PersistenceStateSaved = "saved"
+	// PersistenceStateFailed the document could not be written
+	PersistenceStateFailed = "failed"
+)
+
+type (
+	pendingWrite struct {
+		// author of the latest change
+		client *WebsocketClient
+		// time of the first change that has not been written yet
+		since time.Time
+		timer *time.Timer
+	}
+
+	// PersistenceState tells clients whether the changes of a document have been written to disk
+	PersistenceState struct {
+		Type       string `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		State      string `json:"state" xml:"state" form:"state" query:"state"`
+		// modification time of the file, if saved
+		ModTime *time.Time `json:"modtime,omitempty" xml:"modtime,omitempty" form:"modtime" query:"modtime"`
+		// hex encoded SHA-256 hash of the file content, if saved
+		Hash string `json:"hash,omitempty" xml:"hash,omitempty" form:"hash" query:"hash"`
+		// reason of the failure, if failed
+		Reason string `json:"reason,omitempty" xml:"reason,omitempty" form:"reason" query:"reason"`
+	}
+)
+
+// DocumentPersister writes changed documents to disk after a delay, so rapid edits are coalesced into a single write
+type DocumentPersister struct {
+	treeManager *TreeManager
+	auditLog    *AuditLog
+	delay       time.Duration
+
+	lock mutexSync.Mutex
+	// pending document id -> write that has not happened yet
+	pending map[string]*pendingWrite
+
+	// only one document is written at a time
+	writeLock mutexSync.Mutex
+
+	getContent     func(documentId string) (string, error)
+	onBeforeWrite  func(documentId string, content string)
+	onStateChanged func(state PersistenceState, requester *WebsocketClient)
+}
+
+func NewDocumentPersister(treeManager *TreeManager, auditLog *AuditLog) *DocumentPersister {
+	return &DocumentPersister{
+		treeManager: treeManager,
+		auditLog:    auditLog,
+		delay:       configuration.CurrentConfig.Sync.WriteDelay,
+		pending:     make(map[string]*pendingWrite),
+		getContent: func(documentId string) (string, error) {
+			content, ok := treeManager.GetDocumentContent(documentId)
+			if !ok {
+				return "", fmt.Errorf("document %s does not exist", documentId)
+			}
+			return content, nil
+		},
+	}
+}
+
+// Schedule writes the given document after the write delay, the given client is recorded as the author of the change
+func (dp *DocumentPersister) Schedule(client *WebsocketClient, documentId string) {
+	dp.lock.Lock()
+	if p, ok := dp.pending[documentId]; ok {
+		p.client = client
+		if time.Since(p.since) < maxWriteDelayFactor*dp.delay {
+			p.timer.Reset(dp.delay)
+		}
+		dp.lock.Unlock()
+		return
+	}
+
+	dp.pending[documentId] = &pendingWrite{
+		client: client,
+		since:  time.Now(),
+		timer: time.AfterFunc(dp.delay, func() {
+			dp.Flush(documentId)
+		}),
+	}
+	dp.lock.Unlock()
+
+	dp.notifyStateChanged(PersistenceState{DocumentId: documentId, State: PersistenceStateDirty}, nil)
+}
+
+// Flush writes the given document right away if it has pending changes,
+// returns the persistence state of the document afterwards
+func (dp *DocumentPersister) Flush(documentId string) PersistenceState {
+	return dp.FlushFor(nil, documentId)
+}
+
+// FlushFor is the same as Flush on request of the given client, which is sent the resulting state
+// along with the response to its request and is therefore not notified about it
+func (dp *DocumentPersister) FlushFor(requester *WebsocketClient, documentId string) PersistenceState {
+	dp.lock.Lock()
+	p, ok := dp.pending[documentId]
+	if !ok {
+		dp.lock.Unlock()
+		return dp.currentState(documentId)
+	}
+	p.timer.Stop()
+	delete(dp.pending, documentId)
+	dp.lock.Unlock()
+
+	return dp.write(p.client, documentId, requester)
+}
+
+// FlushAll writes all documents with pending changes right away
+func (dp *DocumentPersister) FlushAll() {
+	dp.lock.Lock()
+	documentIds := make([]string, 0, len(dp.pending))
+	for documentId := range dp.pending {
+		documentIds = append(documentIds, documentId)
+	}
+	dp.lock.Unlock()
+
+	for _, documentId := range documentIds {
+		dp.Flush(documentId)
+	}
+}
+
+// Relocate moves the pending write of a document to its new id, e.g. after the document has been renamed
+func (dp *DocumentPersister) Relocate(oldId string, newId string) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	p, ok := dp.pending[oldId]
+	if !ok {
+		return
+	}
+	p.timer.Stop()
+	delete(dp.pending, oldId)
+	p.timer = time.AfterFunc(dp.delay, func() {
+		dp.Flush(newId)
+	})
+	dp.pending[newId] = p
+}
+
+// WithoutWrites runs the given function while no document is being written
+func (dp *DocumentPersister) WithoutWrites(f func()) {
+	dp.writeLock.Lock()
+	defer dp.writeLock.Unlock()
+	f()
+}
+
+// returns the persistence state of a document without pending changes, based on its file
+func (dp *DocumentPersister) currentState(documentId string) PersistenceState {
+	// wait for a write that may be in progress
+	dp.writeLock.Lock()
+	defer dp.writeLock.Unlock()
+
+	d := dp.treeManager.GetDocument(documentId)
+	if d == nil {
+		return PersistenceState{DocumentId: documentId, State: PersistenceStateFailed, Reason: "document does not exist"}
+	}
+	content, err := os.ReadFile(d.Path)
+	if err != nil {
+		return PersistenceState{DocumentId: documentId, State: PersistenceStateFailed, Reason: err.Error()}
+	}
+	return dp.savedState(documentId, d.Path, content)
+}
+
+// returns the state of a document whose file has been written with the given content
+func (dp *DocumentPersister) savedState(documentId string, path string, content []byte) PersistenceState {
+	state := PersistenceState{
+		DocumentId: documentId,
+		State:      PersistenceStateSaved,
+		Hash:       hashContent(content),
+	}
+	if fileInfo, err := os.Stat(path); err == nil {
+		modTime := fileInfo.ModTime()
+		state.ModTime = &modTime
+	}
+	return state
+}
+
+// writes the current content of the given document to disk, returns the resulting persistence state,
+// which is not sent to the requester of the write
+func (dp *DocumentPersister) write(client *WebsocketClient, documentId string, requester *WebsocketClient) PersistenceState {
+	dp.writeLock.Lock()
+	defer dp.writeLock.Unlock()
+
+	log.Printf("Synchronizing document '%s' to disk", documentId)
+
+	d := dp.treeManager.GetDocument(documentId)
+	if d == nil {
+		log.Printf("Unable to write document content for document %s: Document was nil", documentId)
+		return PersistenceState{DocumentId: documentId, State: PersistenceStateFailed, Reason: "document does not exist"}
+	}
+
+	dp.notifyStateChanged(PersistenceState{DocumentId: documentId, State: PersistenceStateSaving}, nil)
+
+	content, err := dp.getContent(documentId)
+	if err != nil {
+		log.Printf("Unable to get document content for document %s: %v", documentId, err)
+		return dp.failed(documentId, err, requester)
+	}
+
+	var previousSize int64
+	if fileInfo, err := os.Stat(d.Path); err == nil {
+		previousSize = fileInfo.Size()
+	}
+
+	if dp.onBeforeWrite != nil {
+		dp.onBeforeWrite(documentId, content)
+	}
+	err = WriteFile(d.Path, []byte(content))
+	if err != nil {
+		log.Printf("Unable to write modified document content for document %s: %v", documentId, err)
+		return dp.failed(documentId, err, requester)
+	}
+
+	dp.auditLog.Record(newDocumentSaveAuditEntry(
+		client,
+		documentId,
+		dp.treeManager.RelativePath(d.Path),
+		int64(len(content))-previousSize,
+	))
+
+	log.Printf("Document '%s' synchronized to disk successfully", documentId)
+
+	state := dp.savedState(documentId, d.Path, []byte(content))
+	dp.notifyStateChanged(state, requester)
+	return state
+}
+
+// reports that the given document could not be written
+func (dp *DocumentPersister) failed(documentId string, err error, requester *WebsocketClient) PersistenceState {
+	state := PersistenceState{
+		DocumentId: documentId,
+		State:      PersistenceStateFailed,
+		Reason:     err.Error(),
+	}
+	dp.notifyStateChanged(state, requester)
+	return state
+}
+
+func (dp *DocumentPersister) notifyStateChanged(state PersistenceState, requester *WebsocketClient) {
+	if dp.onStateChanged != nil {
+		dp.onStateChanged(state, requester)
+	}
+}
+
+// returns the hex encoded SHA-256 hash of the given content
+func hashContent(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// SetContentProvider sets the function used to get the content that is written for a document
+func (dp *DocumentPersister) SetContentProvider(f func(documentId string) (string, error)) {
+	dp.getContent = f
+}
+
+// SetOnBeforeWriteListener sets the listener that is called right before the content of a document is written
+func (dp *DocumentPersister) SetOnBeforeWriteListener(f func(documentId string, content string)) {
+	dp.onBeforeWrite = f
+}
+
+// SetOnStateChangedListener sets the listener that is notified whenever the persistence state of a document changes,
+// along with the client that requested the change, if any, which is sent the state separately
+func (dp *DocumentPersister) SetOnStateChangedListener(f func(state PersistenceState, requester *WebsocketClient)) {
+	dp.onStateChanged = f
+}
@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"log"
+	"sort"
+	mutexSync "sync"
+	"time"
+)
+
+type (
+	// TextAnchor is a position in the text of a document, relative to the automerge heads
+	// of the document version it refers to, so it can be moved along with concurrent edits
+	TextAnchor struct {
+		// hex encoded change hashes of the document version the index refers to
+		Heads []string `json:"heads" xml:"heads" form:"heads" query:"heads"`
+		// position in the text, counted in unicode code points
+		Index int `json:"index" xml:"index" form:"index" query:"index"`
+	}
+
+	TextSelection struct {
+		Anchor TextAnchor `json:"anchor" xml:"anchor" form:"anchor" query:"anchor"`
+		Head   TextAnchor `json:"head" xml:"head" form:"head" query:"head"`
+	}
+
+	PresenceRequest struct {
+		Type       string         `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId  string         `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId string         `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		ClientId   string         `json:"clientId" xml:"clientId" form:"clientId" query:"clientId"`
+		User       string         `json:"user" xml:"user" form:"user" query:"user"`
+		Color      string         `json:"color" xml:"color" form:"color" query:"color"`
+		Cursor     *TextAnchor    `json:"cursor,omitempty" xml:"cursor,omitempty" form:"cursor" query:"cursor"`
+		Selection  *TextSelection `json:"selection,omitempty" xml:"selection,omitempty" form:"selection" query:"selection"`
+	}
+
+	// Presence is the last known cursor position and selection of a single client
+	Presence struct {
+		ClientId   string         `json:"clientId" xml:"clientId" form:"clientId" query:"clientId"`
+		DocumentId string         `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		User       string         `json:"user" xml:"user" form:"user" query:"user"`
+		Color      string         `json:"color" xml:"color" form:"color" query:"color"`
+		Cursor     *TextAnchor    `json:"cursor,omitempty" xml:"cursor,omitempty" form:"cursor" query:"cursor"`
+		Selection  *TextSelection `json:"selection,omitempty" xml:"selection,omitempty" form:"selection" query:"selection"`
+		LastActive time.Time      `json:"lastActive" xml:"lastActive" form:"lastActive" query:"lastActive"`
+	}
+)
+
+// ToRequest creates the message that is relayed to the other clients of the document
+func (p Presence) ToRequest(messageType string) PresenceRequest {
+	return PresenceRequest{
+		Type:       messageType,
+		RequestId:  "",
+		DocumentId: p.DocumentId,
+		ClientId:   p.ClientId,
+		User:       p.User,
+		Color:      p.Color,
+		Cursor:     p.Cursor,
+		Selection:  p.Selection,
+	}
+}
+
+// PresenceManager keeps track of the cursors and selections of all clients
+type PresenceManager struct {
+	timeout time.Duration
+
+	lock mutexSync.Mutex
+	// entries client -> last presence update of the client
+	entries map[*WebsocketClient]*Presence
+
+	resolveAnchor func(documentId string, anchor TextAnchor) (TextAnchor, error)
+	onExpired     func(client *WebsocketClient, presence Presence)
+}
+
+func NewPresenceManager() *PresenceManager {
+	pm := &PresenceManager{
+		timeout: configuration.CurrentConfig.Sync.PresenceTimeout,
+		entries: make(map[*WebsocketClient]*Presence),
+	}
+
+	go pm.expirePeriodically()
+
+	return pm
+}
+
+// Update stores the presence sent by the given client, the user is always taken from the client connection
+func (pm *PresenceManager) Update(client *WebsocketClient, request PresenceRequest) Presence {
+	presence := Presence{
+		ClientId:   client.Id,
+		DocumentId: client.DocumentId(),
+		User:       client.User.Name,
+		Color:      request.Color,
+		Cursor:     pm.resolve(client.DocumentId(), request.Cursor),
+		Selection:  pm.resolveSelection(client.DocumentId(), request.Selection),
+		LastActive: time.Now(),
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.entries[client] = &presence
+	return presence
+}
+
+// Remove forgets the presence of the given client, returns false if it had none
+func (pm *PresenceManager) Remove(client *WebsocketClient) (Presence, bool) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	presence, ok := pm.entries[client]
+	if !ok {
+		return Presence{}, false
+	}
+	delete(pm.entries, client)
+	return *presence, true
+}
+
+// Replace moves the presence of the previous connection of a client to its new connection
+func (pm *PresenceManager) Replace(previous *WebsocketClient, client *WebsocketClient) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if presence, ok := pm.entries[previous]; ok {
+		delete(pm.entries, previous)
+		pm.entries[client] = presence
+	}
+}
+
+// RelocatePresence moves the presence of all clients of a document to its new id, e.g. after the document has been renamed
+func (pm *PresenceManager) RelocatePresence(oldId string, newId string) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for _, presence := range pm.entries {
+		if presence.DocumentId == oldId {
+			presence.DocumentId = newId
+		}
+	}
+}
+
+// GetPresence returns the presence of all active clients of the given document,
+// with all positions moved to the current version of the document
+func (pm *PresenceManager) GetPresence(documentId string) []Presence {
+	pm.lock.Lock()
+	var result []Presence
+	for _, presence := range pm.entries {
+		if presence.DocumentId == documentId {
+			result = append(result, *presence)
+		}
+	}
+	pm.lock.Unlock()
+
+	for i := range result {
+		result[i].Cursor = pm.resolve(documentId, result[i].Cursor)
+		result[i].Selection = pm.resolveSelection(documentId, result[i].Selection)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastActive.After(result[j].LastActive)
+	})
+	return result
+}
+
+// moves the given anchor to the current version of the document, if a resolver is set
+func (pm *PresenceManager) resolve(documentId string, anchor *TextAnchor) *TextAnchor {
+	if anchor == nil || pm.resolveAnchor == nil {
+		return anchor
+	}
+	resolved, err := pm.resolveAnchor(documentId, *anchor)
+	if err != nil {
+		log.Printf("Unable to resolve text anchor in document %s: %v", documentId, err)
+		return anchor
+	}
+	return &resolved
+}
+
+func (pm *PresenceManager) resolveSelection(documentId string, selection *TextSelection) *TextSelection {
+	if selection == nil {
+		return nil
+	}
+	return &TextSelection{
+		Anchor: *pm.resolve(documentId, &selection.Anchor),
+		Head:   *pm.resolve(documentId, &selection.Head),
+	}
+}
+
+// removes the presence of clients that have not sent an update within the timeout
+func (pm *PresenceManager) expirePeriodically() {
+	ticker := time.NewTicker(max(pm.timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired := make(map[*WebsocketClient]Presence)
+
+		pm.lock.Lock()
+		for client, presence := range pm.entries {
+			if time.Since(presence.LastActive) > pm.timeout {
+				expired[client] = *presence
+				delete(pm.entries, client)
+			}
+		}
+		pm.lock.Unlock()
+
+		if pm.onExpired == nil {
+			continue
+		}
+		for client, presence := range expired {
+			pm.onExpired(client, presence)
+		}
+	}
+}
+
+// SetAnchorResolver sets the function used to move text anchors to the current version of a document
+func (pm *PresenceManager) SetAnchorResolver(f func(documentId string, anchor TextAnchor) (TextAnchor, error)) {
+	pm.resolveAnchor = f
+}
+
+func (pm *PresenceManager) SetOnPresenceExpiredListener(f func(client *WebsocketClient, presence Presence)) {
+	pm.onExpired = f
+}
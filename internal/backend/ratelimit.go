@@ -0,0 +1,266 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	// entries that have not been used for this long are removed from the limiters
+	rateLimiterEntryTimeout = 30 * time.Minute
+)
+
+type (
+	rateLimiterEntry struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+	}
+
+	authFailureEntry struct {
+		failures    []time.Time
+		lockedUntil time.Time
+	}
+)
+
+// KeyedRateLimiter limits the rate of events per key using a token bucket for each key
+type KeyedRateLimiter struct {
+	lock      mutexSync.Mutex
+	limit     rate.Limit
+	burst     int
+	entries   map[string]*rateLimiterEntry
+	lastPrune time.Time
+}
+
+// NewKeyedRateLimiter creates a rate limiter allowing the given number of events per second, a negative rate disables it
+func NewKeyedRateLimiter(perSecond float64, burst int) *KeyedRateLimiter {
+	if perSecond < 0 {
+		return nil
+	}
+	return &KeyedRateLimiter{
+		limit:     rate.Limit(perSecond),
+		burst:     burst,
+		entries:   make(map[string]*rateLimiterEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes a token for the given key if one is available, otherwise returns the time until the next one is
+func (rl *KeyedRateLimiter) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	entry := rl.entries[key]
+	if entry == nil {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.entries[key] = entry
+	}
+	entry.lastSeen = now
+
+	reservation := entry.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// removes entries that have not been used for a while, must be called with the lock held
+func (rl *KeyedRateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < rateLimiterEntryTimeout {
+		return
+	}
+	rl.lastPrune = now
+	for key, entry := range rl.entries {
+		if now.Sub(entry.lastSeen) > rateLimiterEntryTimeout {
+			delete(rl.entries, key)
+		}
+	}
+}
+
+// AuthFailureLimiter locks out keys after too many failed login attempts within a time window
+type AuthFailureLimiter struct {
+	lock        mutexSync.Mutex
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	entries     map[string]*authFailureEntry
+}
+
+func NewAuthFailureLimiter(config configuration.AuthFailureLimitConfiguration) *AuthFailureLimiter {
+	if config.MaxFailures < 0 {
+		return nil
+	}
+	return &AuthFailureLimiter{
+		maxFailures: config.MaxFailures,
+		window:      config.Window,
+		lockout:     config.Lockout,
+		entries:     make(map[string]*authFailureEntry),
+	}
+}
+
+// LockedFor returns the remaining lockout time of the given key, or 0 if it is not locked
+func (al *AuthFailureLimiter) LockedFor(key string) time.Duration {
+	if al == nil {
+		return 0
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	entry := al.entries[key]
+	if entry == nil {
+		return 0
+	}
+	return max(time.Until(entry.lockedUntil), 0)
+}
+
+// RecordFailure records a failed login attempt for the given key and locks it if there were too many
+func (al *AuthFailureLimiter) RecordFailure(key string) {
+	if al == nil {
+		return
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	now := time.Now()
+	al.prune(now)
+
+	entry := al.entries[key]
+	if entry == nil {
+		entry = &authFailureEntry{}
+		al.entries[key] = entry
+	}
+
+	// only keep failures within the window
+	failures := entry.failures[:0]
+	for _, failure := range entry.failures {
+		if now.Sub(failure) < al.window {
+			failures = append(failures, failure)
+		}
+	}
+	entry.failures = append(failures, now)
+
+	if len(entry.failures) >= al.maxFailures {
+		entry.lockedUntil = now.Add(al.lockout)
+		entry.failures = nil
+	}
+}
+
+// Reset forgets all failed login attempts of the given key
+func (al *AuthFailureLimiter) Reset(key string) {
+	if al == nil {
+		return
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if entry := al.entries[key]; entry != nil && time.Now().After(entry.lockedUntil) {
+		delete(al.entries, key)
+	}
+}
+
+// removes entries without recent failures or active lockouts, must be called with the lock held
+func (al *AuthFailureLimiter) prune(now time.Time) {
+	for key, entry := range al.entries {
+		lastFailureExpired := len(entry.failures) <= 0 || now.Sub(entry.failures[len(entry.failures)-1]) >= al.window
+		if lastFailureExpired && now.After(entry.lockedUntil) {
+			delete(al.entries, key)
+		}
+	}
+}
+
+// RateLimits bundles all rate limiters of the server
+type RateLimits struct {
+	AuthFailures *AuthFailureLimiter
+
+	MutationsPerIp   *KeyedRateLimiter
+	MutationsPerUser *KeyedRateLimiter
+
+	WebsocketConnectionsPerIp   *KeyedRateLimiter
+	WebsocketConnectionsPerUser *KeyedRateLimiter
+
+	SyncMessagesPerIp   *KeyedRateLimiter
+	SyncMessagesPerUser *KeyedRateLimiter
+}
+
+func NewRateLimits() *RateLimits {
+	var conf = configuration.CurrentConfig.Server.RateLimit
+	return &RateLimits{
+		AuthFailures: NewAuthFailureLimiter(conf.AuthFailures),
+
+		MutationsPerIp:   NewKeyedRateLimiter(conf.Mutations.PerIp, conf.Mutations.Burst),
+		MutationsPerUser: NewKeyedRateLimiter(conf.Mutations.PerUser, conf.Mutations.Burst),
+
+		WebsocketConnectionsPerIp:   NewKeyedRateLimiter(conf.WebsocketConnections.PerIp, conf.WebsocketConnections.Burst),
+		WebsocketConnectionsPerUser: NewKeyedRateLimiter(conf.WebsocketConnections.PerUser, conf.WebsocketConnections.Burst),
+
+		SyncMessagesPerIp:   NewKeyedRateLimiter(conf.SyncMessages.PerIp, conf.SyncMessages.Burst),
+		SyncMessagesPerUser: NewKeyedRateLimiter(conf.SyncMessages.PerUser, conf.SyncMessages.Burst),
+	}
+}
+
+// allows an event only if both the limiter for the remote address and the one for the user allow it
+func allowForIpAndUser(perIp *KeyedRateLimiter, perUser *KeyedRateLimiter, c echo.Context) (allowed bool, retryAfter time.Duration) {
+	allowed, retryAfter = perIp.Allow(c.RealIP())
+	if !allowed {
+		return false, retryAfter
+	}
+	return perUser.Allow(getUser(c).Name)
+}
+
+// MutationMiddleware returns an echo middleware that limits the rate of requests changing data
+func (r *RateLimits) MutationMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+
+			if allowed, retryAfter := allowForIpAndUser(r.MutationsPerIp, r.MutationsPerUser, c); !allowed {
+				return tooManyRequests(c, retryAfter)
+			}
+			return next(c)
+		}
+	}
+}
+
+// AllowWebsocketConnection checks if the client of the given request may open another websocket connection
+func (r *RateLimits) AllowWebsocketConnection(c echo.Context) (allowed bool, retryAfter time.Duration) {
+	return allowForIpAndUser(r.WebsocketConnectionsPerIp, r.WebsocketConnectionsPerUser, c)
+}
+
+// AllowSyncMessage checks if the given client may send another sync message
+func (r *RateLimits) AllowSyncMessage(client *WebsocketClient) (allowed bool, retryAfter time.Duration) {
+	allowed, retryAfter = r.SyncMessagesPerIp.Allow(client.RemoteAddr)
+	if !allowed {
+		return false, retryAfter
+	}
+	return r.SyncMessagesPerUser.Allow(client.User.Name)
+}
+
+// responds with a "429 Too Many Requests" error including a "Retry-After" header
+func tooManyRequests(c echo.Context, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(max(seconds, 1)))
+	return c.JSONPretty(http.StatusTooManyRequests, &ErrorResult{
+		Name:    "Too Many Requests",
+		Message: fmt.Sprintf("Rate limit exceeded, retry after %d seconds", max(seconds, 1)),
+	}, indentationChar)
+}
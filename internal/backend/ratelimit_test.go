@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"testing"
+	"time"
+)
+
+func TestKeyedRateLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     int
+		keys      []string
+		// expected result of Allow for each key
+		allowed []bool
+	}{
+		{
+			name:      "burst",
+			perSecond: 1,
+			burst:     2,
+			keys:      []string{"a", "a", "a"},
+			allowed:   []bool{true, true, false},
+		},
+		{
+			name:      "separate keys",
+			perSecond: 1,
+			burst:     1,
+			keys:      []string{"a", "b", "a", "b"},
+			allowed:   []bool{true, true, false, false},
+		},
+		{
+			name:      "rejected events do not take tokens",
+			perSecond: 1,
+			burst:     1,
+			keys:      []string{"a", "a", "a", "a"},
+			allowed:   []bool{true, false, false, false},
+		},
+		{
+			name:      "disabled",
+			perSecond: -1,
+			burst:     1,
+			keys:      []string{"a", "a", "a"},
+			allowed:   []bool{true, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := NewKeyedRateLimiter(tt.perSecond, tt.burst)
+			// key -> retry after of its last rejected event
+			lastRetryAfter := make(map[string]time.Duration)
+			for i, key := range tt.keys {
+				allowed, retryAfter := rl.Allow(key)
+				if allowed != tt.allowed[i] {
+					t.Fatalf("event %d of key %s: expected allowed = %v", i, key, tt.allowed[i])
+				}
+				if allowed {
+					continue
+				}
+				if retryAfter <= 0 || retryAfter > time.Second {
+					t.Fatalf("event %d of key %s: unexpected retry after %v", i, key, retryAfter)
+				}
+				// a rejected event must not push the next token further away
+				if lastRetryAfter[key] > 0 && retryAfter > lastRetryAfter[key] {
+					t.Fatalf("event %d of key %s: retry after grew from %v to %v", i, key, lastRetryAfter[key], retryAfter)
+				}
+				lastRetryAfter[key] = retryAfter
+			}
+		})
+	}
+}
+
+func TestKeyedRateLimiterRefills(t *testing.T) {
+	rl := NewKeyedRateLimiter(20, 1)
+	if allowed, _ := rl.Allow("a"); !allowed {
+		t.Fatalf("first event has been rejected")
+	}
+	allowed, retryAfter := rl.Allow("a")
+	if allowed {
+		t.Fatalf("second event has been allowed right away")
+	}
+	time.Sleep(retryAfter)
+	if allowed, _ = rl.Allow("a"); !allowed {
+		t.Fatalf("event has been rejected after waiting for %v", retryAfter)
+	}
+}
+
+func TestAllowSyncMessage(t *testing.T) {
+	rateLimits := &RateLimits{
+		SyncMessagesPerIp:   NewKeyedRateLimiter(1, 2),
+		SyncMessagesPerUser: NewKeyedRateLimiter(1, 3),
+	}
+	jane := &User{Name: "jane"}
+	john := &User{Name: "john"}
+
+	tests := []struct {
+		client  *WebsocketClient
+		allowed bool
+	}{
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.1", User: jane}, allowed: true},
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.1", User: jane}, allowed: true},
+		// limited by the address
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.1", User: john}, allowed: false},
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.2", User: jane}, allowed: true},
+		// limited by the user
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.3", User: jane}, allowed: false},
+		{client: &WebsocketClient{RemoteAddr: "10.0.0.3", User: john}, allowed: true},
+	}
+	for i, tt := range tests {
+		allowed, retryAfter := rateLimits.AllowSyncMessage(tt.client)
+		if allowed != tt.allowed {
+			t.Fatalf("message %d from %s of %s: expected allowed = %v", i, tt.client.RemoteAddr, tt.client.User.Name, tt.allowed)
+		}
+		if !allowed && retryAfter <= 0 {
+			t.Fatalf("message %d has been rejected without retry after", i)
+		}
+	}
+}
+
+func TestAuthFailureLimiter(t *testing.T) {
+	const (
+		window  = 100 * time.Millisecond
+		lockout = 100 * time.Millisecond
+	)
+
+	tests := []struct {
+		name        string
+		maxFailures int
+		// steps are "fail", "reset" or "wait" (for the window and the lockout)
+		steps  []string
+		locked bool
+	}{
+		{name: "below the limit", maxFailures: 3, steps: []string{"fail", "fail"}, locked: false},
+		{name: "limit reached", maxFailures: 3, steps: []string{"fail", "fail", "fail"}, locked: true},
+		{name: "lockout expires", maxFailures: 2, steps: []string{"fail", "fail", "wait"}, locked: false},
+		{name: "failures expire with the window", maxFailures: 2, steps: []string{"fail", "wait", "fail"}, locked: false},
+		{name: "reset forgets failures", maxFailures: 2, steps: []string{"fail", "reset", "fail"}, locked: false},
+		{name: "reset keeps the lockout", maxFailures: 2, steps: []string{"fail", "fail", "reset"}, locked: true},
+		{name: "disabled", maxFailures: -1, steps: []string{"fail", "fail", "fail"}, locked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			al := NewAuthFailureLimiter(configuration.AuthFailureLimitConfiguration{
+				MaxFailures: tt.maxFailures,
+				Window:      window,
+				Lockout:     lockout,
+			})
+			for _, step := range tt.steps {
+				switch step {
+				case "fail":
+					al.RecordFailure("10.0.0.1")
+				case "reset":
+					al.Reset("10.0.0.1")
+				case "wait":
+					time.Sleep(max(window, lockout) + 10*time.Millisecond)
+				}
+			}
+
+			lockedFor := al.LockedFor("10.0.0.1")
+			if (lockedFor > 0) != tt.locked {
+				t.Fatalf("expected locked = %v, locked for %v", tt.locked, lockedFor)
+			}
+			if lockedFor > lockout {
+				t.Fatalf("locked for %v, longer than the lockout", lockedFor)
+			}
+			if al.LockedFor("10.0.0.2") > 0 {
+				t.Fatalf("another key has been locked")
+			}
+		})
+	}
+}
+
+func TestSyncMessagesExceedingTheRateLimitAreRejected(t *testing.T) {
+	s := setupSync(t, map[string]string{"a.md": "# A\n"})
+	s.connections.rateLimits = &RateLimits{SyncMessagesPerUser: NewKeyedRateLimiter(1, 1)}
+	documentId := s.documentId("a.md")
+	client := s.connect(t, documentId, testEditor, ModeEdit)
+
+	for _, text := range []string{"first\n", "second\n"} {
+		client.append(text)
+		s.connections.handleRequest(client.client, SyncRequest{
+			Type:          TypeSyncRequest,
+			RequestId:     text,
+			DocumentState: encodeBase64(client.doc.Save()),
+		})
+		client.receive()
+	}
+
+	if len(client.errors) != 1 || client.errors[0].Code != ErrorCodeRateLimited || client.errors[0].RequestId != "second\n" ||
+		client.errors[0].RetryAfter <= 0 || client.errors[0].RetryAfter > 1000 {
+		t.Fatalf("unexpected errors %+v", client.errors)
+	}
+	content, err := s.syncManager.GetContent(documentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "# A\nfirst\n" {
+		t.Fatalf("the rejected message has been processed: %q", content)
+	}
+}
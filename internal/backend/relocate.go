@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"log"
+	"strings"
+)
+
+// DocumentMovedMessage tells the clients of a document that it has been renamed or moved, which changes its id,
+// the session of the clients continues with the new id
+type DocumentMovedMessage struct {
+	Type       string `json:"type" xml:"type" form:"type" query:"type"`
+	RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+	// id of the document before it has been moved
+	OldDocumentId string `json:"oldDocumentId" xml:"oldDocumentId" form:"oldDocumentId" query:"oldDocumentId"`
+	Path          string `json:"path" xml:"path" form:"path" query:"path"`
+	Url           string `json:"url" xml:"url" form:"url" query:"url"`
+}
+
+// MoveItem renames or moves the item at the given path using the given function, which returns the new path of the item,
+// the state and the clients of all documents within the item are moved to the new ids of the documents,
+// so their editing sessions continue
+func (sm *AutomergeSyncManager) MoveItem(oldPath string, move func() (string, error)) (err error) {
+	documents := sm.treeManager.GetDocumentsWithin(oldPath)
+
+	// document id -> new id of the document
+	moved := make(map[string]string)
+	// no document may be written while its file is moved
+	sm.persister.WithoutWrites(func() {
+		var newPath string
+		newPath, err = move()
+		if err != nil || newPath == oldPath {
+			return
+		}
+		for _, d := range documents {
+			newId := sm.treeManager.generateId(newPath + strings.TrimPrefix(d.Path, oldPath))
+			sm.relocateDocument(d.ID, newId)
+			moved[d.ID] = newId
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for oldId, newId := range moved {
+		sm.sendDocumentMoved(oldId, newId)
+	}
+	return nil
+}
+
+// moves the shared document, its stored state and everything attached to it to the new id of the document
+func (sm *AutomergeSyncManager) relocateDocument(oldId string, newId string) {
+	log.Printf("Document '%s' has been moved, its new id is '%s'", oldId, newId)
+
+	sm.documentsLock.Lock()
+	if automergeDocument, ok := sm.documents[oldId]; ok {
+		delete(sm.documents, oldId)
+		sm.documents[newId] = automergeDocument
+	}
+	if actors, ok := sm.serverActors[oldId]; ok {
+		delete(sm.serverActors, oldId)
+		sm.serverActors[newId] = actors
+	}
+	if content, ok := sm.persistedContent[oldId]; ok {
+		delete(sm.persistedContent, oldId)
+		sm.persistedContent[newId] = content
+	}
+	if err := sm.store.Relocate(oldId, newId); err != nil {
+		log.Printf("Unable to move automerge state of document %s: %v", oldId, err)
+	}
+	sm.persister.Relocate(oldId, newId)
+	// the clients are moved while no sync request of them is processed
+	sm.websocketConnectionManager.RelocateDocument(oldId, newId)
+	sm.documentsLock.Unlock()
+
+	// comments and suggestions resolve their anchors while holding their own lock
+	if err := sm.commentManager.RelocateComments(oldId, newId); err != nil {
+		log.Printf("Unable to move comments of document %s: %v", oldId, err)
+	}
+	if err := sm.suggestionManager.RelocateSuggestions(oldId, newId); err != nil {
+		log.Printf("Unable to move suggestions of document %s: %v", oldId, err)
+	}
+	sm.presenceManager.RelocatePresence(oldId, newId)
+}
+
+// tells all clients of a moved document about its new id, path and url
+func (sm *AutomergeSyncManager) sendDocumentMoved(oldId string, newId string) {
+	d := sm.treeManager.GetDocument(newId)
+	if d == nil {
+		return
+	}
+
+	message := DocumentMovedMessage{
+		Type:          TypeDocumentMoved,
+		DocumentId:    newId,
+		OldDocumentId: oldId,
+		Path:          sm.treeManager.RelativePath(d.Path),
+		Url:           d.SubUrl,
+	}
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(newId) {
+		_ = sm.websocketConnectionManager.sendDocumentMoved(client, message)
+	}
+}
+
+// RelocateDocument moves all clients of a document to its new id, including disconnected clients
+// that may still resume their session
+func (wcm *WebsocketConnectionManager) RelocateDocument(oldId string, newId string) {
+	wcm.lock.Lock()
+	defer wcm.lock.Unlock()
+
+	for client := range wcm.clients {
+		if client.DocumentId() != oldId {
+			continue
+		}
+		client.setDocumentId(newId)
+		if client.connection != nil {
+			delete(client.connection.channels, oldId)
+			client.connection.channels[newId] = client
+		}
+	}
+	for _, client := range wcm.suspended {
+		if client.DocumentId() == oldId {
+			client.setDocumentId(newId)
+		}
+	}
+
+	if connections, ok := wcm.connectionsPerDocument[oldId]; ok {
+		delete(wcm.connectionsPerDocument, oldId)
+		wcm.connectionsPerDocument[newId] = connections
+	}
+	if viewers, ok := wcm.viewersPerDocument[oldId]; ok {
+		delete(wcm.viewersPerDocument, oldId)
+		wcm.viewersPerDocument[newId] = viewers
+	}
+}
+
+// returns the document the session with the given resume token belongs to, if it has been suspended,
+// the document may have been moved since the client lost its connection
+func (wcm *WebsocketConnectionManager) suspendedDocumentId(resumeToken string) string {
+	wcm.lock.RLock()
+	defer wcm.lock.RUnlock()
+
+	if client, ok := wcm.suspended[resumeToken]; ok && resumeToken != "" {
+		return client.DocumentId()
+	}
+	return ""
+}
+
+// sends a DocumentMovedMessage to the specified client
+func (wcm *WebsocketConnectionManager) sendDocumentMoved(client *WebsocketClient, message DocumentMovedMessage) (err error) {
+	err = wcm.writeJSON(client, message)
+	if err != nil {
+		log.Printf("%v: error writing DocumentMovedMessage to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
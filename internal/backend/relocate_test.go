@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	mutexSync "sync"
+	"testing"
+)
+
+// moves a document back and forth while one of its clients keeps sending changes,
+// run with -race to detect unsynchronized access to the document id of the client
+func TestMoveDocumentWhileSyncing(t *testing.T) {
+	s := setupSync(t, map[string]string{"a.md": "# A\n"})
+	client := s.connect(t, s.documentId("a.md"), testEditor, ModeEdit)
+
+	const edits = 50
+	done := make(chan struct{})
+	name := "a"
+	var wg mutexSync.WaitGroup
+	wg.Add(2)
+	// the messages to the client are discarded like by the write pump of a connection
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-client.client.send:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d := s.treeManager.GetDocument(s.documentId(name + ".md"))
+			if d == nil {
+				t.Errorf("document %s.md not found", name)
+				return
+			}
+			newName := "b"
+			if name == newName {
+				newName = "a"
+			}
+			err := s.syncManager.MoveItem(d.Path, func() (string, error) {
+				moved, err := s.treeManager.RenameDocument(d, nil, newName)
+				if err != nil {
+					return "", err
+				}
+				return moved.Path, nil
+			})
+			if err != nil {
+				t.Errorf("unable to move document: %v", err)
+				return
+			}
+			name = newName
+		}
+	}()
+
+	for i := 0; i < edits; i++ {
+		client.append(fmt.Sprintf("line %d\n", i))
+		if err := client.sendState(); err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	documentId := s.documentId(name + ".md")
+	if client.client.DocumentId() != documentId {
+		t.Fatalf("client is connected to %s instead of %s", client.client.DocumentId(), documentId)
+	}
+	content, err := s.syncManager.GetContent(documentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < edits; i++ {
+		if !strings.Contains(content, fmt.Sprintf("line %d\n", i)) {
+			t.Fatalf("change %d is missing from the moved document: %q", i, content)
+		}
+	}
+}
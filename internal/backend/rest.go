@@ -7,15 +7,27 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"gopkg.in/yaml.v3"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	urlParamParentId = "parentId"
-	urlParamId       = "id"
-	urlParamName     = "name"
-	indentationChar  = "  "
+	urlParamParentId   = "parentId"
+	urlParamId         = "id"
+	urlParamName       = "name"
+	urlParamComment    = "commentId"
+	urlParamReply      = "replyId"
+	urlParamSuggestion = "suggestionId"
+	indentationChar    = "  "
+
+	// prefix of the routes of the comment threads of a document
+	pathDocumentComments = "/document/:" + urlParamId + "/comments/"
 
 	EndpointPathAlive = "/alive/"
 )
@@ -38,14 +50,20 @@ type (
 
 	RenameSectionRequest struct {
 		Name string `json:"name" xml:"name" form:"name" query:"name" validate:"required"`
+		// id of the section the section is moved to, it stays in its current section if empty
+		Parent string `json:"parent" xml:"parent" form:"parent" query:"parent"`
 	}
 
 	RenameDocumentRequest struct {
 		Name string `json:"name" xml:"name" form:"name" query:"name" validate:"required"`
+		// id of the section the document is moved to, it stays in its current section if empty
+		Parent string `json:"parent" xml:"parent" form:"parent" query:"parent"`
 	}
 
 	RenameResourceRequest struct {
 		Name string `json:"name" xml:"name" form:"name" query:"name" validate:"required"`
+		// id of the section the resource is moved to, it stays in its current section if empty
+		Parent string `json:"parent" xml:"parent" form:"parent" query:"parent"`
 	}
 )
 
@@ -54,15 +72,39 @@ type RestService struct {
 	treeManager                *TreeManager
 	syncManager                SyncManager
 	websocketConnectionManager *WebsocketConnectionManager
+	authenticator              *Authenticator
+	oidc                       *OIDCAuthenticator
+	auditLog                   *AuditLog
+	rateLimits                 *RateLimits
+	presenceManager            *PresenceManager
+	lockManager                *LockManager
+	commentManager             *CommentManager
+	suggestionManager          *SuggestionManager
 }
 
 func NewRestService(
 	treeManager *TreeManager,
 	syncManager SyncManager,
+	authenticator *Authenticator,
+	oidc *OIDCAuthenticator,
+	auditLog *AuditLog,
+	rateLimits *RateLimits,
+	presenceManager *PresenceManager,
+	lockManager *LockManager,
+	commentManager *CommentManager,
+	suggestionManager *SuggestionManager,
 ) *RestService {
 	rs := &RestService{
-		treeManager: treeManager,
-		syncManager: syncManager,
+		treeManager:       treeManager,
+		syncManager:       syncManager,
+		authenticator:     authenticator,
+		oidc:              oidc,
+		auditLog:          auditLog,
+		rateLimits:        rateLimits,
+		presenceManager:   presenceManager,
+		lockManager:       lockManager,
+		commentManager:    commentManager,
+		suggestionManager: suggestionManager,
 	}
 	rs.echoRest = rs.createRestService()
 	return rs
@@ -71,6 +113,7 @@ func NewRestService(
 func (rs *RestService) createRestService() *echo.Echo {
 	echoRest := echo.New()
 	echoRest.HideBanner = true
+	echoRest.IPExtractor = newIPExtractor(configuration.CurrentConfig.Server.TrustedProxies)
 
 	// Root level middleware
 	echoRest.Pre(middleware.AddTrailingSlash())
@@ -92,31 +135,26 @@ func (rs *RestService) createRestService() *echo.Echo {
 	}
 
 	// global auth
-	var authConf = configuration.CurrentConfig.Server.BasicAuth
-	if authConf.User != "" && authConf.Password != "" {
-		basicAuthConfig := middleware.BasicAuthConfig{
-			Skipper: func(context echo.Context) bool {
-				return context.Path() == EndpointPathAlive
-			},
-			Validator: func(username string, password string, context echo.Context) (b bool, err error) {
-				if username == authConf.User && password == authConf.Password {
-					return true, nil
-				}
-				return false, nil
-			},
-			Realm: "Restricted",
-		}
-		echoRest.Use(middleware.BasicAuthWithConfig(basicAuthConfig))
-	}
+	echoRest.Use(rs.authenticator.Middleware())
+	echoRest.Use(rs.rateLimits.MutationMiddleware())
 
 	echoRest.GET(EndpointPathAlive, rs.isAlive)
+	echoRest.GET("/locks/", rs.getLocks)
 
 	// Authentication
+	echoRest.GET(EndpointPathUser, rs.authenticator.getCurrentUser)
+	echoRest.POST(EndpointPathLogout, rs.authenticator.logout)
+	if rs.oidc != nil {
+		echoRest.GET(EndpointPathLogin, rs.oidc.login)
+		echoRest.GET(EndpointPathCallback, rs.oidc.callback)
+	}
+
 	// Group level middleware
 	groupMkDocs := echoRest.Group("/mkdocs")
 	groupSections := echoRest.Group("/section")
 	groupDocuments := echoRest.Group("/document")
 	groupResources := echoRest.Group("/resource")
+	groupAdmin := echoRest.Group("/admin", RequireRole(RoleAdmin))
 
 	groupMkDocs.GET("/config/", rs.getMkDocsConfig)
 
@@ -125,13 +163,30 @@ func (rs *RestService) createRestService() *echo.Echo {
 	groupSections.POST("/", rs.createSection)
 	groupSections.PUT("/:"+urlParamId+"/", rs.renameSection)
 	groupSections.DELETE("/:"+urlParamId+"/", rs.deleteSection)
+	groupSections.POST("/:"+urlParamId+"/lock/", rs.lockSection)
+	groupSections.DELETE("/:"+urlParamId+"/lock/", rs.unlockSection)
 
 	groupDocuments.GET("/:"+urlParamId+"/", rs.getDocumentDescription)
 	groupDocuments.GET("/:"+urlParamId+"/ws/", rs.handleNewConnection)
 	groupDocuments.GET("/:"+urlParamId+"/content/", rs.getDocumentContent)
+	groupDocuments.GET("/:"+urlParamId+"/changes/", rs.getDocumentChanges)
+	groupDocuments.GET("/:"+urlParamId+"/diff/", rs.getDocumentDiff)
+	groupDocuments.GET("/:"+urlParamId+"/blame/", rs.getDocumentBlame)
+	groupDocuments.GET("/:"+urlParamId+"/presence/", rs.getDocumentPresence)
+	groupDocuments.GET("/:"+urlParamId+"/comments/", rs.getDocumentComments)
+	groupDocuments.POST("/:"+urlParamId+"/comments/", rs.createComment)
+	groupDocuments.PUT("/:"+urlParamId+"/comments/:"+urlParamComment+"/", rs.updateComment)
+	groupDocuments.DELETE("/:"+urlParamId+"/comments/:"+urlParamComment+"/", rs.deleteComment)
+	groupDocuments.POST("/:"+urlParamId+"/comments/:"+urlParamComment+"/replies/", rs.replyToComment)
+	groupDocuments.DELETE("/:"+urlParamId+"/comments/:"+urlParamComment+"/replies/:"+urlParamReply+"/", rs.deleteCommentReply)
+	groupDocuments.GET("/:"+urlParamId+"/suggestions/", rs.getDocumentSuggestions)
+	groupDocuments.POST("/:"+urlParamId+"/suggestions/:"+urlParamSuggestion+"/accept/", rs.acceptSuggestion)
+	groupDocuments.POST("/:"+urlParamId+"/suggestions/:"+urlParamSuggestion+"/reject/", rs.rejectSuggestion)
 	groupDocuments.POST("/", rs.createDocument)
 	groupDocuments.PUT("/:"+urlParamId+"/", rs.renameDocument)
 	groupDocuments.DELETE("/:"+urlParamId+"/", rs.deleteDocument)
+	groupDocuments.POST("/:"+urlParamId+"/lock/", rs.lockDocument)
+	groupDocuments.DELETE("/:"+urlParamId+"/lock/", rs.unlockDocument)
 
 	groupResources.GET("/:"+urlParamId+"/", rs.getResourceDescription)
 	groupResources.GET("/:"+urlParamId+"/content/", rs.getResourceContent)
@@ -139,13 +194,69 @@ func (rs *RestService) createRestService() *echo.Echo {
 	groupResources.PUT("/:"+urlParamId+"/", rs.renameResource)
 	groupResources.DELETE("/:"+urlParamId+"/", rs.deleteResource)
 
+	groupAdmin.GET("/audit/", rs.getAuditLog)
+	groupAdmin.GET("/sessions/", rs.getSessions)
+	groupAdmin.DELETE("/sessions/:"+urlParamId+"/", rs.disconnectSession)
+
 	return echoRest
 }
 
+// returns the extractor for the remote address of requests, forwarding headers are only trusted
+// if they have been set by one of the given proxies, as clients could spoof them otherwise
+func newIPExtractor(trustedProxies []string) echo.IPExtractor {
+	if len(trustedProxies) <= 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipRange, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %s: %v", proxy, err)
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 // Start the REST service
 func (rs *RestService) Start() {
 	var serverConf = configuration.CurrentConfig.Server
-	rs.echoRest.Logger.Fatal(rs.echoRest.Start(fmt.Sprintf("%s:%d", serverConf.Host, serverConf.Port)))
+	address := fmt.Sprintf("%s:%d", serverConf.Host, serverConf.Port)
+	if !serverConf.TLS.IsEnabled() {
+		rs.echoRest.Logger.Fatal(rs.echoRest.Start(address))
+		return
+	}
+
+	tlsConfig, err := createTLSConfig(serverConf.TLS, serverConf.Host)
+	if err != nil {
+		rs.echoRest.Logger.Fatal(err)
+	}
+
+	if serverConf.TLS.RedirectPort > 0 {
+		redirectServer := createHttpsRedirectServer(serverConf.Host, serverConf.TLS.RedirectPort, serverConf.Port)
+		go func() {
+			rs.echoRest.Logger.Fatal(redirectServer.ListenAndServe())
+		}()
+	}
+
+	rs.echoRest.Logger.Fatal(rs.echoRest.StartServer(&http.Server{
+		Addr:      address,
+		TLSConfig: tlsConfig,
+	}))
 }
 
 // returns an empty "ok" answer
@@ -211,13 +322,268 @@ func (rs *RestService) getItemDescription(c echo.Context, itemType string) (err
 func (rs *RestService) getDocumentContent(c echo.Context) (err error) {
 	id := c.Param(urlParamId)
 
+	content, ok := rs.treeManager.GetDocumentContent(id)
+	if !ok {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	// an earlier version of the document, given by its automerge heads
+	if at := c.QueryParam("at"); at != "" {
+		content, err = rs.syncManager.GetContentAt(id, ParseHeads(at))
+		if err != nil {
+			return rs.returnHistoryError(c, err)
+		}
+	}
+	return c.String(http.StatusOK, content)
+}
+
+// returns the change history of the document with the given id
+func (rs *RestService) getDocumentChanges(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
 	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
 
-	if d != nil {
-		return c.String(http.StatusOK, d.Content)
-	} else {
+	changes, err := rs.syncManager.GetChanges(id)
+	if err != nil {
+		return rs.ReturnError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, changes, indentationChar)
+}
+
+// returns the differences between the versions of the document given by the query parameters "from" and "to",
+// which default to the beginning of the history and the current version
+func (rs *RestService) getDocumentDiff(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	diff, err := rs.syncManager.GetDiff(id, ParseHeads(c.QueryParam("from")), ParseHeads(c.QueryParam("to")))
+	if err != nil {
+		return rs.returnHistoryError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, diff, indentationChar)
+}
+
+// returns the text of the document with the given id annotated with the last author of each part
+func (rs *RestService) getDocumentBlame(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	spans, err := rs.syncManager.GetBlame(id)
+	if err != nil {
+		return rs.ReturnError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, spans, indentationChar)
+}
+
+// returns the matching response for an error of reading the history of a document
+func (rs *RestService) returnHistoryError(c echo.Context, e error) (err error) {
+	switch {
+	case errors.Is(e, errInvalidHeads):
+		return echo.NewHTTPError(http.StatusBadRequest, e.Error())
+	case errors.Is(e, errUnknownHeads):
+		return c.JSONPretty(http.StatusNotFound, &ErrorResult{
+			Name:    "Not found",
+			Message: e.Error(),
+		}, indentationChar)
+	default:
+		return rs.ReturnError(c, e)
+	}
+}
+
+// returns the cursors and selections of all clients currently editing the document with the given id
+func (rs *RestService) getDocumentPresence(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	presence := rs.presenceManager.GetPresence(id)
+	if presence == nil {
+		presence = []Presence{}
+	}
+	return c.JSONPretty(http.StatusOK, presence, indentationChar)
+}
+
+// returns all comment threads of the document with the given id
+func (rs *RestService) getDocumentComments(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	comments, err := rs.commentManager.GetComments(id)
+	if err != nil {
+		return rs.ReturnError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, comments, indentationChar)
+}
+
+// starts a new comment thread on a text range of the document with the given id
+func (rs *RestService) createComment(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+	r := new(NewCommentRequest)
+	if err = c.Bind(r); err != nil {
+		return rs.ReturnError(c, err)
+	}
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	comment, err := rs.commentManager.Create(getUser(c), id, *r)
+	if err != nil {
+		return rs.returnCommentError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, comment, indentationChar)
+}
+
+// resolves or reopens a comment thread
+func (rs *RestService) updateComment(c echo.Context) (err error) {
+	r := new(UpdateCommentRequest)
+	if err = c.Bind(r); err != nil {
+		return rs.ReturnError(c, err)
+	}
+
+	comment, err := rs.commentManager.SetResolved(getUser(c), c.Param(urlParamId), c.Param(urlParamComment), r.Resolved)
+	if err != nil {
+		return rs.returnCommentError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, comment, indentationChar)
+}
+
+// deletes a comment thread including all of its replies
+func (rs *RestService) deleteComment(c echo.Context) (err error) {
+	err = rs.commentManager.Delete(getUser(c), c.Param(urlParamId), c.Param(urlParamComment))
+	if err != nil {
+		return rs.returnCommentError(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// adds a reply to a comment thread
+func (rs *RestService) replyToComment(c echo.Context) (err error) {
+	r := new(CommentReplyRequest)
+	if err = c.Bind(r); err != nil {
+		return rs.ReturnError(c, err)
+	}
+
+	comment, err := rs.commentManager.Reply(getUser(c), c.Param(urlParamId), c.Param(urlParamComment), *r)
+	if err != nil {
+		return rs.returnCommentError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, comment, indentationChar)
+}
+
+// deletes a single reply of a comment thread
+func (rs *RestService) deleteCommentReply(c echo.Context) (err error) {
+	comment, err := rs.commentManager.DeleteReply(getUser(c), c.Param(urlParamId), c.Param(urlParamComment), c.Param(urlParamReply))
+	if err != nil {
+		return rs.returnCommentError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, comment, indentationChar)
+}
+
+// returns the matching response for an error of the comment manager
+func (rs *RestService) returnCommentError(c echo.Context, e error) (err error) {
+	switch {
+	case errors.Is(e, errCommentNotFound):
+		return c.JSONPretty(http.StatusNotFound, &ErrorResult{
+			Name:    "Not found",
+			Message: e.Error(),
+		}, indentationChar)
+	case errors.Is(e, errNotCommentAuthor):
+		return c.JSONPretty(http.StatusForbidden, &ErrorResult{
+			Name:    "Forbidden",
+			Message: e.Error(),
+		}, indentationChar)
+	case errors.Is(e, errEmptyComment):
+		return echo.NewHTTPError(http.StatusBadRequest, e.Error())
+	default:
+		return rs.ReturnError(c, e)
+	}
+}
+
+// returns all pending suggestions of the document with the given id
+func (rs *RestService) getDocumentSuggestions(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	suggestions, err := rs.suggestionManager.GetSuggestions(id)
+	if err != nil {
+		return rs.ReturnError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, suggestions, indentationChar)
+}
+
+// applies a pending suggestion to the document
+func (rs *RestService) acceptSuggestion(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
 		return rs.ReturnNotFound(c, id)
 	}
+
+	err = rs.syncManager.AcceptSuggestion(getUser(c), id, c.Param(urlParamSuggestion))
+	if err != nil {
+		return rs.returnSuggestionError(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// discards a pending suggestion of the document
+func (rs *RestService) rejectSuggestion(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	d := rs.treeManager.GetDocument(id)
+	if d == nil {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	err = rs.syncManager.RejectSuggestion(id, c.Param(urlParamSuggestion))
+	if err != nil {
+		return rs.returnSuggestionError(c, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// returns the matching response for an error of accepting or rejecting a suggestion
+func (rs *RestService) returnSuggestionError(c echo.Context, e error) (err error) {
+	switch {
+	case errors.Is(e, errSuggestionNotFound):
+		return c.JSONPretty(http.StatusNotFound, &ErrorResult{
+			Name:    "Not found",
+			Message: e.Error(),
+		}, indentationChar)
+	case errors.Is(e, errSuggestionConflict):
+		return c.JSONPretty(http.StatusConflict, &ErrorResult{
+			Name:    "Conflict",
+			Message: e.Error(),
+		}, indentationChar)
+	default:
+		// locked documents or any other error
+		return rs.ReturnLocked(c, e)
+	}
 }
 
 // creates a new document with the given data
@@ -236,6 +602,12 @@ func (rs *RestService) createSection(c echo.Context) (err error) {
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	rs.recordTreeChange(c, AuditEntry{
+		Action:   AuditActionCreate,
+		ItemType: TypeSection,
+		ItemId:   section.ID,
+		Path:     rs.treeManager.RelativePath(section.Path),
+	})
 
 	return c.JSONPretty(http.StatusOK, section, " ")
 }
@@ -252,11 +624,43 @@ func (rs *RestService) renameSection(c echo.Context) (err error) {
 	if s == nil {
 		return rs.ReturnNotFound(c, id)
 	}
+	if err = rs.lockManager.CheckChange(getUser(c), s.Path); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
+	var parent *Section
+	if r.Parent != "" {
+		parent = rs.treeManager.GetSection(r.Parent)
+		if parent == nil {
+			return rs.ReturnNotFound(c, r.Parent)
+		}
+	}
+	if err = rs.lockManager.CheckChange(getUser(c), filepath.Join(targetDirectory(s.Path, parent), r.Name)); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
 
-	section, err := rs.treeManager.RenameSection(s, r.Name)
+	oldPath := s.Path
+	var section *Section
+	err = rs.syncManager.MoveItem(oldPath, func() (string, error) {
+		section, err = rs.treeManager.RenameSection(s, parent, r.Name)
+		if err != nil {
+			return "", err
+		}
+		rs.lockManager.Relocate(oldPath, section.Path)
+		return section.Path, nil
+	})
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	// renaming an item to its current name does not change anything
+	if section.Path != oldPath {
+		rs.recordTreeChange(c, AuditEntry{
+			Action:   AuditActionRename,
+			ItemType: TypeSection,
+			ItemId:   section.ID,
+			Path:     rs.treeManager.RelativePath(section.Path),
+			OldPath:  rs.treeManager.RelativePath(oldPath),
+		})
+	}
 
 	return c.JSONPretty(http.StatusOK, section, " ")
 }
@@ -276,6 +680,12 @@ func (rs *RestService) createDocument(c echo.Context) (err error) {
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	rs.recordTreeChange(c, AuditEntry{
+		Action:   AuditActionCreate,
+		ItemType: TypeDocument,
+		ItemId:   document.ID,
+		Path:     rs.treeManager.RelativePath(document.Path),
+	})
 
 	return c.JSONPretty(http.StatusOK, document, " ")
 }
@@ -291,11 +701,43 @@ func (rs *RestService) renameDocument(c echo.Context) (err error) {
 	if d == nil {
 		return rs.ReturnNotFound(c, id)
 	}
+	if err = rs.lockManager.CheckChange(getUser(c), d.Path); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
+	var parent *Section
+	if r.Parent != "" {
+		parent = rs.treeManager.GetSection(r.Parent)
+		if parent == nil {
+			return rs.ReturnNotFound(c, r.Parent)
+		}
+	}
+	if err = rs.lockManager.CheckChange(getUser(c), filepath.Join(targetDirectory(d.Path, parent), r.Name+markdownFileExtension)); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
 
-	document, err := rs.treeManager.RenameDocument(d, r.Name)
+	oldPath := d.Path
+	var document *Document
+	// the editing sessions of the document continue with its new id
+	err = rs.syncManager.MoveItem(oldPath, func() (string, error) {
+		document, err = rs.treeManager.RenameDocument(d, parent, r.Name)
+		if err != nil {
+			return "", err
+		}
+		rs.lockManager.Relocate(oldPath, document.Path)
+		return document.Path, nil
+	})
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	if document.Path != oldPath {
+		rs.recordTreeChange(c, AuditEntry{
+			Action:   AuditActionRename,
+			ItemType: TypeDocument,
+			ItemId:   document.ID,
+			Path:     rs.treeManager.RelativePath(document.Path),
+			OldPath:  rs.treeManager.RelativePath(oldPath),
+		})
+	}
 	return c.JSONPretty(http.StatusOK, document, " ")
 }
 
@@ -310,11 +752,34 @@ func (rs *RestService) renameResource(c echo.Context) (err error) {
 	if d == nil {
 		return rs.ReturnNotFound(c, id)
 	}
+	if err = rs.lockManager.CheckChange(getUser(c), d.Path); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
+	var parent *Section
+	if r.Parent != "" {
+		parent = rs.treeManager.GetSection(r.Parent)
+		if parent == nil {
+			return rs.ReturnNotFound(c, r.Parent)
+		}
+	}
+	if err = rs.lockManager.CheckChange(getUser(c), filepath.Join(targetDirectory(d.Path, parent), r.Name)); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
 
-	resource, err := rs.treeManager.RenameResource(d, r.Name)
+	oldPath := d.Path
+	resource, err := rs.treeManager.RenameResource(d, parent, r.Name)
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	if resource.Path != oldPath {
+		rs.recordTreeChange(c, AuditEntry{
+			Action:   AuditActionRename,
+			ItemType: TypeResource,
+			ItemId:   resource.ID,
+			Path:     rs.treeManager.RelativePath(resource.Path),
+			OldPath:  rs.treeManager.RelativePath(oldPath),
+		})
+	}
 	return c.JSONPretty(http.StatusOK, resource, " ")
 }
 
@@ -337,19 +802,41 @@ func (rs *RestService) deleteResource(c echo.Context) (err error) {
 func (rs *RestService) deleteItem(c echo.Context, itemType string) (err error) {
 	id := c.Param(urlParamId)
 
+	path := rs.treeManager.GetItemPath(id, itemType)
+	if path == "" {
+		return rs.ReturnNotFound(c, id)
+	}
+	user := getUser(c)
+	if err = rs.lockManager.CheckChange(user, path); err != nil {
+		return rs.ReturnLocked(c, err)
+	}
+
+	// other users cannot edit the item while the user holds an exclusive lock on it,
+	// their remaining connections are closed after the deletion
+	if !rs.lockManager.HoldsExclusiveLock(user, path) {
+		switch itemType {
+		case TypeSection:
+			err = rs.syncManager.IsItemBeingEditedRecursive(rs.treeManager.GetSection(id))
+			if err != nil {
+				return rs.ReturnError(c, err)
+			}
+		case TypeDocument:
+			if rs.websocketConnectionManager.IsClientConnected(id) {
+				return c.JSONPretty(http.StatusConflict, &ErrorResult{
+					Name:    "Conflict",
+					Message: "There are still clients connected to the document",
+				}, indentationChar)
+			}
+		}
+	}
+
+	// read-only clients do not prevent the deletion, they are disconnected afterwards
+	var followedDocumentIds []string
 	switch itemType {
 	case TypeSection:
-		err = rs.syncManager.IsItemBeingEditedRecursive(rs.treeManager.GetSection(id))
-		if err != nil {
-			return rs.ReturnError(c, err)
-		}
+		followedDocumentIds = documentIdsRecursive(rs.treeManager.GetSection(id))
 	case TypeDocument:
-		if rs.websocketConnectionManager.IsClientConnected(id) {
-			return c.JSONPretty(http.StatusConflict, &ErrorResult{
-				Name:    "Conflict",
-				Message: "There are still clients connected to the document",
-			}, indentationChar)
-		}
+		followedDocumentIds = []string{id}
 	}
 
 	success, err := rs.treeManager.DeleteItem(id, itemType)
@@ -360,11 +847,122 @@ func (rs *RestService) deleteItem(c echo.Context, itemType string) (err error) {
 	if !success {
 		return rs.ReturnNotFound(c, id)
 	} else {
+		rs.recordTreeChange(c, AuditEntry{
+			Action:   AuditActionDelete,
+			ItemType: itemType,
+			ItemId:   id,
+			Path:     rs.treeManager.RelativePath(path),
+		})
 		rs.treeManager.CreateItemTree()
+		rs.lockManager.RemoveLocks(path)
+		for _, documentId := range followedDocumentIds {
+			rs.websocketConnectionManager.CloseDocumentConnections(documentId, "the document has been deleted")
+			rs.commentManager.RemoveComments(documentId)
+			rs.suggestionManager.RemoveSuggestions(documentId)
+			rs.syncManager.RemoveDocument(documentId)
+		}
 		return c.NoContent(http.StatusOK)
 	}
 }
 
+// locks an existing section for the current user
+func (rs *RestService) lockSection(c echo.Context) (err error) {
+	return rs.lockItem(c, TypeSection)
+}
+
+// locks an existing document for the current user
+func (rs *RestService) lockDocument(c echo.Context) (err error) {
+	return rs.lockItem(c, TypeDocument)
+}
+
+// releases the lock on a section
+func (rs *RestService) unlockSection(c echo.Context) (err error) {
+	return rs.unlockItem(c, TypeSection)
+}
+
+// releases the lock on a document
+func (rs *RestService) unlockDocument(c echo.Context) (err error) {
+	return rs.unlockItem(c, TypeDocument)
+}
+
+// acquires or renews the lock of the current user on an item by id and itemType
+func (rs *RestService) lockItem(c echo.Context, itemType string) (err error) {
+	id := c.Param(urlParamId)
+	r := new(LockRequest)
+	if err = c.Bind(r); err != nil {
+		return rs.ReturnError(c, err)
+	}
+
+	mode, lease, err := rs.lockManager.ParseLockRequest(*r)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid lock request: "+err.Error())
+	}
+
+	path := rs.treeManager.GetItemPath(id, itemType)
+	if path == "" {
+		return rs.ReturnNotFound(c, id)
+	}
+
+	lock, err := rs.lockManager.Acquire(getUser(c), itemType, id, path, mode, lease, r.Reason)
+	if err != nil {
+		return rs.ReturnLocked(c, err)
+	}
+	rs.auditLog.RecordRequest(c, AuditEntry{
+		Action:   AuditActionLock,
+		ItemType: itemType,
+		ItemId:   id,
+		Path:     lock.Path,
+	})
+
+	return c.JSONPretty(http.StatusOK, lock, indentationChar)
+}
+
+// releases the lock on an item by id and itemType, admins may also release the locks of other users
+func (rs *RestService) unlockItem(c echo.Context, itemType string) (err error) {
+	id := c.Param(urlParamId)
+
+	released, err := rs.lockManager.Release(getUser(c), id)
+	if err != nil {
+		return c.JSONPretty(http.StatusForbidden, &ErrorResult{
+			Name:    "Forbidden",
+			Message: err.Error(),
+		}, indentationChar)
+	}
+	if !released {
+		return c.JSONPretty(http.StatusNotFound, &ErrorResult{
+			Name:    "Not found",
+			Message: "The item '" + id + "' is not locked",
+		}, indentationChar)
+	}
+	rs.auditLog.RecordRequest(c, AuditEntry{
+		Action:   AuditActionUnlock,
+		ItemType: itemType,
+		ItemId:   id,
+		Path:     rs.treeManager.RelativePath(rs.treeManager.GetItemPath(id, itemType)),
+	})
+
+	return c.NoContent(http.StatusOK)
+}
+
+// returns all locks that are currently held
+func (rs *RestService) getLocks(c echo.Context) (err error) {
+	return c.JSONPretty(http.StatusOK, rs.lockManager.GetLocks(), indentationChar)
+}
+
+// returns the ids of all documents within the given section and its subsections
+func documentIdsRecursive(s *Section) (documentIds []string) {
+	if s == nil {
+		return nil
+	}
+	for _, doc := range *s.Documents {
+		documentIds = append(documentIds, doc.ID)
+	}
+	for _, subsection := range *s.Subsections {
+		documentIds = append(documentIds, documentIdsRecursive(subsection)...)
+	}
+	return documentIds
+}
+
 // GetResourceDescription returns the description of a single resource with the given id (if found)
 func (rs *RestService) GetResourceDescription(c echo.Context) (err error) {
 	id := c.Param(urlParamId)
@@ -412,10 +1010,73 @@ func (rs *RestService) uploadNewResource(c echo.Context) (err error) {
 	if err != nil {
 		return rs.ReturnError(c, err)
 	}
+	rs.recordTreeChange(c, AuditEntry{
+		Action:   AuditActionCreate,
+		ItemType: TypeResource,
+		ItemId:   resource.ID,
+		Path:     rs.treeManager.RelativePath(resource.Path),
+	})
 
 	return c.JSONPretty(http.StatusOK, resource, indentationChar)
 }
 
+// returns the entries of the audit log matching the query parameters "user", "item", "from" and "to",
+// "limit" restricts the result to the newest entries
+func (rs *RestService) getAuditLog(c echo.Context) (err error) {
+	query := AuditQuery{
+		User:   c.QueryParam("user"),
+		ItemId: c.QueryParam("item"),
+	}
+
+	if from := c.QueryParam("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid 'from' parameter: "+err.Error())
+		}
+	}
+	if to := c.QueryParam("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid 'to' parameter: "+err.Error())
+		}
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid 'limit' parameter: "+err.Error())
+		}
+	}
+
+	entries, err := rs.auditLog.Query(query)
+	if err != nil {
+		return rs.ReturnError(c, err)
+	}
+	return c.JSONPretty(http.StatusOK, entries, indentationChar)
+}
+
+// returns all connected websocket sessions
+func (rs *RestService) getSessions(c echo.Context) (err error) {
+	return c.JSONPretty(http.StatusOK, rs.websocketConnectionManager.GetSessions(), indentationChar)
+}
+
+// forcibly disconnects a websocket session after writing its pending changes
+func (rs *RestService) disconnectSession(c echo.Context) (err error) {
+	id := c.Param(urlParamId)
+
+	session, ok := rs.websocketConnectionManager.DisconnectSession(id)
+	if !ok {
+		return rs.ReturnNotFound(c, id)
+	}
+	entry := AuditEntry{
+		Action: AuditActionDisconnect,
+	}
+	if session.DocumentId != "" {
+		entry.ItemType = TypeDocument
+		entry.ItemId = session.DocumentId
+		entry.Path = session.DocumentPath
+	}
+	rs.auditLog.RecordRequest(c, entry)
+
+	return c.NoContent(http.StatusOK)
+}
+
 // return the error message of an error
 func (rs *RestService) ReturnError(c echo.Context, e error) (err error) {
 	return c.JSONPretty(http.StatusInternalServerError, &ErrorResult{
@@ -424,6 +1085,18 @@ func (rs *RestService) ReturnError(c echo.Context, e error) (err error) {
 	}, indentationChar)
 }
 
+// return a "locked" message if the given error is a LockedError
+func (rs *RestService) ReturnLocked(c echo.Context, e error) (err error) {
+	var lockedErr *LockedError
+	if !errors.As(e, &lockedErr) {
+		return rs.ReturnError(c, e)
+	}
+	return c.JSONPretty(http.StatusLocked, &ErrorResult{
+		Name:    "Locked",
+		Message: lockedErr.Error(),
+	}, indentationChar)
+}
+
 // return a "not found" message
 func (rs *RestService) ReturnNotFound(c echo.Context, id string) (err error) {
 	return c.JSONPretty(http.StatusNotFound, &ErrorResult{
@@ -435,9 +1108,26 @@ func (rs *RestService) ReturnNotFound(c echo.Context, id string) (err error) {
 func (rs *RestService) RegisterWebsocketHandler(websocketConnectionManager *WebsocketConnectionManager) {
 	rs.websocketConnectionManager = websocketConnectionManager
 	rs.echoRest.GET("/:"+urlParamId+"/ws/", rs.handleNewConnection)
+	rs.echoRest.GET("/ws/", rs.handleMultiplexedConnection)
 }
 
 func (rs *RestService) handleNewConnection(c echo.Context) (err error) {
 	documentId := c.Param(urlParamId)
 	return rs.websocketConnectionManager.HandleNewConnection(c, documentId)
 }
+
+func (rs *RestService) handleMultiplexedConnection(c echo.Context) (err error) {
+	return rs.websocketConnectionManager.HandleMultiplexedConnection(c)
+}
+
+// records a change of the tree in the audit log and tells the multiplexed websocket connections about it
+func (rs *RestService) recordTreeChange(c echo.Context, entry AuditEntry) {
+	rs.auditLog.RecordRequest(c, entry)
+	rs.websocketConnectionManager.SendTreeEvent(TreeEvent{
+		Action:   entry.Action,
+		ItemType: entry.ItemType,
+		ItemId:   entry.ItemId,
+		Path:     entry.Path,
+		OldPath:  entry.OldPath,
+	})
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenameChecksLocksOnTheTarget(t *testing.T) {
+	otherUser := &User{Name: "john", Roles: []string{RoleEditor}}
+
+	tests := []struct {
+		name     string
+		itemType string
+		item     string
+		// path of the item the other user has locked, relative to the docs directory
+		locked  string
+		newName string
+		// name of the section the item is moved to, it stays in its current section if empty
+		parent string
+		status int
+	}{
+		{name: "document", itemType: TypeDocument, item: "a.md", locked: "b.md", newName: "c", status: http.StatusOK},
+		{name: "document to locked name", itemType: TypeDocument, item: "a.md", locked: "c.md", newName: "c", status: http.StatusLocked},
+		{name: "document into locked section", itemType: TypeDocument, item: "a.md", locked: "sub", newName: "a", parent: "sub", status: http.StatusLocked},
+		{name: "section to locked name", itemType: TypeSection, item: "sub", locked: "other", newName: "other", status: http.StatusLocked},
+		{name: "resource to locked name", itemType: TypeResource, item: "image.png", locked: "logo.png", newName: "logo.png", status: http.StatusLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{
+				"a.md":      "# A\n",
+				"b.md":      "# B\n",
+				"image.png": "png",
+				"sub/s.md":  "# S\n",
+			})
+			lockedPath := filepath.Join(s.docsPath, tt.locked)
+			_, err := s.lockManager.Acquire(otherUser, TypeDocument, s.treeManager.generateId(lockedPath), lockedPath,
+				LockModeExclusive, time.Minute, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs := &RestService{
+				treeManager:                s.treeManager,
+				syncManager:                s.syncManager,
+				auditLog:                   NewAuditLog(),
+				lockManager:                s.lockManager,
+				websocketConnectionManager: s.connections,
+			}
+
+			body := `{"name": "` + tt.newName + `"`
+			if tt.parent != "" {
+				body += `, "parent": "` + s.documentId(tt.parent) + `"`
+			}
+			body += `}`
+			request := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+			request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			response := httptest.NewRecorder()
+			c := echo.New().NewContext(request, response)
+			c.Set(contextKeyUser, testEditor)
+			c.SetParamNames(urlParamId)
+			c.SetParamValues(s.documentId(tt.item))
+
+			switch tt.itemType {
+			case TypeSection:
+				err = rs.renameSection(c)
+			case TypeDocument:
+				err = rs.renameDocument(c)
+			case TypeResource:
+				err = rs.renameResource(c)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, response.Code, response.Body.String())
+			}
+			if _, err = os.Stat(filepath.Join(s.docsPath, tt.item)); (err == nil) != (tt.status != http.StatusOK) {
+				t.Fatalf("unexpected state of the renamed item: %v", err)
+			}
+		})
+	}
+}
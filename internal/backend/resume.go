@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"log"
+	"time"
+)
+
+// SessionMessage is sent to every client right after it connected,
+// the resume token allows the client to continue its session with a new connection after it lost the connection
+type SessionMessage struct {
+	Type        string `json:"type" xml:"type" form:"type" query:"type"`
+	RequestId   string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+	DocumentId  string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+	ClientId    string `json:"clientId" xml:"clientId" form:"clientId" query:"clientId"`
+	ResumeToken string `json:"resumeToken" xml:"resumeToken" form:"resumeToken" query:"resumeToken"`
+	// true if the client continues the session of its previous connection
+	Resumed bool `json:"resumed" xml:"resumed" form:"resumed" query:"resumed"`
+	// true if the client is connected in view mode
+	ReadOnly bool `json:"readOnly" xml:"readOnly" form:"readOnly" query:"readOnly"`
+	// true if the client is connected in suggestion mode
+	Suggesting bool `json:"suggesting" xml:"suggesting" form:"suggesting" query:"suggesting"`
+	// hex encoded automerge actor id the client should use for its changes, not set for diff-sync and view clients
+	ActorId string `json:"actorId,omitempty" xml:"actorId,omitempty" form:"actorId" query:"actorId"`
+}
+
+// sends the session information to the given client
+func (wcm *WebsocketConnectionManager) sendSession(client *WebsocketClient, resumed bool) error {
+	err := wcm.writeJSON(client, SessionMessage{
+		Type:        TypeSession,
+		DocumentId:  client.DocumentId(),
+		ClientId:    client.Id,
+		ResumeToken: client.resumeToken,
+		Resumed:     resumed,
+		ReadOnly:    client.ReadOnly,
+		Suggesting:  client.Suggesting,
+		ActorId:     client.ActorId,
+	})
+	if err != nil {
+		log.Printf("%v: error writing SessionMessage to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
+
+// keeps the given disconnected client for the resume grace period,
+// must be called with the lock held
+func (wcm *WebsocketConnectionManager) suspendClient(client *WebsocketClient) {
+	wcm.suspended[client.resumeToken] = client
+	client.resumeTimer = time.AfterFunc(wcm.config.ResumeGracePeriod, func() {
+		wcm.expireSuspendedClient(client)
+	})
+}
+
+// removes the given suspended client if it has not resumed its session in the meantime
+func (wcm *WebsocketConnectionManager) expireSuspendedClient(client *WebsocketClient) {
+	wcm.lock.Lock()
+	if wcm.suspended[client.resumeToken] != client {
+		wcm.lock.Unlock()
+		return
+	}
+	delete(wcm.suspended, client.resumeToken)
+	wcm.lock.Unlock()
+
+	wcm.removeClient(client)
+}
+
+// returns the suspended client the given new client resumes the session of, if the resume token is valid for it,
+// must be called with the lock held
+func (wcm *WebsocketConnectionManager) takeSuspendedClient(resumeToken string, client *WebsocketClient) *WebsocketClient {
+	previous, ok := wcm.suspended[resumeToken]
+	if resumeToken == "" || !ok {
+		return nil
+	}
+	if previous.DocumentId() != client.DocumentId() || previous.Protocol != client.Protocol || previous.ReadOnly != client.ReadOnly ||
+		previous.Suggesting != client.Suggesting || previous.User.Name != client.User.Name {
+		log.Printf("%v: resume token does not match the connection, starting a new session", client.RemoteAddr)
+		return nil
+	}
+
+	previous.resumeTimer.Stop()
+	delete(wcm.suspended, resumeToken)
+	return previous
+}
+
+// AddOnClientResumedListener adds a listener that is called instead of the new client listeners when a client
+// resumes the session of its previous connection, the state of the previous client has to be moved to the new one
+func (wcm *WebsocketConnectionManager) AddOnClientResumedListener(f func(previous *WebsocketClient, client *WebsocketClient, document *Document) error) {
+	wcm.onClientResumed = append(wcm.onClientResumed, f)
+}
@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	mutexSync "sync"
+	"time"
+)
+
+type (
+	// Session is a login session of a user, created after a successful OpenID Connect login
+	Session struct {
+		ID        string
+		User      *User
+		CreatedAt time.Time
+		ExpiresAt time.Time
+	}
+)
+
+// SessionManager keeps track of the login sessions issued by this server
+type SessionManager struct {
+	lock     mutexSync.RWMutex
+	sessions map[string]*Session
+
+	cookieName string
+	maxAge     time.Duration
+}
+
+func NewSessionManager() *SessionManager {
+	var sessionConf = configuration.CurrentConfig.Server.Session
+	return &SessionManager{
+		sessions:   make(map[string]*Session),
+		cookieName: sessionConf.CookieName,
+		maxAge:     sessionConf.MaxAge,
+	}
+}
+
+// CreateSession creates a new session for the given user and attaches the session cookie to the response
+func (sm *SessionManager) CreateSession(c echo.Context, user *User) *Session {
+	now := time.Now()
+	session := &Session{
+		ID:        randomToken(32),
+		User:      user,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sm.maxAge),
+	}
+
+	sm.lock.Lock()
+	sm.removeExpiredSessions(now)
+	sm.sessions[session.ID] = session
+	sm.lock.Unlock()
+
+	c.SetCookie(&http.Cookie{
+		Name:     sm.cookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return session
+}
+
+// GetSession returns the (non-expired) session referenced by the session cookie of the request, if any
+func (sm *SessionManager) GetSession(c echo.Context) *Session {
+	cookie, err := c.Cookie(sm.cookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	session := sm.sessions[cookie.Value]
+	if session == nil || time.Now().After(session.ExpiresAt) {
+		return nil
+	}
+	return session
+}
+
+// DestroySession removes the session referenced by the session cookie of the request and clears the cookie
+func (sm *SessionManager) DestroySession(c echo.Context) *Session {
+	session := sm.GetSession(c)
+	if session != nil {
+		sm.lock.Lock()
+		delete(sm.sessions, session.ID)
+		sm.lock.Unlock()
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     sm.cookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return session
+}
+
+// removes all sessions that have expired, must be called with the write lock held
+func (sm *SessionManager) removeExpiredSessions(now time.Time) {
+	for id, session := range sm.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(sm.sessions, id)
+		}
+	}
+}
+
+// creates a random, url safe token with the given amount of entropy bytes
+func randomToken(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
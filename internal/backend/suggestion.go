@@ -0,0 +1,403 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	mutexSync "sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	suggestionsFileExtension = ".suggestions.json"
+
+	// SuggestionAccepted the suggested change has been applied to the document
+	SuggestionAccepted = "accepted"
+	// SuggestionRejected the suggested change has been discarded
+	SuggestionRejected = "rejected"
+	// SuggestionWithdrawn the author has undone the suggested change
+	SuggestionWithdrawn = "withdrawn"
+)
+
+type (
+	// Suggestion is a change of a document proposed by a client in suggestion mode,
+	// it is only applied to the document once it has been accepted
+	Suggestion struct {
+		Id         string `json:"id" xml:"id" form:"id" query:"id"`
+		DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		Author     string `json:"author" xml:"author" form:"author" query:"author"`
+		// id of the client connection the suggestion has been made with
+		ClientId string `json:"clientId" xml:"clientId" form:"clientId" query:"clientId"`
+		// range of the replaced text in the document, moved along with the edits of the document
+		Range       TextSelection `json:"range" xml:"range" form:"range" query:"range"`
+		Original    string        `json:"original" xml:"original" form:"original" query:"original"`
+		Replacement string        `json:"replacement" xml:"replacement" form:"replacement" query:"replacement"`
+		// the change as diff-match-patch patch of the document
+		Diff      string    `json:"diff" xml:"diff" form:"diff" query:"diff"`
+		CreatedAt time.Time `json:"createdAt" xml:"createdAt" form:"createdAt" query:"createdAt"`
+		UpdatedAt time.Time `json:"updatedAt" xml:"updatedAt" form:"updatedAt" query:"updatedAt"`
+	}
+
+	// SuggestionMessage tells the clients of a document about a created, changed or removed suggestion
+	SuggestionMessage struct {
+		Type         string `json:"type" xml:"type" form:"type" query:"type"`
+		RequestId    string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+		DocumentId   string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+		SuggestionId string `json:"suggestionId" xml:"suggestionId" form:"suggestionId" query:"suggestionId"`
+		// the current state of the suggestion, not set if it has been removed
+		Suggestion *Suggestion `json:"suggestion,omitempty" xml:"suggestion,omitempty" form:"suggestion" query:"suggestion"`
+		// why the suggestion has been removed: "accepted", "rejected" or "withdrawn"
+		Resolution string `json:"resolution,omitempty" xml:"resolution,omitempty" form:"resolution" query:"resolution"`
+	}
+)
+
+var (
+	errSuggestionNotFound = errors.New("suggestion not found")
+	errSuggestionConflict = errors.New("the suggested text has been changed in the meantime")
+)
+
+// SuggestionManager stores the pending suggestions of all documents in the state directory
+type SuggestionManager struct {
+	stateDir string
+
+	lock mutexSync.Mutex
+	// suggestions document id -> pending suggestions of the document, loaded on first access
+	suggestions map[string][]*Suggestion
+
+	resolveAnchor func(documentId string, anchor TextAnchor) (TextAnchor, error)
+	onChanged     func(message SuggestionMessage)
+}
+
+func NewSuggestionManager(stateDir string) *SuggestionManager {
+	return &SuggestionManager{
+		stateDir:    stateDir,
+		suggestions: make(map[string][]*Suggestion),
+	}
+}
+
+// returns the path of the suggestions file of the given document
+func (sg *SuggestionManager) suggestionsPath(documentId string) string {
+	return filepath.Join(sg.stateDir, documentId+suggestionsFileExtension)
+}
+
+// GetSuggestions returns all pending suggestions of the given document in the order of their position,
+// with their ranges moved to the current version of the document
+func (sg *SuggestionManager) GetSuggestions(documentId string) ([]Suggestion, error) {
+	sg.lock.Lock()
+	suggestions, err := sg.loadLocked(documentId)
+	if err != nil {
+		sg.lock.Unlock()
+		return nil, err
+	}
+	result := make([]Suggestion, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		result = append(result, *suggestion)
+	}
+	sg.lock.Unlock()
+
+	for i := range result {
+		result[i].Range = sg.resolveRange(documentId, result[i].Range)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Range.Anchor.Index < result[j].Range.Anchor.Index
+	})
+	return result, nil
+}
+
+// GetSuggestion returns the pending suggestion with the given id
+func (sg *SuggestionManager) GetSuggestion(documentId string, suggestionId string) (Suggestion, error) {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	suggestions, err := sg.loadLocked(documentId)
+	if err != nil {
+		return Suggestion{}, err
+	}
+	for _, suggestion := range suggestions {
+		if suggestion.Id == suggestionId {
+			return *suggestion, nil
+		}
+	}
+	return Suggestion{}, errSuggestionNotFound
+}
+
+// GetClientSuggestions returns the pending suggestions made by the given client
+func (sg *SuggestionManager) GetClientSuggestions(documentId string, clientId string) ([]Suggestion, error) {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	suggestions, err := sg.loadLocked(documentId)
+	if err != nil {
+		return nil, err
+	}
+	var result []Suggestion
+	for _, suggestion := range suggestions {
+		if suggestion.ClientId == clientId {
+			result = append(result, *suggestion)
+		}
+	}
+	return result, nil
+}
+
+// UpdateClientSuggestions replaces the suggestions of the given client with the given changes of the document,
+// which refer to the document version with the given heads,
+// a change that overlaps a previous suggestion of the client keeps its id, suggestions without a change are withdrawn
+func (sg *SuggestionManager) UpdateClientSuggestions(
+	client *WebsocketClient,
+	heads []string,
+	text string,
+	changes []TextChange,
+	resolve func(anchor TextAnchor) TextAnchor,
+) error {
+	documentId := client.DocumentId()
+
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	suggestions, err := sg.loadLocked(documentId)
+	if err != nil {
+		return err
+	}
+
+	var updated []*Suggestion
+	var messages []SuggestionMessage
+	// previous suggestions of the client that have not been matched with a change yet
+	previous := make(map[*Suggestion]TextSelection)
+	for _, suggestion := range suggestions {
+		if suggestion.ClientId != client.Id {
+			updated = append(updated, suggestion)
+			continue
+		}
+		previous[suggestion] = TextSelection{
+			Anchor: resolve(suggestion.Range.Anchor),
+			Head:   resolve(suggestion.Range.Head),
+		}
+	}
+
+	now := time.Now()
+	for _, change := range changes {
+		end := change.Index + utf8.RuneCountInString(change.Original)
+
+		var suggestion *Suggestion
+		for candidate, selection := range previous {
+			if change.Index <= selection.Head.Index && selection.Anchor.Index <= end {
+				suggestion = candidate
+				delete(previous, candidate)
+				break
+			}
+		}
+		if suggestion == nil {
+			suggestion = &Suggestion{
+				Id:         randomToken(12),
+				DocumentId: documentId,
+				Author:     client.User.Name,
+				ClientId:   client.Id,
+				CreatedAt:  now,
+			}
+		} else if suggestion.Original == change.Original && suggestion.Replacement == change.Replacement {
+			// only moved along with other changes of the document
+			suggestion.Range = newTextSelection(heads, change.Index, end)
+			updated = append(updated, suggestion)
+			continue
+		}
+
+		suggestion.Range = newTextSelection(heads, change.Index, end)
+		suggestion.Original = change.Original
+		suggestion.Replacement = change.Replacement
+		suggestion.UpdatedAt = now
+		suggestion.Diff, err = CreatePatch(text, ApplyTextChanges(text, []TextChange{change}))
+		if err != nil {
+			return err
+		}
+		updated = append(updated, suggestion)
+
+		current := *suggestion
+		messages = append(messages, SuggestionMessage{
+			Type:         TypeSuggestion,
+			DocumentId:   documentId,
+			SuggestionId: suggestion.Id,
+			Suggestion:   &current,
+		})
+	}
+	for suggestion := range previous {
+		messages = append(messages, SuggestionMessage{
+			Type:         TypeSuggestionRemoved,
+			DocumentId:   documentId,
+			SuggestionId: suggestion.Id,
+			Resolution:   SuggestionWithdrawn,
+		})
+	}
+
+	if len(messages) <= 0 {
+		// the stored ranges can still be resolved, so there is nothing to write
+		sg.suggestions[documentId] = updated
+		return nil
+	}
+	err = sg.saveLocked(documentId, updated)
+	if err != nil {
+		return err
+	}
+	sg.notifyChanged(messages)
+	return nil
+}
+
+// RemoveSuggestion removes the given suggestion after it has been accepted or rejected
+func (sg *SuggestionManager) RemoveSuggestion(documentId string, suggestionId string, resolution string) error {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	suggestions, err := sg.loadLocked(documentId)
+	if err != nil {
+		return err
+	}
+
+	for i, suggestion := range suggestions {
+		if suggestion.Id != suggestionId {
+			continue
+		}
+		err = sg.saveLocked(documentId, append(suggestions[:i:i], suggestions[i+1:]...))
+		if err != nil {
+			return err
+		}
+		sg.notifyChanged([]SuggestionMessage{{
+			Type:         TypeSuggestionRemoved,
+			DocumentId:   documentId,
+			SuggestionId: suggestionId,
+			Resolution:   resolution,
+		}})
+		return nil
+	}
+	return errSuggestionNotFound
+}
+
+// RemoveSuggestions removes all suggestions of the given document, e.g. after it has been deleted
+func (sg *SuggestionManager) RemoveSuggestions(documentId string) {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	delete(sg.suggestions, documentId)
+	err := os.Remove(sg.suggestionsPath(documentId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Unable to remove suggestions of document %s: %v", documentId, err)
+	}
+}
+
+// RelocateSuggestions moves all suggestions of a document to its new id, e.g. after the document has been renamed
+func (sg *SuggestionManager) RelocateSuggestions(oldId string, newId string) error {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+
+	suggestions, err := sg.loadLocked(oldId)
+	if err != nil {
+		return err
+	}
+	for _, suggestion := range suggestions {
+		suggestion.DocumentId = newId
+	}
+	err = sg.saveLocked(newId, suggestions)
+	if err != nil {
+		return err
+	}
+	delete(sg.suggestions, oldId)
+	err = os.Remove(sg.suggestionsPath(oldId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// returns the suggestions of the given document, reading them from disk if necessary,
+// must be called with the lock held
+func (sg *SuggestionManager) loadLocked(documentId string) ([]*Suggestion, error) {
+	if suggestions, ok := sg.suggestions[documentId]; ok {
+		return suggestions, nil
+	}
+
+	var suggestions []*Suggestion
+	data, err := os.ReadFile(sg.suggestionsPath(documentId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &suggestions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sg.suggestions[documentId] = suggestions
+	return suggestions, nil
+}
+
+// writes the given suggestions of a document to disk, must be called with the lock held
+func (sg *SuggestionManager) saveLocked(documentId string, suggestions []*Suggestion) error {
+	if len(suggestions) <= 0 {
+		err := os.Remove(sg.suggestionsPath(documentId))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		sg.suggestions[documentId] = suggestions
+		return nil
+	}
+
+	data, err := json.Marshal(suggestions)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(sg.suggestionsPath(documentId), data, 0600)
+	if err != nil {
+		return err
+	}
+	sg.suggestions[documentId] = suggestions
+	return nil
+}
+
+// moves the given range to the current version of the document, if a resolver is set
+func (sg *SuggestionManager) resolveRange(documentId string, selection TextSelection) TextSelection {
+	if sg.resolveAnchor == nil {
+		return selection
+	}
+	resolved := selection
+	var err error
+	if resolved.Anchor, err = sg.resolveAnchor(documentId, selection.Anchor); err != nil {
+		log.Printf("Unable to resolve suggestion range in document %s: %v", documentId, err)
+		return selection
+	}
+	if resolved.Head, err = sg.resolveAnchor(documentId, selection.Head); err != nil {
+		log.Printf("Unable to resolve suggestion range in document %s: %v", documentId, err)
+		return selection
+	}
+	return resolved
+}
+
+// passes the given messages on to the listener
+func (sg *SuggestionManager) notifyChanged(messages []SuggestionMessage) {
+	if sg.onChanged == nil {
+		return
+	}
+	for _, message := range messages {
+		sg.onChanged(message)
+	}
+}
+
+// SetAnchorResolver sets the function used to move text anchors to the current version of a document
+func (sg *SuggestionManager) SetAnchorResolver(f func(documentId string, anchor TextAnchor) (TextAnchor, error)) {
+	sg.resolveAnchor = f
+}
+
+// SetOnSuggestionChangedListener sets the listener that is notified whenever a suggestion has been created, changed or removed
+func (sg *SuggestionManager) SetOnSuggestionChangedListener(f func(message SuggestionMessage)) {
+	sg.onChanged = f
+}
+
+// creates a text range between the given positions of the document version with the given heads
+func newTextSelection(heads []string, start int, end int) TextSelection {
+	return TextSelection{
+		Anchor: TextAnchor{Heads: heads, Index: start},
+		Head:   TextAnchor{Heads: heads, Index: end},
+	}
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSuggestion(t *testing.T) {
+	contributor := &User{Name: "john", Roles: []string{RoleContributor}}
+
+	tests := []struct {
+		name   string
+		accept bool
+		// the author disconnects before the suggestion is resolved, so the document is not open anymore
+		disconnected bool
+		expected     string
+	}{
+		{name: "accept", accept: true, expected: "Hello there\n"},
+		{name: "reject", accept: false, expected: "Hello world\n"},
+		{name: "accept without clients", accept: true, disconnected: true, expected: "Hello there\n"},
+		{name: "reject without clients", accept: false, disconnected: true, expected: "Hello world\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupSync(t, map[string]string{"a.md": "Hello world\n"})
+			documentId := s.documentId("a.md")
+			author := s.connect(t, documentId, contributor, ModeSuggest)
+
+			author.replace("world", "there")
+			if err := author.sync(); err != nil {
+				t.Fatal(err)
+			}
+			suggestions, err := s.suggestionManager.GetSuggestions(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(suggestions) != 1 || suggestions[0].Original != "world" || suggestions[0].Replacement != "there" ||
+				suggestions[0].Author != contributor.Name {
+				t.Fatalf("unexpected suggestions %+v", suggestions)
+			}
+			if content, _ := s.syncManager.readContent(documentId); content != "Hello world\n" {
+				t.Fatalf("the suggestion has changed the shared document: %q", content)
+			}
+
+			if tt.disconnected {
+				author.disconnect()
+			}
+			if tt.accept {
+				err = s.syncManager.AcceptSuggestion(testEditor, documentId, suggestions[0].Id)
+			} else {
+				err = s.syncManager.RejectSuggestion(documentId, suggestions[0].Id)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			suggestions, err = s.suggestionManager.GetSuggestions(documentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(suggestions) != 0 {
+				t.Fatalf("the suggestion has not been removed: %+v", suggestions)
+			}
+			if content, _ := s.syncManager.readContent(documentId); content != tt.expected {
+				t.Fatalf("expected shared document %q, got %q", tt.expected, content)
+			}
+
+			if !tt.disconnected {
+				// the fork of the author only contains the remaining suggestions
+				if err = author.sync(); err != nil {
+					t.Fatal(err)
+				}
+				if author.content() != tt.expected {
+					t.Fatalf("expected fork %q, got %q", tt.expected, author.content())
+				}
+				return
+			}
+
+			s.syncManager.documentsLock.Lock()
+			_, open := s.syncManager.documents[documentId]
+			_, actors := s.syncManager.serverActors[documentId]
+			s.syncManager.documentsLock.Unlock()
+			if open || actors {
+				t.Fatalf("the document has been kept in memory after resolving the suggestion")
+			}
+			s.persister.Flush(documentId)
+			content, err := os.ReadFile(filepath.Join(s.docsPath, "a.md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.expected {
+				t.Fatalf("expected file content %q, got %q", tt.expected, content)
+			}
+		})
+	}
+}
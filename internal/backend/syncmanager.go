@@ -4,7 +4,6 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"golang.org/x/text/encoding/unicode"
 	"log"
 	"strings"
@@ -30,26 +29,58 @@ type (
 
 type SyncManager interface {
 	IsItemBeingEditedRecursive(s *Section) (err error)
+	// AcceptSuggestion applies a pending suggestion to the given document on behalf of the given user
+	AcceptSuggestion(user *User, documentId string, suggestionId string) error
+	// RejectSuggestion discards a pending suggestion of the given document
+	RejectSuggestion(documentId string, suggestionId string) error
+	// GetChanges returns the change history of the given document
+	GetChanges(documentId string) ([]DocumentChange, error)
+	// GetContentAt returns the content of the given document at the version with the given heads
+	GetContentAt(documentId string, heads []string) (string, error)
+	// GetDiff returns the differences between two versions of the given document
+	GetDiff(documentId string, from []string, to []string) (DocumentDiff, error)
+	// GetBlame returns the text of the given document annotated with the changes that have inserted it
+	GetBlame(documentId string) ([]BlameSpan, error)
+	// MoveItem renames or moves the item at the given path using the given function, which returns its new path,
+	// and moves the editing sessions of all documents within it to their new ids
+	MoveItem(oldPath string, move func() (string, error)) error
+	// RemoveDocument discards the editing state and the history of a deleted document
+	RemoveDocument(documentId string)
+}
+
+// SharedDocumentState holds the authoritative content of the documents, which is shared by all sync strategies
+type SharedDocumentState interface {
+	// GetContent returns the current content of the given document
+	GetContent(documentId string) (string, error)
+	// UpdateContent changes the content of the given document using the given function
+	// and passes the change on to all other clients of the document
+	UpdateContent(client *WebsocketClient, documentId string, update func(content string) (string, error)) error
 }
 
 // DSSyncManager manages processing of EditRequests from clients
 type DSSyncManager struct {
 	treeManager                *TreeManager
 	websocketConnectionManager *WebsocketConnectionManager
+	sharedState                SharedDocumentState
+	lockManager                *LockManager
 
-	// ServerShadows client connection -> server shadow
-	ServerShadows map[*websocket.Conn]string
+	// ServerShadows client -> server shadow
+	ServerShadows map[*WebsocketClient]string
 
-	// lock for synchronizing the tree to the disk
-	lock mutexSync.RWMutex
+	// lock for the server shadows
+	lock mutexSync.Mutex
 }
 
 func NewSyncManager(
 	treeManager *TreeManager,
+	sharedState SharedDocumentState,
+	lockManager *LockManager,
 ) *DSSyncManager {
 	syncManager := &DSSyncManager{
 		treeManager:   treeManager,
-		ServerShadows: make(map[*websocket.Conn]string),
+		sharedState:   sharedState,
+		lockManager:   lockManager,
+		ServerShadows: make(map[*WebsocketClient]string),
 	}
 
 	return syncManager
@@ -73,26 +104,57 @@ func (sm *DSSyncManager) IsItemBeingEditedRecursive(s *Section) (err error) {
 }
 
 // sets the initial server shadow for a new client connection
-func (sm *DSSyncManager) initClient(conn *websocket.Conn, shadowContent string) {
+func (sm *DSSyncManager) initClient(conn *WebsocketClient, shadowContent string) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
 	sm.ServerShadows[conn] = shadowContent
 }
 
 // removes the shadow for the given client
-func (sm *DSSyncManager) removeClient(conn *websocket.Conn) {
+func (sm *DSSyncManager) removeClient(conn *WebsocketClient) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
 	delete(sm.ServerShadows, conn)
 }
 
+// moves the shadow of the previous connection of a client to its new connection
+// and sends it the changes it has missed in the meantime
+func (sm *DSSyncManager) resumeClient(previous *WebsocketClient, client *WebsocketClient, document *Document) error {
+	sm.lock.Lock()
+	shadow, ok := sm.ServerShadows[previous]
+	delete(sm.ServerShadows, previous)
+	if !ok {
+		sm.lock.Unlock()
+		return sm.sendInitialTextResponse(client, document)
+	}
+	sm.ServerShadows[client] = shadow
+	defer sm.lock.Unlock()
+	return sm.sendEditRequestResponse(client, document.ID, "")
+}
+
 // handles incoming edit requests from the client
-func (sm *DSSyncManager) handleEditRequest(client *websocket.Conn, editRequest EditRequest) (err error) {
-	documentId := editRequest.DocumentId
+func (sm *DSSyncManager) handleEditRequest(client *WebsocketClient, editRequest EditRequest) (err error) {
+	documentId := client.DocumentId()
 
+	err = sm.lockManager.CheckEdit(client.User, documentId)
+	if err != nil {
+		// the client has already applied the rejected edit to its own text, so it has to start over
+		resyncErr := sm.sendInitialTextResponse(client, sm.treeManager.GetDocument(documentId))
+		if resyncErr != nil {
+			log.Printf("%v: unable to resync with client: %v", client.RemoteAddr, resyncErr)
+		}
+		return &messageError{code: ErrorCodeLocked, requestId: editRequest.RequestId, err: err}
+	}
+
+	sm.lock.Lock()
 	// check if the server shadow matches the client shadow before the patch has been applied
 	checksum := sm.calculateChecksum(sm.ServerShadows[client])
 	if checksum != editRequest.ShadowChecksum {
-		log.Printf("%v: shadow out of sync (got %v but expected %v", client.RemoteAddr(), editRequest.ShadowChecksum, checksum)
+		sm.lock.Unlock()
+		log.Printf("%v: shadow out of sync (got %v but expected %v", client.RemoteAddr, editRequest.ShadowChecksum, checksum)
 		err = sm.sendInitialTextResponse(client, sm.treeManager.GetDocument(documentId)) // force resync
 		if err != nil {
-			log.Printf("%v: unable to resync with client: %v", client.RemoteAddr(), err)
+			log.Printf("%v: unable to resync with client: %v", client.RemoteAddr, err)
 			return err
 		}
 		return
@@ -100,64 +162,93 @@ func (sm *DSSyncManager) handleEditRequest(client *websocket.Conn, editRequest E
 
 	// patch the server shadow
 	sm.ServerShadows[client], err = ApplyPatch(sm.ServerShadows[client], editRequest.Patches)
+	sm.lock.Unlock()
 
-	// then patch the server document version
-	d := sm.treeManager.GetDocument(documentId)
-	patchedText, err := ApplyPatch(d.Content, editRequest.Patches)
+	// then patch the shared document version
+	err = sm.sharedState.UpdateContent(client, documentId, func(content string) (string, error) {
+		return ApplyPatch(content, editRequest.Patches)
+	})
 	if err != nil {
 		// if fuzzy patch fails, drop client changes
-		log.Printf("%v: fuzzy patch failed: %v", client.RemoteAddr(), err)
+		log.Printf("%v: fuzzy patch failed: %v", client.RemoteAddr, err)
 		// reset err variable as we can recover from this error
 		err = nil
-	} else {
-		if d.Content != patchedText {
-			defer sm.saveCurrentDocumentContent(documentId)
-		}
-		d.Content = patchedText
 	}
 
-	err = sm.sendEditRequestResponse(client, documentId)
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	err = sm.sendEditRequestResponse(client, documentId, editRequest.RequestId)
 	if err != nil {
-		log.Printf("%v: error sending response: %v", client.RemoteAddr(), err)
+		log.Printf("%v: error sending response: %v", client.RemoteAddr, err)
 		return err
 	}
 
 	return err
 }
 
+// HandleContentChanged passes a change of the shared document on to all diff-sync clients of the document, except the one it originates from
+func (sm *DSSyncManager) HandleContentChanged(origin *WebsocketClient, documentId string) {
+	for _, client := range sm.websocketConnectionManager.GetClientsForDocument(documentId) {
+		if client == origin || client.Protocol != ProtocolDiffSync {
+			continue
+		}
+
+		sm.lock.Lock()
+		err := sm.sendEditRequestResponse(client, documentId, "")
+		sm.lock.Unlock()
+		if err != nil {
+			log.Printf("%v: error sending changes: %v", client.RemoteAddr, err)
+		}
+	}
+}
+
 // send the full document text to a client
-func (sm *DSSyncManager) sendInitialTextResponse(client *websocket.Conn, document *Document) (err error) {
+func (sm *DSSyncManager) sendInitialTextResponse(client *WebsocketClient, document *Document) (err error) {
+	content, err := sm.sharedState.GetContent(document.ID)
+	if err != nil {
+		return err
+	}
+
 	// set initial state in backend
-	sm.initClient(client, document.Content)
+	sm.initClient(client, content)
 
 	// Write current document state to the client
-	err = client.WriteJSON(InitialContentRequest{
+	err = sm.websocketConnectionManager.writeJSON(client, InitialContentRequest{
 		Type:       TypeInitialContent,
 		DocumentId: document.ID,
 		RequestId:  "",
-		Content:    document.Content,
+		Content:    content,
 	})
 	if err != nil {
-		log.Printf("%v: error writing initial content response: %v", client.RemoteAddr(), err)
+		log.Printf("%v: error writing initial content response: %v", client.RemoteAddr, err)
 		return err
 	}
 
 	return
 }
 
-// responds to a client with the changes from the server site document version
-func (sm *DSSyncManager) sendEditRequestResponse(client *websocket.Conn, documentId string) (err error) {
-	d := sm.treeManager.GetDocument(documentId)
+// responds to a client with the changes from the server site document version,
+// the response carries the id of the request it answers, if any,
+// must be called with the lock held
+func (sm *DSSyncManager) sendEditRequestResponse(client *WebsocketClient, documentId string, requestId string) (err error) {
+	content, err := sm.sharedState.GetContent(documentId)
+	if err != nil {
+		return err
+	}
 
-	shadow := sm.ServerShadows[client]
+	shadow, ok := sm.ServerShadows[client]
+	if !ok {
+		// the client has disconnected in the meantime
+		return nil
+	}
 	shadowChecksum := sm.calculateChecksum(shadow)
 
-	patches, err := CreatePatch(shadow, d.Content)
+	patches, err := CreatePatch(shadow, content)
 	if err != nil {
 		log.Printf("Error creating patch: %v", err)
 		return err
 	}
-	sm.ServerShadows[client] = d.Content
+	sm.ServerShadows[client] = content
 
 	// we can skip this if there are no changes that need to be passed to the client
 	if len(patches) <= 0 {
@@ -167,7 +258,7 @@ func (sm *DSSyncManager) sendEditRequestResponse(client *websocket.Conn, documen
 	return sm.websocketConnectionManager.sendToClient(client,
 		EditRequest{
 			Type:           TypeEditRequest,
-			RequestId:      "",
+			RequestId:      requestId,
 			DocumentId:     documentId,
 			Patches:        patches,
 			ShadowChecksum: shadowChecksum,
@@ -193,42 +284,32 @@ func (sm *DSSyncManager) calculateChecksum(text string) string {
 	return strings.ToLower(checksum)
 }
 
-func (sm *DSSyncManager) saveCurrentDocumentContent(documentId string) {
-	sm.lock.RLock()
-	defer sm.lock.RUnlock()
-
-	log.Printf("Synchronizing document '%s' synchronized to disk", documentId)
-
-	d := sm.treeManager.GetDocument(documentId)
-	if d == nil {
-		log.Printf("Unable to write document content for document %s: Document was nil", documentId)
-		return
-	}
-
-	err := WriteFile(d.Path, []byte(d.Content))
-	if err != nil {
-		log.Printf("Unable to write modified document content for document %s: %v", documentId, err)
-	}
-
-	log.Printf("Document '%s' synchronized to disk successfully", documentId)
-}
-
 func (sm *DSSyncManager) SetWebsocketConnectionManager(manager *WebsocketConnectionManager) {
 	sm.websocketConnectionManager = manager
 
-	sm.websocketConnectionManager.SetOnNewClientListener(func(client *websocket.Conn, document *Document) error {
+	sm.websocketConnectionManager.AddOnNewClientListener(func(client *WebsocketClient, document *Document) error {
+		if client.Protocol != ProtocolDiffSync {
+			return nil
+		}
 		fmt.Println("New client connected", client)
 		return sm.sendInitialTextResponse(client, document)
 	})
-	sm.websocketConnectionManager.SetOnIncomingEditRequestMessageListener(func(client *websocket.Conn, request EditRequest) error {
+	sm.websocketConnectionManager.AddOnClientResumedListener(func(previous *WebsocketClient, client *WebsocketClient, document *Document) error {
+		if client.Protocol != ProtocolDiffSync {
+			return nil
+		}
+		fmt.Println("Client resumed", client)
+		return sm.resumeClient(previous, client, document)
+	})
+	sm.websocketConnectionManager.SetOnIncomingEditRequestMessageListener(func(client *WebsocketClient, request EditRequest) error {
 		fmt.Println("Incoming message from client", client)
 		return sm.handleEditRequest(client, request)
 	})
-	sm.websocketConnectionManager.SetOnClientDisconnectedListener(func(client *websocket.Conn, documentId string, remainingConnections uint) {
+	sm.websocketConnectionManager.AddOnClientDisconnectedListener(func(client *WebsocketClient, documentId string, remainingConnections uint) {
+		if client.Protocol != ProtocolDiffSync {
+			return
+		}
 		fmt.Println("Client disconnected", client)
 		sm.removeClient(client)
-		if remainingConnections <= 0 {
-			sm.saveCurrentDocumentContent(documentId)
-		}
 	})
 }
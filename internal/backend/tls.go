@@ -0,0 +1,234 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	mutexSync "sync"
+	"time"
+)
+
+const (
+	selfSignedCertificateValidity = 365 * 24 * time.Hour
+)
+
+// CertificateLoader provides the server certificate and reloads it when the certificate files change
+type CertificateLoader struct {
+	certFile string
+	keyFile  string
+
+	lock        mutexSync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func NewCertificateLoader(certFile string, keyFile string) (*CertificateLoader, error) {
+	cl := &CertificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cl.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cl *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := cl.reloadIfChanged(); err != nil {
+		// keep serving the previous certificate, the files may be in the middle of being replaced
+		log.Printf("Unable to reload TLS certificate: %v", err)
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.certificate, nil
+}
+
+// loads the certificate files if they have been modified since they were loaded the last time
+func (cl *CertificateLoader) reloadIfChanged() error {
+	certInfo, err := os.Stat(cl.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cl.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.certificate != nil && certInfo.ModTime().Equal(cl.certModTime) && keyInfo.ModTime().Equal(cl.keyModTime) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return err
+	}
+	if cl.certificate != nil {
+		log.Printf("Reloaded TLS certificate from %s", cl.certFile)
+	}
+
+	cl.certificate = &certificate
+	cl.certModTime = certInfo.ModTime()
+	cl.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// creates the TLS configuration of the server based on the given configuration
+func createTLSConfig(tlsConf configuration.TLSConfiguration, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if tlsConf.CertFile != "" && tlsConf.KeyFile != "" {
+		if tlsConf.SelfSigned {
+			if err := ensureSelfSignedCertificate(tlsConf.CertFile, tlsConf.KeyFile, host); err != nil {
+				return nil, err
+			}
+		}
+
+		certificateLoader, err := NewCertificateLoader(tlsConf.CertFile, tlsConf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+		tlsConfig.GetCertificate = certificateLoader.GetCertificate
+	} else {
+		// no files configured, so the self-signed certificate only lives as long as the process
+		certPEM, keyPEM, err := generateSelfSignedCertificate(host)
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if tlsConf.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(tlsConf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA file: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("client CA file does not contain any PEM encoded certificates")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// writes a new self-signed certificate to the given files, unless the certificate file already exists
+func ensureSelfSignedCertificate(certFile string, keyFile string, host string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+
+	log.Printf("Generating self-signed TLS certificate %s", certFile)
+	certPEM, keyPEM, err := generateSelfSignedCertificate(host)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+// generates a self-signed certificate for the given host (and localhost) in PEM format
+func generateSelfSignedCertificate(host string) (certPEM []byte, keyPEM []byte, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"mkdocsrest"}, CommonName: "mkdocsrest self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsUnspecified() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	} else if host != "" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// creates a plain HTTP server that redirects all requests to the HTTPS port
+func createHttpsRedirectServer(host string, redirectPort int, httpsPort int) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(host, strconv.Itoa(redirectPort)),
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			targetHost, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				targetHost = r.Host
+			}
+			target := "https://" + net.JoinHostPort(targetHost, strconv.Itoa(httpsPort)) + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		}),
+	}
+}
+
+// returns the user identified by the verified client certificate of the given request, if any
+func userFromClientCertificate(r *http.Request) *User {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) <= 0 || len(r.TLS.VerifiedChains[0]) <= 0 {
+		return nil
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	return &User{
+		Name:  name,
+		Roles: []string{configuration.CurrentConfig.Server.TLS.ClientCertRole},
+	}
+}
@@ -78,6 +78,11 @@ func NewTreeManager() *TreeManager {
 func (tm *TreeManager) CreateItemTree() {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
+	tm.createItemTreeLocked()
+}
+
+// rebuilds the item tree, must be called with the lock held
+func (tm *TreeManager) createItemTreeLocked() {
 	path, file := filepath.Split(tm.rootPath)
 
 	tm.DocumentTree = tm.createSectionForTree(path, file, "root")
@@ -157,6 +162,15 @@ func (tm *TreeManager) createSectionForTree(path string, name string, id string)
 	}
 }
 
+// RelativePath returns the given path relative to the docs directory
+func (tm *TreeManager) RelativePath(path string) string {
+	relativePath, err := filepath.Rel(tm.rootPath, path)
+	if err != nil {
+		return path
+	}
+	return relativePath
+}
+
 // generates an item id from its path
 func (tm *TreeManager) generateId(path string) string {
 	return tm.createHash(path)
@@ -225,6 +239,29 @@ func (tm *TreeManager) GetDocument(id string) *Document {
 	return tm.findDocumentRecursive(&tm.DocumentTree, id)
 }
 
+// GetDocumentContent returns the content of the document with the given id, false if there is no such document
+func (tm *TreeManager) GetDocumentContent(id string) (string, bool) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	d := tm.findDocumentRecursive(&tm.DocumentTree, id)
+	if d == nil {
+		return "", false
+	}
+	return d.Content, true
+}
+
+// SetDocumentContent updates the content of the document with the given id, returns false if it has not changed
+func (tm *TreeManager) SetDocumentContent(id string, content string) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	d := tm.findDocumentRecursive(&tm.DocumentTree, id)
+	if d == nil || d.Content == content {
+		return false
+	}
+	d.Content = content
+	return true
+}
+
 // GetResource finds a resource with the given id in the document tree
 func (tm *TreeManager) GetResource(id string) *Resource {
 	tm.lock.Lock()
@@ -415,10 +452,18 @@ func (tm *TreeManager) CreateDocument(parentSectionId string, documentName strin
 	return &newDocumentTreeItem, err
 }
 
-func (tm *TreeManager) RenameSection(section *Section, name string) (sec *Section, err error) {
+// RenameSection renames the given section and moves it into the given parent section, if any
+func (tm *TreeManager) RenameSection(section *Section, parent *Section, name string) (sec *Section, err error) {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
-	var newFilePath = filepath.Join(filepath.Dir(section.Path), name)
+	var newFilePath = filepath.Join(targetDirectory(section.Path, parent), name)
+	if newFilePath == section.Path {
+		// renaming a section to its current name does not change anything
+		return section, nil
+	}
+	if isWithinPath(newFilePath, section.Path) {
+		return nil, errors.New("Section " + section.Name + " cannot be moved into itself!")
+	}
 	exists, err := tm.fileExists(newFilePath)
 	if exists {
 		return nil, errors.New("Target section " + section.Name + " already exists!")
@@ -429,17 +474,21 @@ func (tm *TreeManager) RenameSection(section *Section, name string) (sec *Sectio
 		return nil, err
 	}
 
-	tm.CreateItemTree()
-	section = tm.GetSection(tm.generateId(newFilePath))
+	tm.createItemTreeLocked()
+	section = tm.findSectionRecursive(&tm.DocumentTree, tm.generateId(newFilePath))
 
 	return section, err
 }
 
-func (tm *TreeManager) RenameDocument(document *Document, name string) (doc *Document, err error) {
+// RenameDocument renames the given document and moves it into the given parent section, if any
+func (tm *TreeManager) RenameDocument(document *Document, parent *Section, name string) (doc *Document, err error) {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
 	var fileName = name + markdownFileExtension
-	var newFilePath = filepath.Join(filepath.Dir(document.Path), fileName)
+	var newFilePath = filepath.Join(targetDirectory(document.Path, parent), fileName)
+	if newFilePath == document.Path {
+		return document, nil
+	}
 
 	exists, err := tm.fileExists(newFilePath)
 	if exists {
@@ -451,16 +500,20 @@ func (tm *TreeManager) RenameDocument(document *Document, name string) (doc *Doc
 		return nil, err
 	}
 
-	tm.CreateItemTree()
-	document = tm.GetDocument(tm.generateId(newFilePath))
+	tm.createItemTreeLocked()
+	document = tm.findDocumentRecursive(&tm.DocumentTree, tm.generateId(newFilePath))
 
 	return document, err
 }
 
-func (tm *TreeManager) RenameResource(resource *Resource, name string) (res *Resource, err error) {
+// RenameResource renames the given resource and moves it into the given parent section, if any
+func (tm *TreeManager) RenameResource(resource *Resource, parent *Section, name string) (res *Resource, err error) {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
-	var newFilePath = filepath.Join(filepath.Dir(resource.Path), name)
+	var newFilePath = filepath.Join(targetDirectory(resource.Path, parent), name)
+	if newFilePath == resource.Path {
+		return resource, nil
+	}
 	exists, err := tm.fileExists(newFilePath)
 	if exists {
 		return nil, errors.New("Target resource " + resource.Name + " already exists!")
@@ -471,12 +524,42 @@ func (tm *TreeManager) RenameResource(resource *Resource, name string) (res *Res
 		return nil, err
 	}
 
-	tm.CreateItemTree()
-	resource = tm.GetResource(tm.generateId(newFilePath))
+	tm.createItemTreeLocked()
+	resource = tm.findResourceRecursive(&tm.DocumentTree, tm.generateId(newFilePath))
 
 	return resource, err
 }
 
+// returns the directory an item at the given path is moved to: the given parent section or its current directory
+func targetDirectory(path string, parent *Section) string {
+	if parent == nil {
+		return filepath.Dir(path)
+	}
+	return parent.Path
+}
+
+// GetDocumentsWithin returns copies of the document at the given path or of all documents within the section at it
+func (tm *TreeManager) GetDocumentsWithin(path string) []Document {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	var documents []Document
+	tm.collectDocumentsRecursive(&tm.DocumentTree, path, &documents)
+	return documents
+}
+
+// traverses the tree and collects all documents at or within the given path
+func (tm *TreeManager) collectDocumentsRecursive(section *Section, path string, documents *[]Document) {
+	for _, document := range *section.Documents {
+		if isWithinPath(document.Path, path) {
+			*documents = append(*documents, *document)
+		}
+	}
+	for _, subsection := range *section.Subsections {
+		tm.collectDocumentsRecursive(subsection, path, documents)
+	}
+}
+
 func (tm *TreeManager) fileExists(filePath string) (exists bool, err error) {
 	if _, err := os.Stat(filePath); err == nil {
 		// path/to/whatever exists
@@ -488,34 +571,40 @@ func (tm *TreeManager) fileExists(filePath string) (exists bool, err error) {
 	}
 }
 
-// DeleteItem deletes a file/folder with the given ID and type from disk
-func (tm *TreeManager) DeleteItem(id string, itemType string) (success bool, err error) {
+// GetItemPath returns the path of the item with the given ID and type, or an empty string if it does not exist
+func (tm *TreeManager) GetItemPath(id string, itemType string) string {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
-	var path string
+	return tm.findItemPath(id, itemType)
+}
+
+// traverses the tree and searches for the path of the item with the given id and type
+func (tm *TreeManager) findItemPath(id string, itemType string) string {
 	switch itemType {
 	case TypeSection:
-		s := tm.findSectionRecursive(&tm.DocumentTree, id)
-		if s != nil {
-			path = s.Path
-		} else {
-			return false, nil
+		if s := tm.findSectionRecursive(&tm.DocumentTree, id); s != nil {
+			return s.Path
 		}
 	case TypeDocument:
-		d := tm.findDocumentRecursive(&tm.DocumentTree, id)
-		if d != nil {
-			path = d.Path
-		} else {
-			return false, nil
+		if d := tm.findDocumentRecursive(&tm.DocumentTree, id); d != nil {
+			return d.Path
 		}
 	case TypeResource:
-		r := tm.findResourceRecursive(&tm.DocumentTree, id)
-		if r != nil {
-			path = r.Path
-		} else {
-			return false, nil
+		if r := tm.findResourceRecursive(&tm.DocumentTree, id); r != nil {
+			return r.Path
 		}
 	}
+	return ""
+}
+
+// DeleteItem deletes a file/folder with the given ID and type from disk
+func (tm *TreeManager) DeleteItem(id string, itemType string) (success bool, err error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	path := tm.findItemPath(id, itemType)
+	if path == "" {
+		return false, nil
+	}
 
 	success, err = DeleteFileOrFolder(path)
 	if !success || err != nil {
@@ -1,115 +1,542 @@
 package backend
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/MkDocsEditor/MkDocsEditor-Backend/internal/configuration"
+	automerge "github.com/automerge/automerge-go"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	mutexSync "sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	TypeInitialContent = "initial-content"
 	TypeEditRequest    = "edit-request"
 	TypeSyncRequest    = "sync-request"
+
+	TypePresence        = "presence"
+	TypePresenceRemoved = "presence-removed"
+
+	TypeComment        = "comment"
+	TypeCommentRemoved = "comment-removed"
+
+	TypeSuggestion        = "suggestion"
+	TypeSuggestionRemoved = "suggestion-removed"
+
+	TypeFlush            = "flush"
+	TypePersistenceState = "persistence-state"
+
+	TypeError = "error"
+
+	TypeSession = "session"
+
+	TypeSubscribe    = "subscribe"
+	TypeUnsubscribe  = "unsubscribe"
+	TypeUnsubscribed = "unsubscribed"
+
+	TypeTreeEvent = "tree-event"
+
+	TypeDocumentMoved = "document-moved"
+
+	// ErrorCodeInvalidMessage the message could not be decoded
+	ErrorCodeInvalidMessage = "invalid-message"
+	// ErrorCodeUnsupportedMessage the message type is unknown or not supported by the sync protocol of the client
+	ErrorCodeUnsupportedMessage = "unsupported-message"
+	// ErrorCodeRequestFailed the message was valid, but could not be processed
+	ErrorCodeRequestFailed = "request-failed"
+	// ErrorCodeReadOnly the message would change the document, but the client is connected in view mode
+	ErrorCodeReadOnly = "read-only"
+	// ErrorCodeLocked the message would change the document, but another user holds an exclusive lock on it
+	ErrorCodeLocked = "locked"
+	// ErrorCodeNotSubscribed the message refers to a document the multiplexed connection is not subscribed to
+	ErrorCodeNotSubscribed = "not-subscribed"
+	// ErrorCodeForeignActor the message contains changes of an actor that belongs to another client or user
+	ErrorCodeForeignActor = "foreign-actor"
+	// ErrorCodeRateLimited the client sends more messages than allowed, the message has not been processed
+	ErrorCodeRateLimited = "rate-limited"
+
+	// ProtocolAutomerge clients exchange automerge sync messages
+	ProtocolAutomerge = "automerge"
+	// ProtocolDiffSync clients exchange diff-match-patch patches against a shadow copy of the document
+	ProtocolDiffSync = "diff-sync"
+
+	queryParamProtocol = "protocol"
+	queryParamResume   = "resume"
+	queryParamMode     = "mode"
+
+	// ModeEdit clients may change the document
+	ModeEdit = "edit"
+	// ModeView clients only follow the changes of the document
+	ModeView = "view"
+	// ModeSuggest clients edit their own copy of the document, their changes are stored as suggestions
+	ModeSuggest = "suggest"
+
+	// subprotocolV2 selects version 2 of the websocket protocol,
+	// optionally followed by the sync protocol, e.g. "v2.automerge"
+	subprotocolV2 = "v2"
+)
+
+const (
+	// ProtocolVersion1 clients send the type of a message and the message itself in two separate JSON frames
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 clients send a single envelope per frame, exchange sync payloads in binary frames
+	// and are told about requests that could not be processed
+	ProtocolVersion2 = 2
 )
 
+// WebsocketClient holds information about a single connected websocket client
+type WebsocketClient struct {
+	conn *websocket.Conn
+	// messages waiting to be written to the connection by the write pump
+	send chan outboundMessage
+	// closed when the connection is closed
+	done      chan struct{}
+	closeOnce mutexSync.Once
+	// time of the last message received from the client, in unix nanoseconds
+	lastMessage atomic.Int64
+	// number of messages received from the client and queued for it
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	// true if an administrator has disconnected the client, it may not resume its session then
+	disconnectedByAdmin atomic.Bool
+	// allows the client to resume its session after it lost the connection
+	resumeToken string
+	// removes the state of the client when it does not resume its session in time
+	resumeTimer *time.Timer
+	// true if the client closed the connection itself, so it will not resume its session
+	closedByClient bool
+	// multiplexed connection the client is a document channel of, nil for clients with their own connection,
+	// channels share the connection and the write pump of the multiplexed connection
+	connection *WebsocketClient
+	// document channels of a multiplexed connection (document id -> channel), guarded by the lock of the manager
+	channels map[string]*WebsocketClient
+	// id of the document the client is connected to, changes when the document is moved
+	// while the client is reading messages, use DocumentId and setDocumentId
+	documentId atomic.Value
+
+	// Id identifies the connection towards other clients
+	Id       string
+	Protocol string
+	// Version of the websocket protocol used by the client
+	Version int
+	// ReadOnly clients only follow the changes of the document and do not count as editors
+	ReadOnly bool
+	// Suggesting clients do not change the document, their changes are proposed as suggestions
+	Suggesting bool
+	// ActorId is the automerge actor the client should make its changes with, so they are attributed to its user,
+	// only set for automerge clients that may change the document
+	ActorId     string
+	User        *User
+	RemoteAddr  string
+	ConnectedAt time.Time
+}
+
 type WebsocketConnectionManager struct {
 	treeManager *TreeManager
+	rateLimits  *RateLimits
+	config      configuration.WebsocketConfiguration
 
 	upgrader websocket.Upgrader
 	lock     mutexSync.RWMutex
-	// connected clients (websocket -> document id)
-	clients                map[*websocket.Conn]string
+	// connected clients, including the document channels of multiplexed connections
+	clients map[*WebsocketClient]bool
+	// connected multiplexed connections, which are not bound to a single document
+	connections map[*WebsocketClient]bool
+	// connected editors (document id -> number of clients)
 	connectionsPerDocument map[string]uint
-
-	onNewClient          func(client *websocket.Conn, document *Document) error
-	onIncomingMessage    func(client *websocket.Conn, request EditRequest) error
-	onSyncRequest        func(client *websocket.Conn, request SyncRequest) error
-	onClientDisconnected func(client *websocket.Conn, documentId string, remainingConnections uint)
+	// connected read-only clients (document id -> number of clients)
+	viewersPerDocument map[string]uint
+	// disconnected clients that may still resume their session (resume token -> client)
+	suspended map[string]*WebsocketClient
+
+	// listeners of all sync strategies are notified about new and disconnected clients
+	onNewClient          []func(client *WebsocketClient, document *Document) error
+	onClientResumed      []func(previous *WebsocketClient, client *WebsocketClient, document *Document) error
+	onIncomingMessage    func(client *WebsocketClient, request EditRequest) error
+	onSyncRequest        func(client *WebsocketClient, request SyncRequest) error
+	onPresence           func(client *WebsocketClient, request PresenceRequest) error
+	onFlush              func(client *WebsocketClient, request FlushRequest) error
+	onClientDisconnected []func(client *WebsocketClient, documentId string, remainingConnections uint)
 }
 
 func NewWebsocketConnectionManager(
 	treeManager *TreeManager,
+	rateLimits *RateLimits,
 ) *WebsocketConnectionManager {
 	return &WebsocketConnectionManager{
 		treeManager: treeManager,
+		rateLimits:  rateLimits,
+		config:      configuration.CurrentConfig.Server.Websocket,
 
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
+			CheckOrigin:     checkWebsocketOrigin,
+			Subprotocols: []string{
+				ProtocolAutomerge,
+				ProtocolDiffSync,
+				subprotocolV2 + "." + ProtocolAutomerge,
+				subprotocolV2 + "." + ProtocolDiffSync,
+				subprotocolV2,
 			},
 		},
 		lock:                   mutexSync.RWMutex{},
-		clients:                make(map[*websocket.Conn]string), // connected clients (websocket -> document id)
+		clients:                make(map[*WebsocketClient]bool),
+		connections:            make(map[*WebsocketClient]bool),
 		connectionsPerDocument: make(map[string]uint),
+		viewersPerDocument:     make(map[string]uint),
+		suspended:              make(map[string]*WebsocketClient),
 	}
 }
 
+// only allows websocket connections from the origins that are allowed by the CORS configuration,
+// or from the same origin if none are configured
+func checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		// not a browser, so there is no session that could be abused
+		return true
+	}
+
+	var allowedOrigins = configuration.CurrentConfig.Server.CORS.AllowedOrigins
+	if len(allowedOrigins) <= 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsClientConnected returns true if an editor is connected to the given document, read-only clients are ignored
 func (wcm *WebsocketConnectionManager) IsClientConnected(documentId string) bool {
 	wcm.lock.RLock()
 	defer wcm.lock.RUnlock()
 	return wcm.connectionsPerDocument[documentId] > 0
 }
 
+// GetClientsForDocument returns all clients that are currently connected to the given document
+func (wcm *WebsocketConnectionManager) GetClientsForDocument(documentId string) []*WebsocketClient {
+	wcm.lock.RLock()
+	defer wcm.lock.RUnlock()
+
+	var result []*WebsocketClient
+	for client := range wcm.clients {
+		if client.DocumentId() == documentId {
+			result = append(result, client)
+		}
+	}
+	return result
+}
+
+// CloseDocumentConnections closes the connections of all clients of the given document with the given reason
+func (wcm *WebsocketConnectionManager) CloseDocumentConnections(documentId string, reason string) {
+	for _, client := range wcm.GetClientsForDocument(documentId) {
+		wcm.closeClient(client, websocket.CloseGoingAway, reason)
+	}
+}
+
 // handle new websocket connections
 func (wcm *WebsocketConnectionManager) HandleNewConnection(c echo.Context, documentId string) (err error) {
 	d := wcm.treeManager.GetDocument(documentId)
+	if d == nil {
+		// the document of a suspended session may have been moved while the client was disconnected
+		if movedId := wcm.suspendedDocumentId(c.QueryParam(queryParamResume)); movedId != "" {
+			documentId = movedId
+			d = wcm.treeManager.GetDocument(documentId)
+		}
+	}
 	if d == nil {
 		return echo.ErrNotFound
 	}
 
-	client, err := wcm.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	protocol := c.QueryParam(queryParamProtocol)
+	if protocol != "" && !isSupportedProtocol(protocol) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unsupported sync protocol: "+protocol)
+	}
+
+	mode := c.QueryParam(queryParamMode)
+	if mode != "" && mode != ModeEdit && mode != ModeView && mode != ModeSuggest {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unsupported mode: "+mode)
+	}
+	mode = allowedMode(getUser(c), mode)
+	if mode == ModeSuggest && protocol != "" && protocol != ProtocolAutomerge {
+		return echo.NewHTTPError(http.StatusBadRequest, "Suggestion mode requires the automerge protocol")
+	}
+
+	if allowed, retryAfter := wcm.rateLimits.AllowWebsocketConnection(c); !allowed {
+		return tooManyRequests(c, retryAfter)
+	}
+
+	conn, err := wcm.upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
+	conn.SetReadLimit(wcm.config.MaxMessageSize)
 
-	// Make sure we Close the connection when the function returns
-	defer wcm.disconnectClient(client)
+	version, subprotocol := parseSubprotocol(conn.Subprotocol())
+	if protocol == "" {
+		protocol = subprotocol
+	}
+	if protocol == "" {
+		protocol = configuration.CurrentConfig.Sync.DefaultProtocol
+	}
+	if mode == ModeSuggest && protocol != ProtocolAutomerge {
+		wcm.closeWithReason(conn, websocket.CloseUnsupportedData, "suggestion mode requires the automerge protocol")
+		return nil
+	}
+
+	client := &WebsocketClient{
+		conn:        conn,
+		Id:          randomToken(12),
+		Protocol:    protocol,
+		Version:     version,
+		ReadOnly:    mode == ModeView,
+		Suggesting:  mode == ModeSuggest,
+		User:        getUser(c),
+		RemoteAddr:  c.RealIP(),
+		ConnectedAt: time.Now(),
+		send:        make(chan outboundMessage, wcm.config.SendQueueSize),
+		done:        make(chan struct{}),
+		resumeToken: randomToken(24),
+	}
+	client.setDocumentId(documentId)
+	client.lastMessage.Store(client.ConnectedAt.UnixNano())
+	if protocol == ProtocolAutomerge && !client.ReadOnly {
+		client.ActorId = automerge.NewActorID()
+	}
 
 	wcm.lock.Lock()
+	previous := wcm.takeSuspendedClient(c.QueryParam(queryParamResume), client)
+	if previous != nil {
+		// the client continues the session of its previous connection, which is still counted
+		client.Id = previous.Id
+		client.ActorId = previous.ActorId
+	} else {
+		if reason := wcm.checkConnectionLimits(client); reason != "" {
+			wcm.lock.Unlock()
+			wcm.closeWithReason(conn, websocket.ClosePolicyViolation, reason)
+			return nil
+		}
+		if client.ReadOnly {
+			wcm.viewersPerDocument[documentId] = wcm.viewersPerDocument[documentId] + 1
+		} else {
+			wcm.connectionsPerDocument[documentId] = wcm.connectionsPerDocument[documentId] + 1
+		}
+	}
 	// Register our new client
-	wcm.clients[client] = documentId
-	wcm.connectionsPerDocument[documentId] = wcm.connectionsPerDocument[documentId] + 1
+	wcm.clients[client] = true
 	wcm.lock.Unlock()
 
-	err = wcm.onNewClient(client, d)
+	// Make sure we Close the connection when the function returns
+	defer wcm.disconnectClient(client)
+
+	wcm.extendReadDeadline(client)
+	conn.SetPongHandler(func(string) error {
+		wcm.extendReadDeadline(client)
+		return nil
+	})
+	go wcm.writePump(client)
+
+	err = wcm.sendSession(client, previous != nil)
 	if err != nil {
 		return err
 	}
+	if previous != nil {
+		for _, onClientResumed := range wcm.onClientResumed {
+			err = onClientResumed(previous, client, d)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, onNewClient := range wcm.onNewClient {
+			err = onNewClient(client, d)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	for {
-		request, err := wcm.parseRequestBody(client)
+		request, err := wcm.readRequest(client)
+		wcm.extendReadDeadline(client)
+		client.lastMessage.Store(time.Now().UnixNano())
+		client.messagesReceived.Add(1)
+		var messageErr *messageError
+		if errors.As(err, &messageErr) {
+			// the connection is still usable, only this message is skipped
+			wcm.handleRequestError(client, messageErr.requestId, messageErr.code, messageErr.err)
+			continue
+		}
 		if err != nil {
-			log.Printf("%v: error: %v", client.RemoteAddr(), err)
+			client.closedByClient = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+			wcm.handleReadError(conn, err)
 			break
 		}
 
-		switch request.(type) {
-		//case InitialContentRequest:
-		case EditRequest:
-			// Send the newly received message to the broadcast channel
-			err = wcm.handleIncomingMessage(client, request.(EditRequest))
-			if err != nil {
-				log.Printf("%v: error: %v", client.RemoteAddr(), err)
-				break
-			}
-		case SyncRequest:
-			err = wcm.handleSyncRequest(client, request.(SyncRequest))
-			if err != nil {
-				log.Printf("%v: error: %v", client.RemoteAddr(), err)
-				break
-			}
-		default:
-			log.Printf("%v: error: invalid message type: %v", client.RemoteAddr(), request)
+		wcm.handleRequest(client, request)
+	}
+
+	return nil
+}
+
+// processes a single request of the given client and tells the client if it could not be processed
+func (wcm *WebsocketConnectionManager) handleRequest(client *WebsocketClient, request interface{}) {
+	var err error
+	switch request.(type) {
+	//case InitialContentRequest:
+	case EditRequest:
+		editRequest := request.(EditRequest)
+		if client.Protocol != ProtocolDiffSync {
+			err = fmt.Errorf("edit requests are not supported by the %s protocol", client.Protocol)
+			wcm.handleRequestError(client, editRequest.RequestId, ErrorCodeUnsupportedMessage, err)
+			break
+		}
+		if client.ReadOnly {
+			wcm.handleRequestError(client, editRequest.RequestId, ErrorCodeReadOnly, errReadOnlyClient)
+			break
+		}
+		// Send the newly received message to the broadcast channel
+		err = wcm.handleIncomingMessage(client, editRequest)
+		if err != nil {
+			wcm.handleRequestError(client, editRequest.RequestId, ErrorCodeRequestFailed, err)
+			break
+		}
+	case SyncRequest:
+		syncRequest := request.(SyncRequest)
+		if client.Protocol != ProtocolAutomerge {
+			err = fmt.Errorf("sync requests are not supported by the %s protocol", client.Protocol)
+			wcm.handleRequestError(client, syncRequest.RequestId, ErrorCodeUnsupportedMessage, err)
+			break
+		}
+		// read-only clients still have to tell the server which changes they already know
+		if client.ReadOnly && syncRequest.ContainsChanges() {
+			wcm.handleRequestError(client, syncRequest.RequestId, ErrorCodeReadOnly, errReadOnlyClient)
+			break
+		}
+		// the message is discarded, the client has to send its changes again later
+		if allowed, retryAfter := wcm.rateLimits.AllowSyncMessage(client); !allowed {
+			wcm.handleRequestError(client, syncRequest.RequestId, ErrorCodeRateLimited, &rateLimitError{retryAfter: retryAfter})
+			break
+		}
+		err = wcm.handleSyncRequest(client, syncRequest)
+		if err != nil {
+			wcm.handleRequestError(client, syncRequest.RequestId, ErrorCodeRequestFailed, err)
 			break
 		}
+	case FlushRequest:
+		flushRequest := request.(FlushRequest)
+		err = wcm.handleFlush(client, flushRequest)
+		if err != nil {
+			wcm.handleRequestError(client, flushRequest.RequestId, ErrorCodeRequestFailed, err)
+			break
+		}
+	case PresenceRequest:
+		presenceRequest := request.(PresenceRequest)
+		err = wcm.handlePresence(client, presenceRequest)
+		if err != nil {
+			wcm.handleRequestError(client, presenceRequest.RequestId, ErrorCodeRequestFailed, err)
+			break
+		}
+	case SubscriptionRequest:
+		subscriptionRequest := request.(SubscriptionRequest)
+		err = fmt.Errorf("%s messages are only supported by multiplexed connections", subscriptionRequest.Type)
+		wcm.handleRequestError(client, subscriptionRequest.RequestId, ErrorCodeUnsupportedMessage, err)
+	default:
+		log.Printf("%v: error: invalid message type: %v", client.RemoteAddr, request)
+		break
+	}
+}
+
+// returns true if the given sync protocol is supported by the server
+func isSupportedProtocol(protocol string) bool {
+	return protocol == ProtocolAutomerge || protocol == ProtocolDiffSync
+}
+
+// returns the websocket protocol version and the sync protocol (if any) selected by the given subprotocol
+func parseSubprotocol(subprotocol string) (version int, protocol string) {
+	if subprotocol == subprotocolV2 {
+		return ProtocolVersion2, ""
 	}
+	if protocol, ok := strings.CutPrefix(subprotocol, subprotocolV2+"."); ok {
+		return ProtocolVersion2, protocol
+	}
+	return ProtocolVersion1, subprotocol
+}
 
-	return nil
+// checks if the given client exceeds any connection limit, returns the reason if it does,
+// must be called with the lock held
+func (wcm *WebsocketConnectionManager) checkConnectionLimits(clientInfo *WebsocketClient) string {
+	connectionsToDocument := wcm.connectionsPerDocument[clientInfo.DocumentId()] + wcm.viewersPerDocument[clientInfo.DocumentId()]
+	if wcm.config.MaxConnectionsPerDocument > 0 && connectionsToDocument >= uint(wcm.config.MaxConnectionsPerDocument) {
+		return "too many connections to this document"
+	}
+
+	if wcm.config.MaxConnectionsPerUser > 0 {
+		connectionsOfUser := 0
+		for c := range wcm.clients {
+			if c.User.Name == clientInfo.User.Name {
+				connectionsOfUser++
+			}
+		}
+		if connectionsOfUser >= wcm.config.MaxConnectionsPerUser {
+			return "too many connections of this user"
+		}
+	}
+
+	return ""
+}
+
+// logs the reason a client could not be read from and tells the client why the connection is closed
+func (wcm *WebsocketConnectionManager) handleReadError(client *websocket.Conn, err error) {
+	log.Printf("%v: error: %v", client.RemoteAddr(), err)
+
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+	case errors.Is(err, websocket.ErrReadLimit):
+		// the websocket library already sent a close frame with websocket.CloseMessageTooBig
+	case errors.As(err, &netErr) && netErr.Timeout():
+		wcm.closeWithReason(client, websocket.CloseGoingAway, "no response to ping")
+	}
+}
+
+// sends a close frame with the given code and reason and closes the connection
+func (wcm *WebsocketConnectionManager) closeWithReason(client *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	err := client.WriteControl(websocket.CloseMessage, message, time.Now().Add(wcm.config.WriteTimeout))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Printf("%v: error sending close message: %v", client.RemoteAddr(), err)
+	}
+	_ = client.Close()
+}
+
+// queues a message for the given client, it is written by the write pump of the client
+func (wcm *WebsocketConnectionManager) writeJSON(client *WebsocketClient, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return wcm.enqueue(client, websocket.TextMessage, data)
+}
+
+// queues a binary frame for the given client, it is written by the write pump of the client
+func (wcm *WebsocketConnectionManager) writeBinary(client *WebsocketClient, data []byte) error {
+	return wcm.enqueue(client, websocket.BinaryMessage, data)
 }
 
 type SocketEntityBase struct {
@@ -118,6 +545,126 @@ type SocketEntityBase struct {
 	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
 }
 
+// ErrorMessage tells a client that one of its requests could not be processed (protocol version 2 only)
+type ErrorMessage struct {
+	Type       string `json:"type" xml:"type" form:"type" query:"type"`
+	RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+	Code       string `json:"code" xml:"code" form:"code" query:"code"`
+	Message    string `json:"message" xml:"message" form:"message" query:"message"`
+	// milliseconds after which a rate limited request may be sent again
+	RetryAfter int64 `json:"retryAfter,omitempty" xml:"retryAfter,omitempty" form:"retryAfter" query:"retryAfter"`
+}
+
+// returns the mode the given user may connect in, contributors may only suggest changes
+// and users that may not change documents at all only follow them
+func allowedMode(user *User, mode string) string {
+	switch {
+	case user.HasRole(RoleEditor):
+		return mode
+	case user.HasRole(RoleContributor) && mode != ModeView:
+		return ModeSuggest
+	default:
+		return ModeView
+	}
+}
+
+var errReadOnlyClient = errors.New("the client is connected in view mode and may not change the document")
+
+// messageError is an error in a single message of a client, the connection can still be used afterwards
+type messageError struct {
+	code      string
+	requestId string
+	err       error
+}
+
+func (e *messageError) Error() string {
+	return e.err.Error()
+}
+
+// rateLimitError rejects a message of a client that sends more messages than allowed
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %d ms", e.retryAfter.Milliseconds())
+}
+
+// FlushRequest asks the server to write the document to disk right away,
+// it is acknowledged with a PersistenceState with the same request id
+type FlushRequest struct {
+	Type       string `json:"type" xml:"type" form:"type" query:"type"`
+	RequestId  string `json:"requestId" xml:"requestId" form:"requestId" query:"requestId"`
+	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+}
+
+// reads the next request of the given client in the format of its websocket protocol version
+func (wcm *WebsocketConnectionManager) readRequest(client *WebsocketClient) (request interface{}, err error) {
+	if client.Version >= ProtocolVersion2 {
+		return wcm.parseEnvelope(client.conn)
+	}
+	return wcm.parseRequestBody(client.conn)
+}
+
+// reads a single frame containing a whole request (protocol version 2),
+// sync requests may be sent as binary frames
+func (wcm *WebsocketConnectionManager) parseEnvelope(
+	client *websocket.Conn,
+) (request interface{}, err error) {
+	messageType, data, err := client.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType == websocket.BinaryMessage {
+		syncRequest, err := decodeSyncRequestFrame(data)
+		if err != nil {
+			return nil, &messageError{code: ErrorCodeInvalidMessage, err: err}
+		}
+		if syncRequest.Type != TypeSyncRequest {
+			err = fmt.Errorf("binary frames are not supported for message type: %s", syncRequest.Type)
+			return nil, &messageError{code: ErrorCodeUnsupportedMessage, requestId: syncRequest.RequestId, err: err}
+		}
+		return syncRequest, nil
+	}
+
+	var envelope SocketEntityBase
+	err = json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, &messageError{code: ErrorCodeInvalidMessage, err: err}
+	}
+	switch envelope.Type {
+	case TypeEditRequest:
+		var editRequest EditRequest
+		err = json.Unmarshal(data, &editRequest)
+		request = editRequest
+	case TypeSyncRequest:
+		var syncRequest SyncRequest
+		err = json.Unmarshal(data, &syncRequest)
+		request = syncRequest
+	case TypeFlush:
+		var flushRequest FlushRequest
+		err = json.Unmarshal(data, &flushRequest)
+		request = flushRequest
+	case TypePresence:
+		var presenceRequest PresenceRequest
+		err = json.Unmarshal(data, &presenceRequest)
+		request = presenceRequest
+	case TypeSubscribe, TypeUnsubscribe:
+		var subscriptionRequest SubscriptionRequest
+		err = json.Unmarshal(data, &subscriptionRequest)
+		request = subscriptionRequest
+	default:
+		err = fmt.Errorf("invalid message type: %s", envelope.Type)
+		return nil, &messageError{code: ErrorCodeUnsupportedMessage, requestId: envelope.RequestId, err: err}
+	}
+	if err != nil {
+		return nil, &messageError{code: ErrorCodeInvalidMessage, requestId: envelope.RequestId, err: err}
+	}
+	return request, nil
+}
+
 func (wcm *WebsocketConnectionManager) parseRequestBody(
 	client *websocket.Conn,
 ) (request interface{}, err error) {
@@ -149,72 +696,209 @@ func (wcm *WebsocketConnectionManager) parseRequestBody(
 			return nil, err
 		}
 		return syncRequest, nil
+	case TypeFlush:
+		var flushRequest FlushRequest
+		err = client.ReadJSON(&flushRequest)
+		if err != nil {
+			return nil, err
+		}
+		return flushRequest, nil
+	case TypePresence:
+		var presenceRequest PresenceRequest
+		err = client.ReadJSON(&presenceRequest)
+		if err != nil {
+			return nil, err
+		}
+		return presenceRequest, nil
 	}
 	return nil, nil
 }
 
 // processes incoming messages from connected clients
-func (wcm *WebsocketConnectionManager) handleIncomingMessage(client *websocket.Conn, request EditRequest) (err error) {
-	fmt.Printf("%v: %s\n", client.RemoteAddr(), request)
+func (wcm *WebsocketConnectionManager) handleIncomingMessage(client *WebsocketClient, request EditRequest) (err error) {
+	fmt.Printf("%v: %s\n", client.RemoteAddr, request)
 	err = wcm.onIncomingMessage(client, request)
 	return err
 }
 
-// sends an EditRequest to the specified connection
-func (wcm *WebsocketConnectionManager) sendToClient(connection *websocket.Conn, editRequest EditRequest) (err error) {
-	err = connection.WriteJSON(editRequest)
+// sends an EditRequest to the specified client
+func (wcm *WebsocketConnectionManager) sendToClient(client *WebsocketClient, editRequest EditRequest) (err error) {
+	err = wcm.writeJSON(client, editRequest)
 	if err != nil {
-		log.Printf("%v: error writing EditRequest to websocket client: %v", connection.RemoteAddr(), err)
+		log.Printf("%v: error writing EditRequest to websocket client: %v", client.RemoteAddr, err)
 	}
 	return err
 }
 
-func (wcm *WebsocketConnectionManager) handleSyncRequest(client *websocket.Conn, request SyncRequest) (err error) {
-	fmt.Printf("%v: %s\n", client.RemoteAddr(), request)
+func (wcm *WebsocketConnectionManager) handleSyncRequest(client *WebsocketClient, request SyncRequest) (err error) {
+	fmt.Printf("%v: %s\n", client.RemoteAddr, request)
 	err = wcm.onSyncRequest(client, request)
 	return err
 }
 
-// sends an SyncRequest to the specified connection
-func (wcm *WebsocketConnectionManager) syncStateToClient(connection *websocket.Conn, syncStateRequest SyncRequest) (err error) {
-	err = connection.WriteJSON(syncStateRequest)
+// sends an SyncRequest to the specified client, as binary frame if its protocol version supports it
+func (wcm *WebsocketConnectionManager) syncStateToClient(client *WebsocketClient, syncStateRequest SyncRequest) (err error) {
+	if client.Version >= ProtocolVersion2 {
+		var frame []byte
+		frame, err = encodeSyncRequestFrame(syncStateRequest)
+		if err == nil {
+			err = wcm.writeBinary(client, frame)
+		}
+	} else {
+		err = wcm.writeJSON(client, syncStateRequest)
+	}
+	if err != nil {
+		log.Printf("%v: error writing SyncRequest to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
+
+func (wcm *WebsocketConnectionManager) handlePresence(client *WebsocketClient, request PresenceRequest) (err error) {
+	if wcm.onPresence == nil {
+		return nil
+	}
+	return wcm.onPresence(client, request)
+}
+
+// sends a PresenceRequest to the specified client
+func (wcm *WebsocketConnectionManager) sendPresenceToClient(client *WebsocketClient, presenceRequest PresenceRequest) (err error) {
+	err = wcm.writeJSON(client, presenceRequest)
+	if err != nil {
+		log.Printf("%v: error writing PresenceRequest to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
+
+func (wcm *WebsocketConnectionManager) handleFlush(client *WebsocketClient, request FlushRequest) (err error) {
+	if wcm.onFlush == nil {
+		return nil
+	}
+	return wcm.onFlush(client, request)
+}
+
+// sends a comment thread to the specified client
+func (wcm *WebsocketConnectionManager) sendComment(client *WebsocketClient, message CommentMessage) (err error) {
+	err = wcm.writeJSON(client, message)
+	if err != nil {
+		log.Printf("%v: error writing CommentMessage to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
+
+// sends a suggestion to the specified client
+func (wcm *WebsocketConnectionManager) sendSuggestion(client *WebsocketClient, message SuggestionMessage) (err error) {
+	err = wcm.writeJSON(client, message)
 	if err != nil {
-		log.Printf("%v: error writing EditRequest to websocket client: %v", connection.RemoteAddr(), err)
+		log.Printf("%v: error writing SuggestionMessage to websocket client: %v", client.RemoteAddr, err)
 	}
 	return err
 }
 
-// disconnects a client
-func (wcm *WebsocketConnectionManager) disconnectClient(conn *websocket.Conn) {
-	err := conn.Close()
+func (wcm *WebsocketConnectionManager) sendPersistenceState(client *WebsocketClient, state PersistenceState) (err error) {
+	state.Type = TypePersistenceState
+	err = wcm.writeJSON(client, state)
 	if err != nil {
-		log.Printf("%v: error closing websocket connection: %v", conn.RemoteAddr(), err)
+		log.Printf("%v: error writing PersistenceState to websocket client: %v", client.RemoteAddr, err)
+	}
+	return err
+}
+
+// logs a request of a client that could not be processed and tells the client about it
+func (wcm *WebsocketConnectionManager) handleRequestError(client *WebsocketClient, requestId string, code string, err error) {
+	// the sync strategies may report a more specific error code
+	var messageErr *messageError
+	if errors.As(err, &messageErr) {
+		code = messageErr.code
+		err = messageErr.err
+	}
+	log.Printf("%v: error: %v", client.RemoteAddr, err)
+	wcm.sendError(client, requestId, code, err)
+}
+
+// sends an ErrorMessage to the specified client, clients of protocol version 1 do not know about error messages
+func (wcm *WebsocketConnectionManager) sendError(client *WebsocketClient, requestId string, code string, err error) {
+	if client.Version < ProtocolVersion2 {
+		return
+	}
+	message := ErrorMessage{
+		Type:       TypeError,
+		RequestId:  requestId,
+		DocumentId: client.DocumentId(),
+		Code:       code,
+		Message:    err.Error(),
+	}
+	var rateLimitErr *rateLimitError
+	if errors.As(err, &rateLimitErr) {
+		message.RetryAfter = max(rateLimitErr.retryAfter.Milliseconds(), 1)
+	}
+	writeErr := wcm.writeJSON(client, message)
+	if writeErr != nil {
+		log.Printf("%v: error writing ErrorMessage to websocket client: %v", client.RemoteAddr, writeErr)
+	}
+}
+
+// disconnects a client, its state is kept for the resume grace period unless the client closed the connection itself
+func (wcm *WebsocketConnectionManager) disconnectClient(client *WebsocketClient) {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+	// the connection may already have been closed with a reason
+	err := client.conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("%v: error closing websocket connection: %v", client.RemoteAddr, err)
 	}
 
 	wcm.lock.Lock()
-	documentId := wcm.clients[conn]
+	delete(wcm.clients, client)
+	if wcm.config.ResumeGracePeriod > 0 && !client.closedByClient && !client.disconnectedByAdmin.Load() {
+		wcm.suspendClient(client)
+		wcm.lock.Unlock()
+		return
+	}
+	wcm.lock.Unlock()
 
-	connectedClientsAfterDisconnect := wcm.connectionsPerDocument[documentId] - 1
+	wcm.removeClient(client)
+}
 
-	wcm.connectionsPerDocument[documentId] = connectedClientsAfterDisconnect
-	wcm.onClientDisconnected(conn, documentId, connectedClientsAfterDisconnect)
-	delete(wcm.clients, conn)
+// forgets a disconnected client and notifies the listeners about it
+func (wcm *WebsocketConnectionManager) removeClient(client *WebsocketClient) {
+	wcm.lock.Lock()
+	documentId := client.DocumentId()
 
+	if client.ReadOnly {
+		wcm.viewersPerDocument[documentId] = wcm.viewersPerDocument[documentId] - 1
+	} else {
+		wcm.connectionsPerDocument[documentId] = wcm.connectionsPerDocument[documentId] - 1
+	}
+	// the document stays open as long as any client follows it
+	connectedClientsAfterDisconnect := wcm.connectionsPerDocument[documentId] + wcm.viewersPerDocument[documentId]
 	wcm.lock.Unlock()
+
+	for _, onClientDisconnected := range wcm.onClientDisconnected {
+		onClientDisconnected(client, documentId, connectedClientsAfterDisconnect)
+	}
 }
 
-func (wcm *WebsocketConnectionManager) SetOnNewClientListener(f func(client *websocket.Conn, document *Document) error) {
-	wcm.onNewClient = f
+func (wcm *WebsocketConnectionManager) AddOnNewClientListener(f func(client *WebsocketClient, document *Document) error) {
+	wcm.onNewClient = append(wcm.onNewClient, f)
 }
 
-func (wcm *WebsocketConnectionManager) SetOnIncomingEditRequestMessageListener(f func(client *websocket.Conn, request EditRequest) error) {
+func (wcm *WebsocketConnectionManager) SetOnIncomingEditRequestMessageListener(f func(client *WebsocketClient, request EditRequest) error) {
 	wcm.onIncomingMessage = f
 }
 
-func (wcm *WebsocketConnectionManager) SetOnSyncRequestMessageListener(f func(client *websocket.Conn, request SyncRequest) error) {
+func (wcm *WebsocketConnectionManager) SetOnSyncRequestMessageListener(f func(client *WebsocketClient, request SyncRequest) error) {
 	wcm.onSyncRequest = f
 }
 
-func (wcm *WebsocketConnectionManager) SetOnClientDisconnectedListener(f func(client *websocket.Conn, documentId string, remainingConnections uint)) {
-	wcm.onClientDisconnected = f
+func (wcm *WebsocketConnectionManager) SetOnFlushRequestListener(f func(client *WebsocketClient, request FlushRequest) error) {
+	wcm.onFlush = f
+}
+
+func (wcm *WebsocketConnectionManager) SetOnPresenceMessageListener(f func(client *WebsocketClient, request PresenceRequest) error) {
+	wcm.onPresence = f
+}
+
+func (wcm *WebsocketConnectionManager) AddOnClientDisconnectedListener(f func(client *WebsocketClient, documentId string, remainingConnections uint)) {
+	wcm.onClientDisconnected = append(wcm.onClientDisconnected, f)
 }
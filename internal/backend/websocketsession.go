@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"sort"
+	"time"
+)
+
+// WebsocketSession describes a connected websocket client for administrators,
+// multiplexed connections are listed with their document channels as separate sessions
+type WebsocketSession struct {
+	Id string `json:"id" xml:"id" form:"id" query:"id"`
+	// id of the multiplexed connection the session is a document channel of
+	ConnectionId string `json:"connectionId,omitempty" xml:"connectionId,omitempty" form:"connectionId" query:"connectionId"`
+	// document of the session, empty for multiplexed connections themselves
+	DocumentId string `json:"documentId" xml:"documentId" form:"documentId" query:"documentId"`
+	// path of the document relative to the docs directory
+	DocumentPath string `json:"documentPath" xml:"documentPath" form:"documentPath" query:"documentPath"`
+	User         string `json:"user" xml:"user" form:"user" query:"user"`
+	RemoteAddr   string `json:"remoteAddr" xml:"remoteAddr" form:"remoteAddr" query:"remoteAddr"`
+	Protocol     string `json:"protocol" xml:"protocol" form:"protocol" query:"protocol"`
+	// Version of the websocket protocol used by the client
+	Version      int       `json:"version" xml:"version" form:"version" query:"version"`
+	ReadOnly     bool      `json:"readOnly" xml:"readOnly" form:"readOnly" query:"readOnly"`
+	Suggesting   bool      `json:"suggesting" xml:"suggesting" form:"suggesting" query:"suggesting"`
+	ConnectedAt  time.Time `json:"connectedAt" xml:"connectedAt" form:"connectedAt" query:"connectedAt"`
+	LastActivity time.Time `json:"lastActivity" xml:"lastActivity" form:"lastActivity" query:"lastActivity"`
+	// number of messages received from the client
+	MessagesReceived int64 `json:"messagesReceived" xml:"messagesReceived" form:"messagesReceived" query:"messagesReceived"`
+	// number of messages sent to the client
+	MessagesSent int64 `json:"messagesSent" xml:"messagesSent" form:"messagesSent" query:"messagesSent"`
+}
+
+// GetSessions returns all connected websocket sessions, oldest first
+func (wcm *WebsocketConnectionManager) GetSessions() []WebsocketSession {
+	wcm.lock.RLock()
+	sessions := make([]WebsocketSession, 0, len(wcm.clients)+len(wcm.connections))
+	for client := range wcm.clients {
+		sessions = append(sessions, newWebsocketSession(client))
+	}
+	for connection := range wcm.connections {
+		sessions = append(sessions, newWebsocketSession(connection))
+	}
+	wcm.lock.RUnlock()
+
+	for i := range sessions {
+		if sessions[i].DocumentId == "" {
+			continue
+		}
+		if d := wcm.treeManager.GetDocument(sessions[i].DocumentId); d != nil {
+			sessions[i].DocumentPath = wcm.treeManager.RelativePath(d.Path)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	return sessions
+}
+
+// returns the description of the given client, must be called with the lock held
+func newWebsocketSession(client *WebsocketClient) WebsocketSession {
+	session := WebsocketSession{
+		Id:               client.Id,
+		DocumentId:       client.DocumentId(),
+		User:             client.User.Name,
+		RemoteAddr:       client.RemoteAddr,
+		Protocol:         client.Protocol,
+		Version:          client.Version,
+		ReadOnly:         client.ReadOnly,
+		Suggesting:       client.Suggesting,
+		ConnectedAt:      client.ConnectedAt,
+		LastActivity:     client.lastActive(),
+		MessagesReceived: client.messagesReceived.Load(),
+		MessagesSent:     client.messagesSent.Load(),
+	}
+	if client.connection != nil {
+		session.ConnectionId = client.connection.Id
+	}
+	return session
+}
+
+// DisconnectSession writes the pending changes of the session with the given id and closes it,
+// the client may not resume the session afterwards, returns false if there is no such session
+func (wcm *WebsocketConnectionManager) DisconnectSession(id string) (WebsocketSession, bool) {
+	wcm.lock.RLock()
+	var client *WebsocketClient
+	for c := range wcm.clients {
+		if c.Id == id {
+			client = c
+		}
+	}
+	for c := range wcm.connections {
+		if c.Id == id {
+			client = c
+		}
+	}
+	if client == nil {
+		wcm.lock.RUnlock()
+		return WebsocketSession{}, false
+	}
+	session := newWebsocketSession(client)
+	// all channels of a multiplexed connection are closed along with it
+	documentClients := []*WebsocketClient{client}
+	if client.channels != nil {
+		documentClients = documentClients[:0]
+		for _, channel := range client.channels {
+			documentClients = append(documentClients, channel)
+		}
+	}
+	wcm.lock.RUnlock()
+
+	log.Printf("%v: disconnecting session %s on behalf of an administrator", client.RemoteAddr, id)
+	client.disconnectedByAdmin.Store(true)
+	for _, documentClient := range documentClients {
+		err := wcm.handleFlush(documentClient, FlushRequest{Type: TypeFlush, DocumentId: documentClient.DocumentId()})
+		if err != nil {
+			log.Printf("%v: unable to flush document %s: %v", client.RemoteAddr, documentClient.DocumentId(), err)
+		}
+	}
+	// the persistence state of the flush is delivered before the connection is closed
+	wcm.closeClientAfterPending(client, websocket.ClosePolicyViolation, "disconnected by an administrator")
+	return session, true
+}
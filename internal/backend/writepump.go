@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"log"
+	"net"
+	"time"
+)
+
+var errClientDisconnected = errors.New("client has been disconnected")
+
+// outboundMessage is a message waiting in the send queue of a client
+type outboundMessage struct {
+	messageType int
+	data        []byte
+	// close code of a queued close request, the connection is closed when the request is reached
+	closeCode int
+}
+
+// queues a message for the given client, a client whose send queue is full does not keep up
+// with the messages of the document and is disconnected
+func (wcm *WebsocketConnectionManager) enqueue(client *WebsocketClient, messageType int, data []byte) error {
+	select {
+	case <-client.done:
+		return errClientDisconnected
+	default:
+	}
+	if client.connection != nil {
+		// document channels are written by the write pump of their multiplexed connection
+		err := wcm.enqueue(client.connection, messageType, data)
+		if err == nil {
+			client.messagesSent.Add(1)
+		}
+		return err
+	}
+
+	select {
+	case client.send <- outboundMessage{messageType: messageType, data: data}:
+		client.messagesSent.Add(1)
+		return nil
+	default:
+		wcm.closeClient(client, websocket.CloseTryAgainLater, "client does not keep up with messages")
+		return errClientDisconnected
+	}
+}
+
+// writes all queued messages of the given client to its connection and pings the client in the configured interval,
+// this is the only goroutine writing messages to the connection
+func (wcm *WebsocketConnectionManager) writePump(client *WebsocketClient) {
+	ticker := time.NewTicker(wcm.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case message := <-client.send:
+			if message.closeCode != 0 {
+				wcm.closeClient(client, message.closeCode, string(message.data))
+				return
+			}
+			_ = client.conn.SetWriteDeadline(time.Now().Add(wcm.config.WriteTimeout))
+			err := client.conn.WriteMessage(message.messageType, message.data)
+			if err != nil {
+				log.Printf("%v: error writing message: %v", client.RemoteAddr, err)
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					wcm.closeClient(client, websocket.CloseTryAgainLater, "client does not keep up with messages")
+				} else {
+					wcm.closeClient(client, websocket.CloseGoingAway, "write failed")
+				}
+				return
+			}
+		case <-ticker.C:
+			if wcm.isIdle(client) {
+				wcm.closeClient(client, websocket.CloseGoingAway, "idle timeout")
+				return
+			}
+			err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wcm.config.WriteTimeout))
+			if err != nil {
+				log.Printf("%v: error sending ping: %v", client.RemoteAddr, err)
+				wcm.closeClient(client, websocket.CloseGoingAway, "ping failed")
+				return
+			}
+		}
+	}
+}
+
+// extends the time the connection of the given client may take to deliver its next frame,
+// a client that neither sends messages nor answers pings within that time is considered dead
+func (wcm *WebsocketConnectionManager) extendReadDeadline(client *WebsocketClient) {
+	_ = client.conn.SetReadDeadline(time.Now().Add(wcm.config.PingInterval + wcm.config.PongTimeout))
+}
+
+// stops the write pump of the given client and closes its connection with the given code and reason,
+// the read loop of the client notices the closed connection and disconnects the client,
+// document channels of multiplexed connections are unsubscribed instead, the connection stays open
+func (wcm *WebsocketConnectionManager) closeClient(client *WebsocketClient, code int, reason string) {
+	if client.connection != nil {
+		client.closeOnce.Do(func() {
+			log.Printf("%v: closing channel of document %s: %s", client.RemoteAddr, client.DocumentId(), reason)
+			close(client.done)
+			// the caller may hold locks of the sync strategies, which are needed to remove the client
+			go wcm.unsubscribe(client, "", reason)
+		})
+		return
+	}
+	client.closeOnce.Do(func() {
+		log.Printf("%v: closing connection: %s", client.RemoteAddr, reason)
+		close(client.done)
+		wcm.closeWithReason(client.conn, code, reason)
+	})
+}
+
+// closes the connection of the given client with the given code and reason once all messages queued before
+// have been written, document channels of multiplexed connections are closed right away
+func (wcm *WebsocketConnectionManager) closeClientAfterPending(client *WebsocketClient, code int, reason string) {
+	if client.connection != nil {
+		wcm.closeClient(client, code, reason)
+		return
+	}
+	select {
+	case client.send <- outboundMessage{data: []byte(reason), closeCode: code}:
+	default:
+		wcm.closeClient(client, code, reason)
+	}
+}
+
+// returns whether the given client has not sent a message within the read timeout and is to be disconnected,
+// clients that only follow documents in view mode do not send messages on their own and are never idle,
+// their pongs keep the connection alive instead
+func (wcm *WebsocketConnectionManager) isIdle(client *WebsocketClient) bool {
+	if time.Since(client.lastActive()) <= wcm.config.ReadTimeout || client.ReadOnly {
+		return false
+	}
+	if client.channels == nil {
+		return true
+	}
+
+	wcm.lock.RLock()
+	defer wcm.lock.RUnlock()
+	if len(client.channels) == 0 {
+		return true
+	}
+	for _, channel := range client.channels {
+		if !channel.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// DocumentId returns the id of the document the client is connected to
+func (client *WebsocketClient) DocumentId() string {
+	documentId, _ := client.documentId.Load().(string)
+	return documentId
+}
+
+// moves the client to the document with the given id
+func (client *WebsocketClient) setDocumentId(documentId string) {
+	client.documentId.Store(documentId)
+}
+
+// returns the time of the last message received from the given client
+func (client *WebsocketClient) lastActive() time.Time {
+	return time.Unix(0, client.lastMessage.Load())
+}
@@ -1,10 +1,11 @@
 package configuration
 
 import (
+	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
-	"log"
 	"path/filepath"
+	"time"
 )
 
 const mkdocsConfigFileDefaultName = "mkdocsrest.yaml"
@@ -12,12 +13,13 @@ const mkdocsConfigFileDefaultName = "mkdocsrest.yaml"
 type Configuration struct {
 	Server ServerConfiguration `yaml:"server"`
 	MkDocs MkDocsConfiguration `yaml:"mkdocs"`
+	Sync   SyncConfiguration   `yaml:"sync"`
 }
 
 var CurrentConfig Configuration
 
-// InitConfig does a one time setup for the configuration file
-func InitConfig(cfgFile string) {
+// InitConfig does a one time setup for the configuration file, returns an error if it cannot be read or contains invalid values
+func InitConfig(cfgFile string) error {
 	viper.SetConfigName("mkdocsrest")
 
 	if cfgFile != "" {
@@ -28,7 +30,7 @@ func InitConfig(cfgFile string) {
 		home, err := homedir.Dir()
 		if err != nil {
 			//ui.ErrorAndNotify("Path Error", "Couldn't detect home directory: %v", err)
-			log.Fatalf("Couldn't detect home directory: %v", err)
+			return fmt.Errorf("couldn't detect home directory: %v", err)
 		}
 
 		viper.AddConfigPath(".")
@@ -40,14 +42,26 @@ func InitConfig(cfgFile string) {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading configuration file, %s", err)
+		return fmt.Errorf("error reading configuration file, %s", err)
 	}
 	err := viper.Unmarshal(&CurrentConfig)
 	if err != nil {
-		log.Fatalf("unable to decode into struct, %v", err)
+		return fmt.Errorf("unable to decode into struct, %v", err)
 	}
 
 	setDefaultValues()
+	return validate()
+}
+
+// returns an error if the configuration contains values that are not supported
+func validate() error {
+	switch CurrentConfig.Sync.DefaultProtocol {
+	case "automerge", "diff-sync":
+	default:
+		return fmt.Errorf("unsupported sync protocol %q in sync.defaultProtocol, must be \"automerge\" or \"diff-sync\"",
+			CurrentConfig.Sync.DefaultProtocol)
+	}
+	return nil
 }
 
 func setDefaultValues() {
@@ -59,4 +73,95 @@ func setDefaultValues() {
 	if CurrentConfig.MkDocs.ConfigFile == "" {
 		CurrentConfig.MkDocs.ConfigFile = filepath.Join(CurrentConfig.MkDocs.ProjectPath, mkdocsConfigFileDefaultName)
 	}
+
+	if CurrentConfig.Sync.DefaultProtocol == "" {
+		CurrentConfig.Sync.DefaultProtocol = "automerge"
+	}
+	if CurrentConfig.Sync.StateDir == "" {
+		CurrentConfig.Sync.StateDir = filepath.Join(CurrentConfig.MkDocs.ProjectPath, ".mkdocsrest")
+	}
+	if CurrentConfig.Sync.CompactionInterval <= 0 {
+		CurrentConfig.Sync.CompactionInterval = 5 * time.Minute
+	}
+	if CurrentConfig.Sync.WriteDelay <= 0 {
+		CurrentConfig.Sync.WriteDelay = 2 * time.Second
+	}
+	if CurrentConfig.Sync.PresenceTimeout <= 0 {
+		CurrentConfig.Sync.PresenceTimeout = time.Minute
+	}
+	if CurrentConfig.Sync.LockLease <= 0 {
+		CurrentConfig.Sync.LockLease = 5 * time.Minute
+	}
+	if CurrentConfig.Sync.MaxLockLease <= 0 {
+		CurrentConfig.Sync.MaxLockLease = time.Hour
+	}
+
+	if CurrentConfig.Server.TLS.ClientCertRole == "" {
+		CurrentConfig.Server.TLS.ClientCertRole = "editor"
+	}
+
+	if CurrentConfig.Server.Session.CookieName == "" {
+		CurrentConfig.Server.Session.CookieName = "mkdocsrest_session"
+	}
+	if CurrentConfig.Server.Session.MaxAge <= 0 {
+		CurrentConfig.Server.Session.MaxAge = 12 * time.Hour
+	}
+	if len(CurrentConfig.Server.OIDC.Scopes) <= 0 {
+		CurrentConfig.Server.OIDC.Scopes = []string{"openid", "profile", "email"}
+	}
+	if CurrentConfig.Server.OIDC.UsernameClaim == "" {
+		CurrentConfig.Server.OIDC.UsernameClaim = "preferred_username"
+	}
+	if CurrentConfig.Server.OIDC.GroupsClaim == "" {
+		CurrentConfig.Server.OIDC.GroupsClaim = "groups"
+	}
+
+	var websocketConf = &CurrentConfig.Server.Websocket
+	if websocketConf.MaxMessageSize <= 0 {
+		websocketConf.MaxMessageSize = 16 * 1024 * 1024
+	}
+	if websocketConf.ReadTimeout <= 0 {
+		websocketConf.ReadTimeout = 10 * time.Minute
+	}
+	if websocketConf.WriteTimeout <= 0 {
+		websocketConf.WriteTimeout = 10 * time.Second
+	}
+	if websocketConf.PingInterval <= 0 {
+		websocketConf.PingInterval = 30 * time.Second
+	}
+	if websocketConf.PongTimeout <= 0 {
+		websocketConf.PongTimeout = 10 * time.Second
+	}
+	if websocketConf.SendQueueSize <= 0 {
+		websocketConf.SendQueueSize = 256
+	}
+	if websocketConf.ResumeGracePeriod == 0 {
+		websocketConf.ResumeGracePeriod = 30 * time.Second
+	}
+
+	var rateLimit = &CurrentConfig.Server.RateLimit
+	if rateLimit.AuthFailures.MaxFailures == 0 {
+		rateLimit.AuthFailures.MaxFailures = 5
+	}
+	if rateLimit.AuthFailures.Window <= 0 {
+		rateLimit.AuthFailures.Window = 15 * time.Minute
+	}
+	if rateLimit.AuthFailures.Lockout <= 0 {
+		rateLimit.AuthFailures.Lockout = 15 * time.Minute
+	}
+	setDefaultRequestRate(&rateLimit.Mutations, 10, 10, 20)
+	setDefaultRequestRate(&rateLimit.WebsocketConnections, 1, 1, 10)
+	setDefaultRequestRate(&rateLimit.SyncMessages, 50, 50, 100)
+}
+
+func setDefaultRequestRate(c *RequestRateConfiguration, perIp float64, perUser float64, burst int) {
+	if c.PerIp == 0 {
+		c.PerIp = perIp
+	}
+	if c.PerUser == 0 {
+		c.PerUser = perUser
+	}
+	if c.Burst <= 0 {
+		c.Burst = burst
+	}
 }
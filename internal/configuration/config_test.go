@@ -0,0 +1,45 @@
+package configuration
+
+import (
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitConfigValidatesDefaultProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		invalid  bool
+	}{
+		{name: "not set", config: "sync: {}\n", expected: "automerge"},
+		{name: "automerge", config: "sync:\n  defaultProtocol: automerge\n", expected: "automerge"},
+		{name: "diff-sync", config: "sync:\n  defaultProtocol: diff-sync\n", expected: "diff-sync"},
+		{name: "unknown", config: "sync:\n  defaultProtocol: ot\n", invalid: true},
+		{name: "wrong case", config: "sync:\n  defaultProtocol: Automerge\n", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			CurrentConfig = Configuration{}
+			t.Cleanup(func() {
+				viper.Reset()
+				CurrentConfig = Configuration{}
+			})
+
+			cfgFile := filepath.Join(t.TempDir(), "mkdocsrest.yaml")
+			if err := os.WriteFile(cfgFile, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := InitConfig(cfgFile)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("expected invalid = %v, got error %v", tt.invalid, err)
+			}
+			if !tt.invalid && CurrentConfig.Sync.DefaultProtocol != tt.expected {
+				t.Fatalf("expected protocol %q, got %q", tt.expected, CurrentConfig.Sync.DefaultProtocol)
+			}
+		})
+	}
+}
@@ -1,11 +1,36 @@
 package configuration
 
+import "time"
+
 type (
 	ServerConfiguration struct {
 		Host      string                      `yaml:"host"`
 		Port      int                         `yaml:"port"`
+		TLS       TLSConfiguration            `yaml:"tls"`
 		BasicAuth AuthenticationConfiguration `yaml:"basicAuth"`
+		OIDC      OIDCConfiguration           `yaml:"oidc"`
+		Session   SessionConfiguration        `yaml:"session"`
 		CORS      CorsConfiguration           `yaml:"cors"`
+		Audit     AuditConfiguration          `yaml:"audit"`
+		RateLimit RateLimitConfiguration      `yaml:"rateLimit"`
+		Websocket WebsocketConfiguration      `yaml:"websocket"`
+		// addresses or CIDR ranges of reverse proxies whose "X-Forwarded-For" header is trusted,
+		// the remote address of the connection is used if empty
+		TrustedProxies []string `yaml:"trustedProxies"`
+	}
+
+	TLSConfiguration struct {
+		// certificate and private key (PEM), changes to the files are picked up without a restart
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+		// generate a self-signed certificate (for development) if the certificate files do not exist
+		SelfSigned bool `yaml:"selfSigned"`
+		// port of a plain HTTP listener that redirects all requests to HTTPS, 0 to disable
+		RedirectPort int `yaml:"redirectPort"`
+		// CA certificates (PEM) used to verify client certificates, requires mutual TLS if set
+		ClientCAFile string `yaml:"clientCAFile"`
+		// role of users authenticated by a client certificate
+		ClientCertRole string `yaml:"clientCertRole"`
 	}
 
 	AuthenticationConfiguration struct {
@@ -13,8 +38,102 @@ type (
 		Password string `yaml:"password"`
 	}
 
+	OIDCConfiguration struct {
+		// URL of the identity provider, used for discovery via "/.well-known/openid-configuration"
+		Issuer       string `yaml:"issuer"`
+		ClientId     string `yaml:"clientId"`
+		ClientSecret string `yaml:"clientSecret"`
+		// URL of the "/auth/callback/" endpoint of this server, as registered at the identity provider
+		RedirectUrl string   `yaml:"redirectUrl"`
+		Scopes      []string `yaml:"scopes"`
+		// name of the ID token claim used as user name
+		UsernameClaim string `yaml:"usernameClaim"`
+		// name of the ID token claim containing the group memberships of the user
+		GroupsClaim string `yaml:"groupsClaim"`
+		// mapping of identity provider groups to server roles
+		Roles []OIDCRoleMapping `yaml:"roles"`
+		// role of users that are not a member of any mapped group, empty to deny access
+		DefaultRole string `yaml:"defaultRole"`
+	}
+
+	OIDCRoleMapping struct {
+		Group string `yaml:"group"`
+		Role  string `yaml:"role"`
+	}
+
+	SessionConfiguration struct {
+		CookieName string        `yaml:"cookieName"`
+		MaxAge     time.Duration `yaml:"maxAge"`
+	}
+
+	AuditConfiguration struct {
+		// path of the JSONL file all mutating operations are appended to, empty to disable the audit log
+		File string `yaml:"file"`
+	}
+
+	RateLimitConfiguration struct {
+		// failed login attempts, per remote address and per user name
+		AuthFailures AuthFailureLimitConfiguration `yaml:"authFailures"`
+		// requests to REST endpoints that change data
+		Mutations RequestRateConfiguration `yaml:"mutations"`
+		// new websocket connections
+		WebsocketConnections RequestRateConfiguration `yaml:"websocketConnections"`
+		// sync messages received via websocket connections
+		SyncMessages RequestRateConfiguration `yaml:"syncMessages"`
+	}
+
+	AuthFailureLimitConfiguration struct {
+		// number of failures within the window that causes a lockout, negative to disable
+		MaxFailures int           `yaml:"maxFailures"`
+		Window      time.Duration `yaml:"window"`
+		Lockout     time.Duration `yaml:"lockout"`
+	}
+
+	// RequestRateConfiguration limits a rate per second using a token bucket, negative rates disable the limit
+	RequestRateConfiguration struct {
+		PerIp   float64 `yaml:"perIp"`
+		PerUser float64 `yaml:"perUser"`
+		Burst   int     `yaml:"burst"`
+	}
+
+	WebsocketConfiguration struct {
+		// maximum size of a single incoming message in bytes
+		MaxMessageSize int64 `yaml:"maxMessageSize"`
+		// maximum number of concurrent connections, 0 for no limit
+		MaxConnectionsPerDocument int `yaml:"maxConnectionsPerDocument"`
+		MaxConnectionsPerUser     int `yaml:"maxConnectionsPerUser"`
+		// time a client may take to send its next message, pings and pongs do not count,
+		// clients in view mode are not disconnected for being idle
+		ReadTimeout time.Duration `yaml:"readTimeout"`
+		// time a client may take to receive a message
+		WriteTimeout time.Duration `yaml:"writeTimeout"`
+		// interval in which clients are pinged
+		PingInterval time.Duration `yaml:"pingInterval"`
+		// time a client may take to answer a ping before it is considered dead
+		PongTimeout time.Duration `yaml:"pongTimeout"`
+		// maximum number of messages waiting to be sent to a client, clients that do not keep up are disconnected
+		SendQueueSize int `yaml:"sendQueueSize"`
+		// time the state of a disconnected client is kept, so it can resume its session, negative to disable
+		ResumeGracePeriod time.Duration `yaml:"resumeGracePeriod"`
+	}
+
 	CorsConfiguration struct {
 		AllowedOrigins []string `yaml:"allowedOrigins"`
 		AllowedMethods []string `yaml:"allowedMethods"`
 	}
 )
+
+// IsEnabled returns true if the server should use TLS
+func (c TLSConfiguration) IsEnabled() bool {
+	return c.SelfSigned || (c.CertFile != "" && c.KeyFile != "")
+}
+
+// IsMutualTLSEnabled returns true if clients have to authenticate using a client certificate
+func (c TLSConfiguration) IsMutualTLSEnabled() bool {
+	return c.IsEnabled() && c.ClientCAFile != ""
+}
+
+// IsEnabled returns true if OpenID Connect login has been configured
+func (c OIDCConfiguration) IsEnabled() bool {
+	return c.Issuer != "" && c.ClientId != ""
+}
@@ -0,0 +1,20 @@
+package configuration
+
+import "time"
+
+type SyncConfiguration struct {
+	// sync protocol used by clients that do not choose one when connecting, "automerge" or "diff-sync"
+	DefaultProtocol string `yaml:"defaultProtocol"`
+	// directory the collaborative editing state of the documents is stored in
+	StateDir string `yaml:"stateDir"`
+	// interval in which the stored editing state of open documents is compacted
+	CompactionInterval time.Duration `yaml:"compactionInterval"`
+	// time changes of a document are collected before they are written to disk
+	WriteDelay time.Duration `yaml:"writeDelay"`
+	// time after which the cursor of a client that has not sent any presence update is removed
+	PresenceTimeout time.Duration `yaml:"presenceTimeout"`
+	// lease of a lock whose owner does not request a specific one
+	LockLease time.Duration `yaml:"lockLease"`
+	// longest lease a lock owner may request
+	MaxLockLease time.Duration `yaml:"maxLockLease"`
+}